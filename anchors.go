@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/artyom/mdserver/render"
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// checkAnchors parses all markdown files listed in index and reports headings
+// sharing the same id to w. It returns an error if any duplicates were found.
+//
+// Renderer makes such ids unique by adding numeric suffixes to later
+// duplicates, so table of contents links still work, but links to these
+// sections from other documents may point to a wrong section.
+func (h *mdHandler) checkAnchors(w io.Writer) error {
+	files, err := markdownFiles(context.Background(), h.files(), ".", h.unlisted)
+	if err != nil {
+		return err
+	}
+	var total int
+	for _, name := range files {
+		b, err := fs.ReadFile(h.files(), name)
+		if err != nil {
+			return err
+		}
+		_, b = splitFrontMatter(b)
+		for _, d := range duplicateHeadingIDs(render.Parse(b, render.Options{Math: h.mathDir != ""})) {
+			fmt.Fprintf(w, "%s: heading id %q is used %d times\n", name, d.id, d.count)
+			total++
+		}
+	}
+	if total > 0 {
+		return fmt.Errorf("found %d duplicate heading ids", total)
+	}
+	return nil
+}
+
+type duplicateID struct {
+	id    string
+	count int
+}
+
+// duplicateHeadingIDs returns ids shared by multiple headings of document, in
+// order of their first appearance.
+func duplicateHeadingIDs(doc ast.Node) []duplicateID {
+	var ids []string
+	counts := make(map[string]int)
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if h, ok := node.(*ast.Heading); ok && entering && h.HeadingID != "" {
+			if counts[h.HeadingID]++; counts[h.HeadingID] == 1 {
+				ids = append(ids, h.HeadingID)
+			}
+		}
+		return ast.GoToNext
+	})
+	var out []duplicateID
+	for _, id := range ids {
+		if counts[id] > 1 {
+			out = append(out, duplicateID{id: id, count: counts[id]})
+		}
+	}
+	return out
+}
+
+// anchorMarker is found in pages with heading links
+const anchorMarker = `class="anchor"`
+
+// anchorScript is embedded into pages with heading links, it copies link
+// to clipboard when it's clicked
+const anchorScript = `document.addEventListener("click", function(e) {
+	var a = e.target.closest && e.target.closest("a.anchor");
+	if (!a || !navigator.clipboard) return;
+	navigator.clipboard.writeText(a.href).then(function() {
+		a.classList.add("copied");
+		setTimeout(function() { a.classList.remove("copied"); }, 1500);
+	});
+});`
+
+var anchorScriptHash = styleHash(anchorScript)
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// apiPrefix is a path prefix of JSON API endpoints
+const apiPrefix = "/api/"
+
+// apiDoc describes markdown document in JSON API responses
+type apiDoc struct {
+	Path     string    `json:"path"`
+	Title    string    `json:"title"`
+	Tags     []string  `json:"tags,omitempty"`
+	Modified time.Time `json:"mtime"`
+}
+
+type apiSearchResult struct {
+	Path    string `json:"path"`
+	Title   string `json:"title"`
+	Count   int    `json:"count"`             // number of matching lines
+	Snippet string `json:"snippet,omitempty"` // html excerpt with matches highlighted
+	Anchor  string `json:"anchor,omitempty"`  // id of heading preceding the first match
+}
+
+type apiSearchResponse struct {
+	Results    []apiSearchResult `json:"results"`
+	Incomplete bool              `json:"incomplete,omitempty"` // search timed out
+}
+
+type apiPage struct {
+	apiDoc
+	Description string `json:"description,omitempty"`
+	HTML        string `json:"html,omitempty"`
+	Markdown    string `json:"markdown,omitempty"` // set instead of HTML on ?raw
+}
+
+// serveAPI handles JSON API requests: /api/index lists markdown files,
+// /api/files lists names and titles of all documents,
+// /api/search?q=term searches them if search is enabled, /api/page/name.md
+// returns document rendered, or as is on ?raw, and /api/graph returns link
+// graph.
+func (h *mdHandler) serveAPI(w http.ResponseWriter, r *http.Request) {
+	switch p := r.URL.Path; {
+	case p == apiPrefix+"index":
+		index, err := dirIndex(r.Context(), h.files(), ".", nil, h.unlisted)
+		if err != nil {
+			apiError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		docs := make([]apiDoc, 0, len(index))
+		for _, rec := range index {
+			docs = append(docs, apiDoc{Path: rec.File, Title: rec.Title, Tags: rec.Tags, Modified: rec.ModTime})
+		}
+		writeJSON(w, docs)
+	case p == apiPrefix+"files":
+		h.serveAPIFiles(w, r)
+	case p == apiPrefix+"search" && h.withSearch:
+		mode, term := h.searchMode(r.URL.Query().Get("q"), r.URL.Query().Get("mode"))
+		index, err := h.search(r.Context(), h.searchLang(r), term, mode, readSearchScope(r.URL.Query()))
+		if _, ok := err.(queryError); ok {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := apiSearchResponse{Results: make([]apiSearchResult, 0, len(index)), Incomplete: err != nil}
+		for _, rec := range index {
+			resp.Results = append(resp.Results, apiSearchResult{
+				Path: rec.File, Title: rec.Title, Count: rec.Count, Snippet: string(rec.Snippet), Anchor: rec.Anchor,
+			})
+		}
+		writeJSON(w, resp)
+	case p == graphPath && h.links != nil:
+		writeJSON(w, h.links.graph(r.Context()))
+	case strings.HasPrefix(p, apiPrefix+"page/"):
+		h.serveAPIPage(w, r, strings.TrimPrefix(p, apiPrefix+"page"))
+	default:
+		apiError(w, "unknown API endpoint", http.StatusNotFound)
+	}
+}
+
+// serveAPIPage responds with markdown document at upath, ".md" suffix of
+// which may be omitted
+func (h *mdHandler) serveAPIPage(w http.ResponseWriter, r *http.Request, upath string) {
+	p := path.Clean(upath)
+	if !strings.HasSuffix(p, mdSuffix) {
+		p += mdSuffix
+	}
+	name := fsName(p)
+	if containsDotDot(p) || !h.insideRoot(name) {
+		apiError(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	if h.excluded(name) {
+		apiError(w, "not found", http.StatusNotFound)
+		return
+	}
+	st, err := fs.Stat(h.files(), name)
+	if err == nil && !st.Mode().IsRegular() {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+			apiError(w, "not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("api %q: %v", name, err)
+		apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if h.maxSize > 0 && st.Size() > h.maxSize {
+		apiError(w, errTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	b, err := fs.ReadFile(h.files(), name)
+	if err != nil {
+		log.Printf("api %q: %v", name, err)
+		apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	body, meta, _ := h.renderBody(name, b)
+	page := apiPage{
+		apiDoc:      apiDoc{Path: name, Title: meta.Title, Tags: meta.Tags, Modified: st.ModTime()},
+		Description: meta.Description,
+		HTML:        string(body),
+	}
+	if hasQueryKey(r.URL.RawQuery, "raw") {
+		page.HTML, page.Markdown = "", string(b)
+	}
+	writeJSON(w, page)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-cache")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		log.Printf("api: %v", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// tokenCookie is a cookie name access token is kept in once it was passed
+// as "token" query parameter
+const tokenCookie = "mdserver-token"
+
+// auth is a middleware rejecting requests without valid credentials: either
+// basic auth user and password, or access token. Token can be passed in
+// "Authorization: Bearer" header, or as "token" query parameter, in which
+// case it's saved in a cookie and client is redirected to the same url
+// without it. Health checks are not authenticated.
+type auth struct {
+	next     http.Handler
+	user     string // if not empty, basic auth is accepted
+	password string
+	token    string // if not empty, token is accepted
+}
+
+func (a *auth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == healthPath || a.authorized(r) {
+		a.next.ServeHTTP(w, r)
+		return
+	}
+	if a.token != "" {
+		q := r.URL.Query()
+		if tok := q.Get("token"); tok != "" && equalSecret(tok, a.token) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     tokenCookie,
+				Value:    tok,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+			q.Del("token")
+			u := *r.URL
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.RequestURI(), http.StatusFound)
+			return
+		}
+	}
+	if a.user != "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mdserver", charset="UTF-8"`)
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// authorized reports whether request has valid credentials
+func (a *auth) authorized(r *http.Request) bool {
+	if a.user != "" {
+		if user, password, ok := r.BasicAuth(); ok &&
+			equalSecret(user, a.user) && equalSecret(password, a.password) {
+			return true
+		}
+	}
+	if a.token == "" {
+		return false
+	}
+	if s := r.Header.Get("Authorization"); strings.HasPrefix(s, "Bearer ") &&
+		equalSecret(strings.TrimPrefix(s, "Bearer "), a.token) {
+		return true
+	}
+	c, err := r.Cookie(tokenCookie)
+	return err == nil && equalSecret(c.Value, a.token)
+}
+
+// equalSecret compares strings in constant time
+func equalSecret(s, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(s), []byte(secret)) == 1
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// renderCache is an LRU cache of rendered pages limited by their total size
+type renderCache struct {
+	max int64 // max total size of cached pages, in bytes
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List // most recently used items at front
+	items map[cacheKey]*list.Element
+}
+
+// cacheKey identifies rendered page: it includes everything that rendered
+// page depends on, and which can change while server runs
+type cacheKey struct {
+	name      string
+	urlPath   string // used to build breadcrumbs
+	plain     bool
+	kind      plainKind
+	print     bool
+	view      viewPrefs
+	deps      string // other files page is built with, see pageDeps
+	mtime     int64  // file modification time, in nanoseconds
+	size      int64  // file size
+	styleTime int64  // when stylesheet was reloaded, in nanoseconds
+	width     int    // width of resized image, see serveResizedImage
+}
+
+type cacheItem struct {
+	key  cacheKey
+	page []byte
+}
+
+func newRenderCache(max int64) *renderCache {
+	return &renderCache{max: max, ll: list.New(), items: make(map[cacheKey]*list.Element)}
+}
+
+// get returns cached page, the returned slice must not be modified
+func (c *renderCache) get(key cacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*cacheItem).page, true
+}
+
+// add puts page into cache, evicting least recently used pages if needed.
+// Page must not be modified after this call.
+func (c *renderCache) add(key cacheKey, page []byte) {
+	if int64(len(page)) > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&cacheItem{key: key, page: page})
+	c.size += int64(len(page))
+	for c.size > c.max {
+		el := c.ll.Back()
+		item := el.Value.(*cacheItem)
+		c.ll.Remove(el)
+		delete(c.items, item.key)
+		c.size -= int64(len(item.page))
+	}
+}
+
+// clear removes all pages from cache
+func (c *renderCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[cacheKey]*list.Element)
+	c.size = 0
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// configFileName is a name of config file in served directory which is used
+// if no -config flag is given
+const configFileName = ".mdserver.toml"
+
+// isConfigFile reports whether file name at any depth is named like
+// configFileName, ignoring case.
+func isConfigFile(name string) bool {
+	return strings.EqualFold(path.Base(name), configFileName)
+}
+
+// dirSettings are settings allowed in configFileName found in served
+// directory. Its content is controlled by whoever can write documents, so
+// settings running commands, reading or writing other files, changing
+// access control or sanitizing are only accepted from file given with
+// -config.
+var dirSettings = map[string]bool{
+	"github": true, "redirect": true, "search": true, "rootindex": true,
+	"hljs": true, "exclude": true, "searchexact": true, "lang": true,
+	"searchtimeout": true, "feed": true, "datefmt": true, "plaintext": true,
+	"nocsv": true, "listings": true, "pagesize": true, "numbered": true,
+	"toc": true, "tocdepth": true, "extensions": true, "mentions": true,
+	"vars": true, "theme": true, "sort": true, "sortdesc": true,
+	"backlinks": true, "orphans": true, "deadends": true, "noemoji": true,
+	"noanchors": true, "quickopen": true, "nogit": true,
+}
+
+// loadConfig reads settings from config file name and sets flags of fset
+// with them, except flags already set on command line. If name is empty,
+// configFileName in dir is used if it exists.
+func loadConfig(fset *flag.FlagSet, name, dir string) error {
+	var allowed map[string]bool
+	if name == "" {
+		allowed = dirSettings
+		if st, err := os.Stat(dir); err == nil && !st.IsDir() {
+			// archive given with -dir
+			return nil
+		}
+		name = filepath.Join(dir, configFileName)
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	settings, err := parseConfig(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	explicit := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, s := range settings {
+		if explicit[s.key] {
+			continue
+		}
+		if fset.Lookup(s.key) == nil || s.key == "config" {
+			return fmt.Errorf("%s:%d: unknown setting %q", name, s.line, s.key)
+		}
+		if allowed != nil && !allowed[s.key] {
+			return fmt.Errorf("%s:%d: setting %q is only accepted from file given with -config",
+				name, s.line, s.key)
+		}
+		if err := fset.Set(s.key, s.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid %s value: %v", name, s.line, s.key, err)
+		}
+	}
+	return nil
+}
+
+type configSetting struct {
+	key, value string
+	line       int
+}
+
+// parseConfig parses config file having one "name = value" (TOML) or
+// "name: value" (YAML) setting per line, where names are flag names. Values
+// may be quoted, lists like ["a", "b"] are joined with commas. Empty lines
+// and lines starting with # are skipped.
+func parseConfig(r io.Reader) ([]configSetting, error) {
+	var out []configSetting
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line == "---" {
+			continue
+		}
+		i := strings.IndexAny(line, "=:")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected name = value", n)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		switch {
+		case strings.HasPrefix(value, "["):
+			value = strings.Join(splitList(value), ",")
+		case value != "" && (value[0] == '"' || value[0] == '\''):
+			value = unquote(value)
+		default:
+			if j := strings.Index(value, " #"); j >= 0 {
+				value = strings.TrimSpace(value[:j])
+			}
+		}
+		out = append(out, configSetting{key: key, value: value, line: n})
+	}
+	return out, sc.Err()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"io/fs"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artyom/mdserver/render"
+)
+
+// markupConverter is a command line of external program which reads document
+// in some markup format from stdin and writes html fragment to stdout, like
+// "pandoc -f rst -t html"
+type markupConverter []string
+
+// convertTimeout limits how long single conversion may take
+const convertTimeout = 30 * time.Second
+
+func (c markupConverter) convert(ctx context.Context, src []byte) ([]byte, error) {
+	return runFilter(ctx, c, convertTimeout, src)
+}
+
+// runFilter runs command args with input on stdin and returns its stdout
+func runFilter(ctx context.Context, args []string, timeout time.Duration, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) != 0 {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// parseConverters parses comma-separated list of ".ext=command" pairs, like
+// ".rst=pandoc -f rst -t html,.adoc=asciidoctor -s -o - -", into map of file
+// extensions to converters. Programs must be available in PATH.
+func parseConverters(list string) (map[string]markupConverter, error) {
+	out := make(map[string]markupConverter)
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("%q is not in .ext=command form", s)
+		}
+		ext, args := strings.ToLower(strings.TrimSpace(s[:i])), strings.Fields(s[i+1:])
+		if !strings.HasPrefix(ext, ".") || len(ext) == 1 || ext == mdSuffix {
+			return nil, fmt.Errorf("invalid file extension %q", ext)
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("empty command for %s files", ext)
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return nil, err
+		}
+		out[ext] = args
+	}
+	return out, nil
+}
+
+// converter returns converter of file name, or nil if its format has none
+func (h *mdHandler) converter(name string) markupConverter {
+	return h.converters[strings.ToLower(path.Ext(name))]
+}
+
+// convertedPolicy sanitizes html produced by converters
+var convertedPolicy = render.DefaultPolicy()
+
+// renderConverted converts file name with content b to sanitized html and
+// returns it along with its title
+func (h *mdHandler) renderConverted(ctx context.Context, name string, b []byte) ([]byte, string, error) {
+	out, err := h.converter(name).convert(ctx, b)
+	if err != nil {
+		return nil, "", fmt.Errorf("convert %s: %w", name, err)
+	}
+	body := out
+	switch {
+	case h.sanitize == sanitizeOff:
+	case h.policy != nil:
+		body = h.policy.SanitizeBytes(out)
+	default:
+		body = convertedPolicy.SanitizeBytes(out)
+	}
+	title := htmlTitle(body)
+	if title == "" {
+		title = nameToTitle(strings.TrimSuffix(path.Base(name), path.Ext(name)))
+	}
+	return body, title, nil
+}
+
+var headingPattern = regexp.MustCompile(`(?is)<h([1-6])\b[^>]*>(.*?)</h[1-6]>`)
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// htmlTitle returns text of the first h1 heading of html document, or of its
+// first heading of any level if it has no h1 headings
+func htmlTitle(b []byte) string {
+	var title []byte
+	for _, m := range headingPattern.FindAllSubmatch(b, -1) {
+		if title == nil {
+			title = m[2]
+		}
+		if m[1][0] == '1' {
+			title = m[2]
+			break
+		}
+	}
+	return strings.Join(strings.Fields(html.UnescapeString(string(tagPattern.ReplaceAll(title, nil)))), " ")
+}
+
+// convertedTitles caches titles of files rendered with converters
+type convertedTitles struct {
+	mu     sync.Mutex
+	titles map[string]convertedTitle
+}
+
+type convertedTitle struct {
+	mtime time.Time
+	size  int64
+	title string
+}
+
+// convertedIndex returns index records of files in dir which have
+// converters, see convertedTitle
+func (h *mdHandler) convertedIndex(ctx context.Context, dir string) []indexRecord {
+	if len(h.converters) == 0 {
+		return nil
+	}
+	var index []indexRecord
+	fsys := h.files()
+	fs.WalkDir(fsys, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() && p != "." && strings.HasPrefix(d.Name(), ".") {
+			return fs.SkipDir
+		}
+		if d.IsDir() || h.converter(p) == nil || h.unlisted(p) {
+			return nil
+		}
+		st, err := d.Info()
+		if err != nil || !st.Mode().IsRegular() {
+			return nil
+		}
+		file := p
+		if dir != "." {
+			file = strings.TrimPrefix(p, dir+"/")
+		}
+		index = append(index, indexRecord{
+			Title:   h.convertedTitle(p, st),
+			File:    file,
+			Subdir:  path.Dir(file),
+			ModTime: st.ModTime(),
+			sortKey: strings.ToLower(strings.TrimSuffix(path.Base(file), path.Ext(file))),
+		})
+		return nil
+	})
+	sort.Slice(index, func(i, j int) bool { return index[i].File < index[j].File })
+	return index
+}
+
+// convertedTitle returns title of file name rendered with converter, as
+// found when the file was last rendered, or its name turned into title if
+// it was modified since then or not rendered yet. Listings don't run
+// converters, which may take a while for every file.
+func (h *mdHandler) convertedTitle(name string, st fs.FileInfo) string {
+	c := &h.convTitles
+	c.mu.Lock()
+	t, ok := c.titles[name]
+	c.mu.Unlock()
+	if ok && t.mtime.Equal(st.ModTime()) && t.size == st.Size() {
+		return t.title
+	}
+	return nameToTitle(strings.TrimSuffix(path.Base(name), path.Ext(name)))
+}
+
+// setConvertedTitle remembers title of rendered file name of given
+// modification time and size, see convertedTitle
+func (h *mdHandler) setConvertedTitle(name string, mtime time.Time, size int64, title string) {
+	c := &h.convTitles
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.titles == nil {
+		c.titles = make(map[string]convertedTitle)
+	}
+	c.titles[name] = convertedTitle{mtime: mtime, size: size, title: title}
+}
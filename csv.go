@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"html/template"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// tableSeparators maps extensions of files rendered as tables to their field
+// separators
+var tableSeparators = map[string]rune{
+	".csv": ',',
+	".tsv": '\t',
+}
+
+// isTable reports whether file should be rendered as html table within page
+// template: it must be a regular .csv or .tsv file, and -nocsv flag must not
+// be set
+func (h *mdHandler) isTable(name string) bool {
+	if h.noCSV {
+		return false
+	}
+	if _, ok := tableSeparators[strings.ToLower(path.Ext(name))]; !ok {
+		return false
+	}
+	st, err := fs.Stat(h.files(), name)
+	return err == nil && st.Mode().IsRegular()
+}
+
+// renderTable renders CSV or TSV file name with content b as html table, using
+// its first row as table header. If file cannot be parsed, it's rendered as
+// preformatted text.
+func renderTable(name string, b []byte) []byte {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.Comma = tableSeparators[strings.ToLower(path.Ext(name))]
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	buf := new(bytes.Buffer)
+	if err != nil {
+		buf.WriteString("<pre>")
+		template.HTMLEscape(buf, b)
+		buf.WriteString("</pre>")
+		return buf.Bytes()
+	}
+	writeRow := func(tag string, rec []string) {
+		buf.WriteString("<tr>")
+		for _, field := range rec {
+			buf.WriteString("<" + tag + ">")
+			template.HTMLEscape(buf, []byte(field))
+			buf.WriteString("</" + tag + ">")
+		}
+		buf.WriteString("</tr>\n")
+	}
+	buf.WriteString("<div class=\"table\"><table>\n")
+	if len(records) != 0 {
+		buf.WriteString("<thead>\n")
+		writeRow("th", records[0])
+		buf.WriteString("</thead>\n<tbody>\n")
+		for _, rec := range records[1:] {
+			writeRow("td", rec)
+		}
+		buf.WriteString("</tbody>\n")
+	}
+	buf.WriteString("</table></div>")
+	return buf.Bytes()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// diffPath is a path prefix of diffs between page revisions, served if
+// directory is a git repository
+const diffPath = "/diff/"
+
+// diffLine is a single line of unified diff
+type diffLine struct {
+	Class string // one of "add", "del", "hunk", or empty for context
+	Text  string
+}
+
+// diff returns unified diff of file between its revisions a and b. File may
+// have different names in these revisions. If b is nil, a is compared with
+// file in work tree.
+func (g *gitRepo) diff(ctx context.Context, a, b *gitCommit, name string) ([]diffLine, error) {
+	args := []string{"diff", "--no-color", "--no-ext-diff", "--relative", "-M", a.Hash}
+	files := []string{a.file, name}
+	if b != nil {
+		args = append(args, b.Hash)
+		files[1] = b.file
+	}
+	if files[0] == files[1] {
+		files = files[:1]
+	}
+	out, err := g.run(ctx, append(append(args, "--"), files...)...)
+	if err != nil {
+		return nil, err
+	}
+	var lines []diffLine
+	for _, s := range strings.Split(string(bytes.TrimSuffix(out, []byte("\n"))), "\n") {
+		switch {
+		case strings.HasPrefix(s, "@@"):
+			lines = append(lines, diffLine{Class: "hunk", Text: s})
+		case lines == nil: // diff header
+		case strings.HasPrefix(s, "+"):
+			lines = append(lines, diffLine{Class: "add", Text: s})
+		case strings.HasPrefix(s, "-"):
+			lines = append(lines, diffLine{Class: "del", Text: s})
+		default:
+			lines = append(lines, diffLine{Text: s})
+		}
+	}
+	return lines, nil
+}
+
+// serveDiff serves diff of markdown file between revisions set by "from" and
+// "to" query parameters. If "from" is not set, revision preceding "to" is
+// used; if "to" is not set, file is compared with its current state.
+func (h *mdHandler) serveDiff(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean("/" + strings.TrimPrefix(r.URL.Path, diffPath))
+	name := fsName(p)
+	if containsDotDot(p) || !strings.HasSuffix(name, mdSuffix) || !h.insideRoot(name) {
+		http.Error(w, "invalid URL path", http.StatusBadRequest)
+		return
+	}
+	if h.excluded(name) {
+		http.NotFound(w, r)
+		return
+	}
+	commits, err := h.git.history(r.Context(), name)
+	if err != nil {
+		log.Printf("diff %q: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// only hashes of commits from file history are accepted, so arbitrary
+	// arguments never reach git
+	find := func(hash string) int {
+		for i := range commits {
+			if commits[i].Hash == hash {
+				return i
+			}
+		}
+		return -1
+	}
+	q := r.URL.Query()
+	from, to := -1, -1
+	if s := q.Get("to"); s != "" {
+		if to = find(s); to < 0 {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	switch s := q.Get("from"); {
+	case s != "":
+		from = find(s)
+	case to >= 0:
+		from = to + 1
+	default:
+		from = 0
+	}
+	if from < 0 || from >= len(commits) {
+		http.NotFound(w, r)
+		return
+	}
+	page := struct {
+		Title       string
+		StyleHref   string
+		Style       template.CSS
+		PageHref    string
+		HistoryHref string
+		Name        string
+		From, To    *gitCommit
+		Lines       []diffLine
+	}{
+		PageHref:    (&url.URL{Path: "/" + name}).String(),
+		HistoryHref: (&url.URL{Path: historyPath + name}).String(),
+		Name:        name,
+		From:        &commits[from],
+	}
+	if to >= 0 {
+		page.To = &commits[to]
+		page.Title = "Changes of " + name + " from " + page.From.Short() + " to " + page.To.Short()
+	} else {
+		page.Title = "Changes of " + name + " since " + page.From.Short()
+	}
+	if page.Lines, err = h.git.diff(r.Context(), page.From, page.To, name); err != nil {
+		log.Printf("diff %q: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	style, _ := h.styles()
+	switch {
+	case h.linkStyle:
+		page.StyleHref = style
+	default:
+		page.Style = template.CSS(style)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", h.csp(false, false))
+	if err := diffTemplate.Execute(w, page); err != nil {
+		log.Printf("diff %q: %v", name, err)
+	}
+}
+
+var diffTemplate = template.Must(template.New("diff").Parse(diffTpl))
+
+const diffTpl = `<!doctype html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="/favicon.ico">
+{{if .StyleHref}}<link rel="stylesheet" href="{{.StyleHref}}">{{end -}}
+{{if .Style}}<style>{{.Style}}</style>{{end}}
+</head><body id="mdserver-diff"><nav id="site"><a href="/?index">index</a> · <a href="{{.PageHref}}">{{.Name}}</a> · <a href="{{.HistoryHref}}">history</a></nav>
+<h1>{{.Title}}</h1>
+{{if .Lines}}<pre id="diff">{{range .Lines}}<span{{with .Class}} class="{{.}}"{{end}}>{{.Text}}
+</span>{{end}}</pre>{{else}}<p>No changes.</p>{{end}}</body>
+`
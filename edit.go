@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/artyom/mdserver/render"
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// editPath is a path prefix of endpoints changing markdown files when run
+// with -edit flag
+const editPath = "/edit/"
+
+// taskScript is embedded into pages with task lists when run with -edit
+// flag, it enables checkboxes and saves their state on change
+const taskScript = `document.addEventListener("DOMContentLoaded", function() {
+	document.querySelectorAll("article input.task-list-item-checkbox[data-task]").forEach(function(box) {
+		box.disabled = false;
+		box.addEventListener("change", function() {
+			var body = new URLSearchParams({task: box.dataset.task, checked: box.checked ? "1" : "0"});
+			fetch("` + editPath + `" + location.pathname.slice(1), {method: "POST", body: body}).then(function(resp) {
+				if (!resp.ok) throw new Error(resp.statusText);
+			}).catch(function(err) {
+				box.checked = !box.checked;
+				alert("Saving failed: " + err.message);
+			});
+		});
+	});
+});`
+
+var taskScriptHash = styleHash(taskScript)
+
+// taskMarker is how rendered task lists start, see render.Options.TaskIndexes
+const taskMarker = `data-task="`
+
+// maxEditBody limits size of requests changing files
+const maxEditBody = 32 << 20
+
+// serveEdit handles requests changing markdown files
+func (h *mdHandler) serveEdit(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		h.serveNewPage(w, r)
+		return
+	}
+	p := path.Clean("/" + strings.TrimPrefix(r.URL.Path, editPath))
+	if !strings.HasSuffix(p, mdSuffix) {
+		p += mdSuffix
+	}
+	name := fsName(p)
+	if containsDotDot(p) || !h.insideRoot(name) {
+		http.Error(w, "invalid URL path", http.StatusBadRequest)
+		return
+	}
+	if h.excluded(name) {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.serveEditor(w, r, name)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	// content is urlencoded, so it may take up to 3 times its size
+	limit := int64(maxEditBody)
+	if h.maxSize > 0 && 3*h.maxSize+4<<10 < limit {
+		limit = 3*h.maxSize + 4<<10
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var err error
+	switch _, ok := r.PostForm["content"]; {
+	case r.PostForm.Get("title") != "":
+		h.createPage(w, r, name, r.PostForm.Get("title"))
+		return
+	case ok:
+		content := []byte(r.PostForm.Get("content"))
+		err = h.updateFile(name, func(b []byte) ([]byte, error) {
+			if contentSum(b) != r.PostForm.Get("sum") {
+				return nil, errModified
+			}
+			if !bytes.Contains(b, []byte("\r\n")) {
+				// browsers submit textarea lines separated by CRLF
+				content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+			}
+			return content, nil
+		})
+		if err == nil {
+			http.Redirect(w, r, (&url.URL{Path: "/" + name}).String(), http.StatusSeeOther)
+			return
+		}
+	default:
+		var n int
+		if n, err = strconv.Atoi(r.PostForm.Get("task")); err != nil || n < 0 {
+			http.Error(w, "invalid task number", http.StatusBadRequest)
+			return
+		}
+		err = h.updateFile(name, func(b []byte) ([]byte, error) {
+			return h.toggleTask(b, n, r.PostForm.Get("checked") == "1")
+		})
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	switch {
+	case err == errTaskState, err == errModified:
+		http.Error(w, "file was modified, reload page", http.StatusConflict)
+	case errors.Is(err, fs.ErrNotExist):
+		http.NotFound(w, r)
+	default:
+		log.Printf("edit %q: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// serveNewPage handles form creating new page in directory referenced by
+// request path, with file name derived from page title
+func (h *mdHandler) serveNewPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	title := strings.TrimSpace(r.PostFormValue("title"))
+	file := pageFileName(title)
+	if file == "" {
+		http.Error(w, "invalid page title", http.StatusBadRequest)
+		return
+	}
+	dir := fsName(path.Clean("/" + strings.TrimPrefix(r.URL.Path, editPath)))
+	h.createPage(w, r, path.Join(dir, file+mdSuffix), title)
+}
+
+// createPage creates markdown file name with title as its first heading, and
+// redirects to editor of this file
+func (h *mdHandler) createPage(w http.ResponseWriter, r *http.Request, name, title string) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	if containsDotDot(name) || strings.HasPrefix(name, ".") || strings.Contains(name, "/.") ||
+		!strings.HasSuffix(name, mdSuffix) || h.excluded(name) {
+		http.Error(w, "invalid page name", http.StatusBadRequest)
+		return
+	}
+	// directories which don't exist yet can't be symlinks, so it's enough to
+	// check the closest existing one
+	dir := path.Dir(name)
+	for {
+		if _, err := fs.Stat(h.files(), dir); err == nil || dir == "." {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	if st, err := fs.Stat(h.files(), dir); err != nil || !st.IsDir() || !h.insideRoot(dir) {
+		http.Error(w, "invalid page name", http.StatusBadRequest)
+		return
+	}
+	file, err := h.filePath(name)
+	if err == nil {
+		err = createFile(file, []byte("# "+strings.TrimSpace(title)+"\n\n"))
+	}
+	switch {
+	case err == nil:
+		http.Redirect(w, r, (&url.URL{Path: editPath + name}).String(), http.StatusSeeOther)
+	case errors.Is(err, fs.ErrExist):
+		http.Error(w, "page already exists", http.StatusConflict)
+	case errors.Is(err, fs.ErrNotExist):
+		http.NotFound(w, r)
+	default:
+		log.Printf("create %q: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// createFile creates new file name with its parent directories, failing if
+// file already exists
+func createFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// pageFileName returns file name without extension for page with given
+// title: spaces are replaced with dashes, and characters other than letters,
+// digits, dashes, underscores and dots are dropped
+func pageFileName(title string) string {
+	var b strings.Builder
+	for _, r := range strings.TrimSuffix(title, mdSuffix) {
+		switch {
+		case r == ' ' || r == '-':
+			if s := b.String(); s != "" && !strings.HasSuffix(s, "-") {
+				b.WriteByte('-')
+			}
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '_', r == '.' && b.Len() != 0:
+			b.WriteRune(r)
+		}
+	}
+	return strings.TrimRight(b.String(), "-.")
+}
+
+// serveMissing serves 404 page for markdown file name offering to create it
+func (h *mdHandler) serveMissing(w http.ResponseWriter, r *http.Request, name string) {
+	page := struct {
+		Title     string
+		StyleHref string
+		Style     template.CSS
+		Href      string
+		PageTitle string
+	}{
+		Title:     "Page not found",
+		Href:      editPath + name,
+		PageTitle: nameToTitle(path.Base(name)),
+	}
+	style, _ := h.styles()
+	switch {
+	case h.linkStyle:
+		page.StyleHref = style
+	default:
+		page.Style = template.CSS(style)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", h.csp(false, false))
+	w.WriteHeader(http.StatusNotFound)
+	if err := missingTemplate.Execute(w, page); err != nil {
+		log.Printf("not found %q: %v", name, err)
+	}
+}
+
+var missingTemplate = template.Must(template.New("missing").Parse(missingTpl))
+
+const missingTpl = `<!doctype html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="/favicon.ico">
+{{if .StyleHref}}<link rel="stylesheet" href="{{.StyleHref}}">{{end -}}
+{{if .Style}}<style>{{.Style}}</style>{{end}}
+</head><body id="mdserver-missing"><nav id="site"><a href="/?index">index</a></nav>
+<h1>{{.Title}}</h1>
+<p>This page doesn't exist yet.</p>
+<form method="post" action="{{.Href}}">
+<input type="text" name="title" value="{{.PageTitle}}" required>
+<input type="submit" value="Create page"></form></body>
+`
+
+// serveEditor serves page with a form to edit markdown file name
+func (h *mdHandler) serveEditor(w http.ResponseWriter, r *http.Request, name string) {
+	b, err := fs.ReadFile(h.files(), name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("edit %q: %v", name, err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	page := struct {
+		Title     string
+		Name      string
+		PageHref  string
+		StyleHref string
+		Style     template.CSS
+		Content   string
+		Sum       string
+	}{
+		Title:    "Edit " + name,
+		Name:     name,
+		PageHref: "/" + name,
+		Content:  string(b),
+		Sum:      contentSum(b),
+	}
+	style, _ := h.styles()
+	switch {
+	case h.linkStyle:
+		page.StyleHref = style
+	default:
+		page.Style = template.CSS(style)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", h.csp(false, false))
+	if err := editorTemplate.Execute(w, page); err != nil {
+		log.Printf("edit %q: %v", name, err)
+	}
+}
+
+var editorTemplate = template.Must(template.New("editor").Parse(editorTpl))
+
+const editorTpl = `<!doctype html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="/favicon.ico">
+{{if .StyleHref}}<link rel="stylesheet" href="{{.StyleHref}}">{{end -}}
+{{if .Style}}<style>{{.Style}}</style>{{end}}
+</head><body id="mdserver-editor"><nav id="site"><a href="/?index">index</a> · <a href="{{.PageHref}}">{{.Name}}</a></nav>
+<form method="post">
+<textarea name="content" autofocus spellcheck="false">{{.Content}}</textarea>
+<input type="hidden" name="sum" value="{{.Sum}}">
+<p><input type="submit" value="Save"> <a href="{{.PageHref}}">cancel</a></p>
+</form></body>
+`
+
+// contentSum returns checksum of file content editor was opened with, used
+// to detect concurrent changes
+func contentSum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// errModified is returned when saving file which was modified since it was
+// opened in editor
+var errModified = errors.New("file was modified")
+
+// sameOrigin reports whether request is not a cross-origin one, so that
+// other sites can't change files on behalf of user
+func sameOrigin(r *http.Request) bool {
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// updateFile replaces content of file name with the result of fn applied to
+// it. File is replaced atomically.
+func (h *mdHandler) updateFile(name string, fn func([]byte) ([]byte, error)) error {
+	file, err := h.filePath(name)
+	if err != nil {
+		return err
+	}
+	h.editMu.Lock()
+	defer h.editMu.Unlock()
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if b, err = fn(b); err != nil {
+		return err
+	}
+	return writeFileAtomic(file, b)
+}
+
+// filePath returns path of file name on disk
+func (h *mdHandler) filePath(name string) (string, error) {
+	if h.mounts != nil {
+		dir, rel, ok := h.mounts.resolve(name)
+		if !ok {
+			return "", fs.ErrNotExist
+		}
+		return filepath.Join(dir, filepath.FromSlash(rel)), nil
+	}
+	if h.fsys != nil {
+		return "", errors.New("files are not on disk")
+	}
+	return filepath.Join(h.dir, filepath.FromSlash(name)), nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to name,
+// keeping permissions of existing file
+func writeFileAtomic(name string, data []byte) error {
+	perm := os.FileMode(0666)
+	if st, err := os.Stat(name); err == nil {
+		perm = st.Mode().Perm()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// errTaskState is returned by toggleTask if task is already in requested
+// state or doesn't exist, which means that page is outdated
+var errTaskState = errors.New("task not found or already in requested state")
+
+// taskLine matches lines which may start task list items, with marker state
+// as the only submatch
+var taskLine = regexp.MustCompile(`(?m)^[ \t]*(?:>[ \t]*)*(?:[-*+]|\d+[.)])[ \t]+\[([ xX])\](?:[ \t]|$)`)
+
+// taskLabel matches labels toggleTask puts after task markers, with label
+// number as the only submatch
+var taskLabel = regexp.MustCompile(`^[ \t]*\x{E000}([0-9]+)\x{E000}`)
+
+// toggleTask sets state of n-th task list item of markdown document b,
+// counting from zero, as numbered by render.Options.TaskIndexes. Lines which
+// look like task list items may be in code blocks or raw html, so to find
+// which of them is n-th item, each one is labeled after its marker, and the
+// label is taken from n-th item of document parsed the same way as when it's
+// rendered.
+func (h *mdHandler) toggleTask(b []byte, n int, checked bool) ([]byte, error) {
+	_, body := splitFrontMatter(b)
+	offset := len(b) - len(body)
+	lines := taskLine.FindAllSubmatchIndex(body, -1)
+	if len(lines) == 0 {
+		return nil, errTaskState
+	}
+	var labeled bytes.Buffer
+	var pos int
+	for i, m := range lines {
+		labeled.Write(body[pos:m[1]])
+		if m[1] == m[3]+1 {
+			// marker at the end of line
+			labeled.WriteByte(' ')
+		}
+		fmt.Fprintf(&labeled, "\uE000%d\uE000", i)
+		pos = m[1]
+	}
+	labeled.Write(body[pos:])
+	label := -1
+	var k int
+	ast.WalkFunc(render.Parse(h.substituteVars(labeled.Bytes()), h.renderOptions()), func(node ast.Node, entering bool) ast.WalkStatus {
+		item, ok := node.(*ast.ListItem)
+		if !ok || !entering || item.Attribute == nil || len(item.Classes) == 0 ||
+			string(item.Classes[0]) != "task-list-item" || len(item.Children) == 0 {
+			return ast.GoToNext
+		}
+		para, ok := item.Children[0].(*ast.Paragraph)
+		if !ok || len(para.Children) < 2 {
+			return ast.GoToNext
+		}
+		text, ok := para.Children[1].(*ast.Text)
+		if !ok {
+			return ast.GoToNext
+		}
+		if k++; k <= n {
+			return ast.GoToNext
+		}
+		if m := taskLabel.FindSubmatch(text.Literal); m != nil {
+			label, _ = strconv.Atoi(string(m[1]))
+		}
+		return ast.Terminate
+	})
+	if label < 0 || label >= len(lines) {
+		return nil, errTaskState
+	}
+	i := offset + lines[label][2]
+	if (b[i] != ' ') == checked {
+		return nil, errTaskState
+	}
+	out := append([]byte(nil), b...)
+	out[i] = ' '
+	if checked {
+		out[i] = 'x'
+	}
+	return out, nil
+}
@@ -0,0 +1,7 @@
+package main
+
+import "io/fs"
+
+// embeddedFS holds files compiled into binary built with "embed" tag, see
+// embedded.go. It's served unless -dir, -zip or -remote is given.
+var embeddedFS fs.FS
@@ -0,0 +1,23 @@
+//go:build embed
+// +build embed
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// embeddedDocs holds files from docs directory, which must be created in
+// source tree before building with "embed" tag
+//
+//go:embed all:docs
+var embeddedDocs embed.FS
+
+func init() {
+	sub, err := fs.Sub(embeddedDocs, "docs")
+	if err != nil {
+		panic(err)
+	}
+	embeddedFS = sub
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// export renders markdown files into html files in outdir, writes
+// autogenerated index.html into each directory with markdown files which
+// doesn't have one, and copies other files as is. Hidden files and
+// directories are skipped.
+func (h *mdHandler) export(outdir string) error {
+	h.exporting = true
+	// exported pages are static, features requiring server are disabled
+	h.withSearch, h.watch = false, nil
+	fsys := h.files()
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != "." && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		dst := filepath.Join(outdir, filepath.FromSlash(p))
+		if d.IsDir() {
+			if err := os.MkdirAll(dst, 0777); err != nil {
+				return err
+			}
+			return h.exportIndex(p, dst)
+		}
+		if !h.insideRoot(p) {
+			return nil
+		}
+		if strings.HasSuffix(p, mdSuffix) {
+			if h.excluded(p) {
+				return nil
+			}
+			return h.exportPage(p, strings.TrimSuffix(dst, mdSuffix)+".html")
+		}
+		return exportFile(fsys, p, dst)
+	})
+	if err != nil {
+		return err
+	}
+	if h.mathDir != "" {
+		if err := exportTree(os.DirFS(h.mathDir), filepath.Join(outdir, filepath.FromSlash(mathPath))); err != nil {
+			return err
+		}
+	}
+	if _, err := fs.Stat(fsys, fsName(faviconPath)); h.favicon != nil && (h.faviconSet || err != nil) {
+		return ioutil.WriteFile(filepath.Join(outdir, filepath.FromSlash(faviconPath)), h.favicon, 0666)
+	}
+	return nil
+}
+
+// exportPage renders markdown file name into dst
+func (h *mdHandler) exportPage(name, dst string) error {
+	rc, _, err := h.readerForFile(name)
+	if err == errTooLarge {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rc.urlPath = "/" + name
+	return writeFile(dst, rc)
+}
+
+// exportIndex writes autogenerated index of markdown files in dir into
+// dst/index.html, unless dir already has index.html or has no markdown files.
+func (h *mdHandler) exportIndex(dir, dst string) error {
+	if _, err := fs.Stat(h.files(), path.Join(dir, "index.html")); err == nil {
+		return nil
+	}
+	index, err := dirIndex(context.Background(), h.files(), dir, nil, h.unlisted)
+	if err != nil {
+		return err
+	}
+	if len(index) == 0 {
+		return nil
+	}
+	sortIndex(index, h.sortBy, h.sortDesc)
+	for i := range index {
+		index[i].File = strings.TrimSuffix(index[i].File, mdSuffix) + ".html"
+	}
+	title := "Index"
+	if dir != "." {
+		title = "Index of /" + dir + "/"
+	}
+	f, err := os.Create(filepath.Join(dst, "index.html"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := h.renderIndex(f, indexPage{Title: title, Index: index}); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// exportFile copies file name from fsys to dst, skipping anything other than
+// regular files
+func exportFile(fsys fs.FS, name, dst string) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err != nil || !st.Mode().IsRegular() {
+		return err
+	}
+	return writeFile(dst, f)
+}
+
+// exportTree copies all files from fsys into dst directory
+func exportTree(fsys fs.FS, dst string) error {
+	return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(dst, filepath.FromSlash(p))
+		if d.IsDir() {
+			return os.MkdirAll(name, 0777)
+		}
+		return exportFile(fsys, p, name)
+	})
+}
+
+func writeFile(name string, r io.Reader) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
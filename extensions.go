@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/artyom/mdserver/render"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// markdownExtensions maps names used with -extensions flag to parser
+// extensions they toggle
+var markdownExtensions = map[string]parser.Extensions{
+	"footnotes":     parser.Footnotes,
+	"deflists":      parser.DefinitionLists,
+	"strikethrough": parser.Strikethrough,
+	"hardbreaks":    parser.HardLineBreak,
+	"autolinks":     parser.Autolink,
+}
+
+// smartQuotes is -extensions name toggling replacement of quotes, dashes and
+// fractions with typographic ones, which is done by renderer, not parser
+const smartQuotes = "smartquotes"
+
+// setExtensions parses comma-separated list of extension names, each
+// prefixed with "+" to enable or "-" to disable it, and changes markdown
+// extensions of h accordingly. Names without prefix are enabled.
+func (h *mdHandler) setExtensions(list string) error {
+	ext := render.DefaultExtensions
+	noSmartypants := false
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		enable := !strings.HasPrefix(s, "-")
+		name := strings.TrimLeft(s, "+-")
+		if name == smartQuotes {
+			noSmartypants = !enable
+			continue
+		}
+		e, ok := markdownExtensions[name]
+		if !ok {
+			return fmt.Errorf("unknown extension %q, must be one of: footnotes, deflists, strikethrough, hardbreaks, autolinks, smartquotes", name)
+		}
+		if enable {
+			ext |= e
+		} else {
+			ext &^= e
+		}
+	}
+	h.extensions, h.noSmartypants = ext, noSmartypants
+	return nil
+}
+
+// mentionPlaceholder is replaced with user name in -mentions URL
+const mentionPlaceholder = "{user}"
+
+// mentionURL returns link destination of @user mention, or an empty string
+// if run without -mentions flag
+func (h *mdHandler) mentionURL(user string) string {
+	if h.mentions == "" {
+		return ""
+	}
+	return strings.Replace(h.mentions, mentionPlaceholder, url.PathEscape(user), -1)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/artyom/mdserver/render"
+)
+
+// feedPath is a path of Atom feed of recently changed documents, served with
+// -feed flag unless served directory has such file
+const feedPath = "/feed.xml"
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string    `xml:"title"`
+	ID      string    `xml:"id"`
+	Link    atomLink  `xml:"link"`
+	Updated string    `xml:"updated"`
+	Author  *atomName `xml:"author,omitempty"`
+	Summary string    `xml:"summary,omitempty"`
+}
+
+type atomName struct {
+	Name string `xml:"name"`
+}
+
+// serveFeed serves Atom feed of h.feedSize most recently changed markdown
+// documents. If directory is in git repository, documents are ordered by
+// their last commits, otherwise by modification time.
+func (h *mdHandler) serveFeed(w http.ResponseWriter, r *http.Request) {
+	index, err := dirIndex(r.Context(), h.files(), ".", nil, h.unlisted)
+	if err != nil {
+		log.Printf("feed: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	authors := make(map[string]string)
+	if h.git != nil {
+		commits := h.git.lastCommits(r.Context())
+		for i := range index {
+			if c, ok := commits[index[i].File]; ok {
+				index[i].ModTime, authors[index[i].File] = c.Time, c.Author
+			}
+		}
+	}
+	sort.SliceStable(index, func(i, j int) bool { return index[i].ModTime.After(index[j].ModTime) })
+	if len(index) > h.feedSize {
+		index = index[:h.feedSize]
+	}
+	base := h.baseURL(r)
+	feed := atomFeed{
+		Title: "Recently changed documents",
+		ID:    base.String(),
+		Links: []atomLink{
+			{Href: base.ResolveReference(&url.URL{Path: strings.TrimPrefix(feedPath, "/")}).String(), Rel: "self"},
+			{Href: base.ResolveReference(&url.URL{RawQuery: "index"}).String()},
+		},
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+	}
+	for i, rec := range index {
+		href := base.ResolveReference(&url.URL{Path: rec.File}).String()
+		e := atomEntry{
+			Title:   rec.Title,
+			ID:      href,
+			Link:    atomLink{Href: href},
+			Updated: rec.ModTime.UTC().Format(time.RFC3339),
+			Summary: h.documentSummary(r.Context(), rec.File),
+		}
+		if a := authors[rec.File]; a != "" {
+			e.Author = &atomName{Name: a}
+		}
+		if i == 0 {
+			feed.Updated = e.Updated
+		}
+		feed.Entries = append(feed.Entries, e)
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(feed); err != nil {
+		log.Printf("feed: %v", err)
+	}
+}
+
+// baseURL returns absolute url of site root set with -baseurl flag, or of
+// server root as requested by client if flag is not set
+func (h *mdHandler) baseURL(r *http.Request) *url.URL {
+	if h.siteURL != nil {
+		return h.siteURL
+	}
+	base := &url.URL{Scheme: "http", Host: r.Host, Path: "/"}
+	if r.TLS != nil {
+		base.Scheme = "https"
+	}
+	return base
+}
+
+// parseBaseURL parses -baseurl flag value, which must be absolute http or
+// https url
+func parseBaseURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an absolute http or https url", s)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawPath, u.RawQuery, u.Fragment = "", "", ""
+	return u, nil
+}
+
+// documentSummary returns description of markdown document name from its
+// front matter, or text of its first paragraph
+func (h *mdHandler) documentSummary(ctx context.Context, name string) string {
+	if ctx.Err() != nil {
+		return ""
+	}
+	f, err := h.files().Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if h.maxSize > 0 {
+		r = io.LimitReader(f, h.maxSize+1)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil || h.maxSize > 0 && int64(len(b)) > h.maxSize {
+		return ""
+	}
+	fm, body := splitFrontMatter(b)
+	if fm.Description != "" {
+		return fm.Description
+	}
+	return truncateText(firstParagraphText(render.Parse(body, h.renderOptions())), 300)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"time"
+)
+
+// frontMatter holds fields of document front matter mdserver uses
+type frontMatter struct {
+	Title       string
+	Description string
+	Tags        []string
+	Date        time.Time
+	Aliases     []string // old paths of document, see redirectMap
+}
+
+// splitFrontMatter splits document b into front matter and the rest of
+// document. Front matter is a block at the very start of document delimited
+// by "---" lines for YAML or "+++" lines for TOML. Only simple "key: value"
+// (YAML) or "key = value" (TOML) top-level fields are parsed, along with
+// inline ["a", "b"] and YAML block lists; other content is ignored. If b has
+// no front matter, it's returned as is.
+func splitFrontMatter(b []byte) (frontMatter, []byte) {
+	var fm frontMatter
+	delim, sep := "---", ":"
+	switch {
+	case bytes.HasPrefix(b, []byte("---\n")), bytes.HasPrefix(b, []byte("---\r\n")):
+	case bytes.HasPrefix(b, []byte("+++\n")), bytes.HasPrefix(b, []byte("+++\r\n")):
+		delim, sep = "+++", "="
+	default:
+		return fm, b
+	}
+	var lines []string
+	rest := b[bytes.IndexByte(b, '\n')+1:]
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		line := rest
+		if i >= 0 {
+			line = rest[:i]
+		}
+		s := strings.TrimRight(string(line), "\r")
+		if s == delim || delim == "---" && s == "..." {
+			if i < 0 {
+				rest = nil
+			} else {
+				rest = rest[i+1:]
+			}
+			break
+		}
+		if i < 0 {
+			// no closing delimiter, so it's not front matter
+			return fm, b
+		}
+		lines = append(lines, s)
+		rest = rest[i+1:]
+	}
+	var key string // key of YAML block list being parsed
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if key != "" && strings.HasPrefix(trimmed, "- ") {
+			switch v := unquote(strings.TrimSpace(trimmed[2:])); key {
+			case "tags":
+				fm.Tags = append(fm.Tags, v)
+			case "aliases":
+				fm.Aliases = append(fm.Aliases, v)
+			}
+			continue
+		}
+		key = ""
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, sep, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		k, v := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+		switch k {
+		case "title":
+			fm.Title = unquote(v)
+		case "description":
+			fm.Description = unquote(v)
+		case "tags", "keywords":
+			if v == "" {
+				key = "tags"
+				continue
+			}
+			fm.Tags = append(fm.Tags, splitList(v)...)
+		case "aliases":
+			if v == "" {
+				key = k
+				continue
+			}
+			fm.Aliases = append(fm.Aliases, splitList(v)...)
+		case "date":
+			fm.Date = parseDate(unquote(v))
+		}
+	}
+	return fm, rest
+}
+
+// splitList parses inline list like ["a", "b"], or comma-separated values
+func splitList(s string) []string {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = unquote(strings.TrimSpace(v)); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// unquote strips matching single or double quotes around s
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseDate parses date in one of common front matter formats, returning
+// zero time if s is not recognized
+func parseDate(s string) time.Time {
+	for _, layout := range []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04",
+		"2006-01-02",
+	} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyPath is a path prefix of page history, served if directory is a git
+// repository
+const historyPath = "/history/"
+
+// gitRepo provides history of files in directory which is a part of git
+// work tree, using git command
+type gitRepo struct {
+	dir string
+
+	mu      sync.Mutex
+	head    string               // HEAD commit last is built for
+	last    map[string]gitCommit // file relative to dir -> last commit changing it
+	checked time.Time            // when head was checked last time
+}
+
+// gitCommit describes single commit
+type gitCommit struct {
+	Hash    string
+	Author  string
+	Time    time.Time
+	Subject string
+
+	file string // name of file as of this commit, set by gitRepo.history
+}
+
+// Short returns abbreviated commit hash
+func (c gitCommit) Short() string {
+	if len(c.Hash) > 7 {
+		return c.Hash[:7]
+	}
+	return c.Hash
+}
+
+// gitCheckInterval limits how often git is asked for HEAD commit
+const gitCheckInterval = time.Second
+
+// gitTimeout limits how long single git command may take
+const gitTimeout = 30 * time.Second
+
+// openGitRepo returns gitRepo for dir, or nil if dir is not inside git work
+// tree or git is not installed
+func openGitRepo(dir string) *gitRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil
+	}
+	g := &gitRepo{dir: dir}
+	if out, err := g.run(context.Background(), "rev-parse", "--is-inside-work-tree"); err != nil ||
+		string(bytes.TrimSpace(out)) != "true" {
+		return nil
+	}
+	return g
+}
+
+// run runs git command inside repository directory and returns its output
+func (g *gitRepo) run(ctx context.Context, args ...string) ([]byte, error) {
+	return g.runEnv(ctx, nil, args...)
+}
+
+// runEnv is like run, but adds env to environment of git command
+func (g *gitRepo) runEnv(ctx context.Context, env []string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, gitTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "core.quotePath=false"}, args...)...)
+	cmd.Dir = g.dir
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) != 0 {
+			return nil, fmt.Errorf("git %s: %v: %s", args[0], err, msg)
+		}
+		return nil, fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// gitLogFormat is git log format parsed by parseGitLog, every commit header
+// starts with ASCII record separator
+const gitLogFormat = "--format=%x1e%H%x00%an%x00%at%x00%s"
+
+// parseGitLog parses output of git log run with gitLogFormat, calling fn for
+// each commit with names of files it changed, if git log was run with
+// --name-only flag
+func parseGitLog(out []byte, fn func(c gitCommit, files []string)) {
+	for _, entry := range bytes.Split(out, []byte("\x1e"))[1:] {
+		lines := strings.Split(string(entry), "\n")
+		fields := strings.SplitN(lines[0], "\x00", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		ts, _ := strconv.ParseInt(fields[2], 10, 64)
+		c := gitCommit{Hash: fields[0], Author: fields[1], Time: time.Unix(ts, 0), Subject: fields[3]}
+		var files []string
+		for _, s := range lines[1:] {
+			if s != "" {
+				files = append(files, s)
+			}
+		}
+		fn(c, files)
+	}
+}
+
+// lastCommits returns map of files relative to repository directory to the
+// last commits changing them. Returned map must not be modified.
+func (g *gitRepo) lastCommits(ctx context.Context) map[string]gitCommit {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.last != nil && time.Since(g.checked) < gitCheckInterval {
+		return g.last
+	}
+	g.checked = time.Now()
+	out, err := g.run(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		// repository without commits
+		return g.last
+	}
+	head := string(bytes.TrimSpace(out))
+	if head == g.head {
+		return g.last
+	}
+	if out, err = g.run(ctx, "log", gitLogFormat, "--name-only", "--relative", "--no-renames",
+		"HEAD", "--", "."); err != nil {
+		log.Print(err)
+		return g.last
+	}
+	last := make(map[string]gitCommit)
+	parseGitLog(out, func(c gitCommit, files []string) {
+		for _, name := range files {
+			if _, ok := last[name]; !ok {
+				last[name] = c
+			}
+		}
+	})
+	g.head, g.last = head, last
+	return last
+}
+
+// lastCommit returns the last commit changing file name
+func (g *gitRepo) lastCommit(ctx context.Context, name string) (gitCommit, bool) {
+	c, ok := g.lastCommits(ctx)[name]
+	return c, ok
+}
+
+// history returns commits changing file name, the most recent first
+func (g *gitRepo) history(ctx context.Context, name string) ([]gitCommit, error) {
+	out, err := g.run(ctx, "log", gitLogFormat, "--name-only", "--relative", "--follow",
+		"HEAD", "--", name)
+	if err != nil {
+		return nil, err
+	}
+	var commits []gitCommit
+	parseGitLog(out, func(c gitCommit, files []string) {
+		if c.file = name; len(files) != 0 {
+			c.file = files[0]
+		}
+		commits = append(commits, c)
+	})
+	return commits, nil
+}
+
+// show returns content of file name as of commit with given hash
+func (g *gitRepo) show(ctx context.Context, hash, name string) ([]byte, error) {
+	return g.run(ctx, "show", hash+":./"+name)
+}
+
+// commitInfo formats author and date of commit, as shown in index
+func (h *mdHandler) commitInfo(c gitCommit) string {
+	if h.dateFormat == "" {
+		return c.Author
+	}
+	return c.Author + ", " + c.Time.Format(h.dateFormat)
+}
+
+// serveHistory serves list of commits changing markdown file, or its old
+// revision if request has rev query parameter
+func (h *mdHandler) serveHistory(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean("/" + strings.TrimPrefix(r.URL.Path, historyPath))
+	name := fsName(p)
+	if containsDotDot(p) || !strings.HasSuffix(name, mdSuffix) || !h.insideRoot(name) {
+		http.Error(w, "invalid URL path", http.StatusBadRequest)
+		return
+	}
+	if h.excluded(name) {
+		http.NotFound(w, r)
+		return
+	}
+	page := struct {
+		Title     string
+		StyleHref string
+		Style     template.CSS
+		PageHref  string
+		DiffHref  string
+		Name      string
+		Commits   []gitCommit
+		Last      int // index of the first commit
+		Commit    *gitCommit
+		Body      template.HTML
+		Format    string
+	}{
+		Title:    "History of " + name,
+		PageHref: (&url.URL{Path: "/" + name}).String(),
+		DiffHref: (&url.URL{Path: diffPath + name}).String(),
+		Name:     name,
+		Format:   h.dateFormat,
+	}
+	if page.Format == "" {
+		page.Format = "2006-01-02"
+	}
+	commits, err := h.git.history(r.Context(), name)
+	if err != nil {
+		log.Printf("history %q: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(commits) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	page.Commits, page.Last = commits, len(commits)-1
+	if rev := r.URL.Query().Get("rev"); rev != "" {
+		for i := range commits {
+			if commits[i].Hash == rev {
+				page.Commit = &commits[i]
+				break
+			}
+		}
+		if page.Commit == nil {
+			http.NotFound(w, r)
+			return
+		}
+		b, err := h.git.show(r.Context(), rev, page.Commit.file)
+		if err != nil {
+			log.Printf("history %q: %v", name, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		// revision is shown under historyPath, so relative links must not
+		// depend on page location
+		body, _, _ := h.renderBody(name, b, absoluteLinks(path.Dir(name)))
+		page.Title = fmt.Sprintf("%s as of %s", name, page.Commit.Short())
+		page.Body = template.HTML(body)
+	}
+	style, _ := h.styles()
+	switch {
+	case h.linkStyle:
+		page.StyleHref = style
+	default:
+		page.Style = template.CSS(style)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", h.csp(false, false))
+	if err := historyTemplate.Execute(w, page); err != nil {
+		log.Printf("history %q: %v", name, err)
+	}
+}
+
+var historyTemplate = template.Must(template.New("history").Parse(historyTpl))
+
+const historyTpl = `<!doctype html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="/favicon.ico">
+{{if .StyleHref}}<link rel="stylesheet" href="{{.StyleHref}}">{{end -}}
+{{if .Style}}<style>{{.Style}}</style>{{end}}
+</head><body id="mdserver-history"><nav id="site"><a href="/?index">index</a> · <a href="{{.PageHref}}">{{.Name}}</a> · <a href="?">history</a></nav>
+{{with .Commit}}<p id="revision">Revision <code>{{.Short}}</code> by {{.Author}}, {{.Time.Format $.Format}}: {{.Subject}}</p>
+<article>
+{{$.Body}}
+</article>{{else}}<h1>{{.Title}}</h1>
+<ul id="history">{{range $i, $c := .Commits}}
+<li><a href="?rev={{.Hash}}"><code>{{.Short}}</code></a> {{.Subject}} <small>{{.Author}}, {{.Time.Format $.Format}}
+{{- if lt $i $.Last}} · <a href="{{$.DiffHref}}?to={{.Hash}}">changes</a>{{end}} · <a href="{{$.DiffHref}}?from={{.Hash}}">compare with current</a></small></li>{{end}}
+</ul>{{end}}</body>
+`
+
+// pull periodically runs git pull until ctx is canceled, calling onUpdate
+// each time HEAD changes
+func (g *gitRepo) pull(ctx context.Context, interval time.Duration, onUpdate func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		updated, err := g.pullOnce(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Print(err)
+			}
+			continue
+		}
+		if updated {
+			onUpdate()
+		}
+	}
+}
+
+// pullEnv is added to environment of git pull, so it fails instead of
+// waiting for credentials nobody is going to enter
+var pullEnv = []string{"GIT_TERMINAL_PROMPT=0"}
+
+// pullOnce runs git pull and reports whether it changed HEAD
+func (g *gitRepo) pullOnce(ctx context.Context) (bool, error) {
+	before, _ := g.run(ctx, "rev-parse", "HEAD")
+	if _, err := g.runEnv(ctx, pullEnv, "pull", "--ff-only", "--quiet"); err != nil {
+		return false, err
+	}
+	after, err := g.run(ctx, "rev-parse", "HEAD")
+	if err != nil || bytes.Equal(before, after) {
+		return false, err
+	}
+	log.Printf("git pull: updated to %s", bytes.TrimSpace(after))
+	return true, nil
+}
@@ -3,10 +3,19 @@ module github.com/artyom/mdserver
 require (
 	github.com/artyom/autoflags v1.1.1
 	github.com/artyom/httpgzip v1.1.1
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/gomarkdown/markdown v0.0.0-20190203074024-f12dffcd0f4e
 	github.com/microcosm-cc/bluemonday v1.0.3
 	github.com/pkg/browser v0.0.0-20180916011732-0a3d74bf9ce4
 	golang.org/x/text v0.3.1-0.20190213135515-6c92c7dc7f53
 )
 
-go 1.13
+require (
+	github.com/aymerick/douceur v0.2.0 // indirect
+	github.com/chris-ramon/douceur v0.2.0 // indirect
+	github.com/gorilla/css v1.0.0 // indirect
+	golang.org/x/net v0.0.0-20181220203305-927f97764cc3 // indirect
+	golang.org/x/sys v0.0.0-20220908164124-27713097b956 // indirect
+)
+
+go 1.24
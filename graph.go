@@ -0,0 +1,166 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// graphPath is a path of JSON representation of document link graph
+const graphPath = apiPrefix + "graph"
+
+// graphData describes documents and links between them, it's served as JSON
+// at graphPath and visualized at /?graph
+type graphData struct {
+	Nodes []graphNode `json:"nodes"`
+	Links []graphLink `json:"links"`
+}
+
+type graphNode struct {
+	ID     string `json:"id"` // file path
+	Title  string `json:"title"`
+	Href   string `json:"href"`
+	Orphan bool   `json:"orphan,omitempty"` // neither links nor is linked to
+}
+
+type graphLink struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+func (h *mdHandler) serveGraph(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		StyleHref string
+		Style     template.CSS
+		Graph     graphData
+		Orphans   []graphNode
+	}{Graph: h.links.graph(r.Context())}
+	for _, n := range page.Graph.Nodes {
+		if n.Orphan {
+			page.Orphans = append(page.Orphans, n)
+		}
+	}
+	style, _ := h.styles()
+	switch {
+	case h.linkStyle:
+		page.StyleHref = style
+	default:
+		page.Style = template.CSS(style)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", h.csp(false, false, "'"+graphScriptHash+"'"))
+	if err := graphTemplate.Execute(w, page); err != nil {
+		log.Printf("graph: %v", err)
+	}
+}
+
+// graphScript lays out graph from JSON data block with a simple force
+// simulation and draws it as SVG; nodes can be dragged around
+const graphScript = `document.addEventListener("DOMContentLoaded", function() {
+	var data = JSON.parse(document.getElementById("graph-data").textContent);
+	var svg = document.getElementById("graph");
+	var ns = "http://www.w3.org/2000/svg";
+	var w = svg.clientWidth, h = svg.clientHeight;
+	var nodes = data.nodes, byID = {};
+	nodes.forEach(function(n, i) {
+		var a = 2 * Math.PI * i / nodes.length;
+		n.x = w / 2 + w / 3 * Math.cos(a);
+		n.y = h / 2 + h / 3 * Math.sin(a);
+		n.vx = n.vy = 0;
+		byID[n.id] = n;
+	});
+	var links = data.links.map(function(l) {
+		var line = document.createElementNS(ns, "line");
+		svg.appendChild(line);
+		return {source: byID[l.source], target: byID[l.target], el: line};
+	});
+	var dragged = null, moved = false;
+	nodes.forEach(function(n) {
+		var a = document.createElementNS(ns, "a");
+		a.setAttribute("href", n.href);
+		if (n.orphan) a.setAttribute("class", "orphan");
+		var c = document.createElementNS(ns, "circle");
+		c.setAttribute("r", 5);
+		var t = document.createElementNS(ns, "text");
+		t.setAttribute("x", 8);
+		t.setAttribute("y", 4);
+		t.textContent = n.title;
+		a.appendChild(c);
+		a.appendChild(t);
+		a.addEventListener("pointerdown", function(e) { dragged = n; moved = false; e.preventDefault(); });
+		a.addEventListener("click", function(e) { if (moved) e.preventDefault(); });
+		svg.appendChild(a);
+		n.el = a;
+	});
+	svg.addEventListener("pointermove", function(e) {
+		if (!dragged) return;
+		var r = svg.getBoundingClientRect();
+		dragged.x = e.clientX - r.left;
+		dragged.y = e.clientY - r.top;
+		moved = true;
+		heat = Math.max(heat, 0.3);
+		if (!running) step();
+	});
+	window.addEventListener("pointerup", function() { dragged = null; });
+	var heat = 1, running = false;
+	function step() {
+		running = true;
+		for (var i = 0; i < nodes.length; i++) {
+			for (var j = i + 1; j < nodes.length; j++) {
+				var a = nodes[i], b = nodes[j];
+				var dx = b.x - a.x, dy = b.y - a.y, d2 = Math.max(dx * dx + dy * dy, 1), d = Math.sqrt(d2);
+				var f = 2000 / d2;
+				a.vx -= f * dx / d; a.vy -= f * dy / d;
+				b.vx += f * dx / d; b.vy += f * dy / d;
+			}
+		}
+		links.forEach(function(l) {
+			var dx = l.target.x - l.source.x, dy = l.target.y - l.source.y;
+			var d = Math.max(Math.sqrt(dx * dx + dy * dy), 1), f = (d - 80) * 0.05;
+			l.source.vx += f * dx / d; l.source.vy += f * dy / d;
+			l.target.vx -= f * dx / d; l.target.vy -= f * dy / d;
+		});
+		nodes.forEach(function(n) {
+			n.vx += (w / 2 - n.x) * 0.005;
+			n.vy += (h / 2 - n.y) * 0.005;
+			if (n !== dragged) {
+				n.x = Math.min(Math.max(n.x + n.vx * heat, 10), w - 10);
+				n.y = Math.min(Math.max(n.y + n.vy * heat, 10), h - 10);
+			}
+			n.vx *= 0.5; n.vy *= 0.5;
+			n.el.setAttribute("transform", "translate(" + n.x + "," + n.y + ")");
+		});
+		links.forEach(function(l) {
+			l.el.setAttribute("x1", l.source.x);
+			l.el.setAttribute("y1", l.source.y);
+			l.el.setAttribute("x2", l.target.x);
+			l.el.setAttribute("y2", l.target.y);
+		});
+		heat *= 0.99;
+		if (heat > 0.01 || dragged) {
+			requestAnimationFrame(step);
+		} else {
+			running = false;
+		}
+	}
+	step();
+});`
+
+var graphScriptHash = styleHash(graphScript)
+
+var graphTemplate = template.Must(template.New("graph").Parse(graphTpl))
+
+const graphTpl = `<!doctype html><head><meta charset="utf-8"><title>Link graph</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="/favicon.ico">
+{{if .StyleHref}}<link rel="stylesheet" href="{{.StyleHref}}">{{end -}}
+{{if .Style}}<style>{{.Style}}</style>{{end}}
+<script type="application/json" id="graph-data">{{.Graph}}</script>
+<script>` + graphScript + `</script>
+</head><body id="mdserver-graph"><nav id="site"><a href="/?index">index</a> · <a href="` + graphPath + `">json</a></nav>
+<h1>Link graph</h1>
+<svg id="graph"></svg>{{with .Orphans}}
+<h2>Orphan pages</h2>
+<ul>{{range .}}<li><a href="{{.Href}}">{{.Title}}</a> <small>{{.ID}}</small></li>{{end}}</ul>{{end}}</body>
+`
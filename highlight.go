@@ -0,0 +1,73 @@
+package main
+
+import (
+	"html/template"
+	"net/url"
+	"strings"
+)
+
+// highlightParam is a query parameter search results link pages with,
+// holding search query which highlightScript highlights on page
+const highlightParam = "hl"
+
+// textFragment returns URL fragment directive making browsers supporting
+// text fragments scroll to and highlight the first occurrence of q, used in
+// case highlightScript can't run
+func textFragment(q string) template.URL {
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return ""
+	}
+	// dashes and commas have special meaning in text directive
+	s := strings.NewReplacer("+", "%20", "-", "%2D").Replace(url.QueryEscape(q))
+	return template.URL(":~:text=" + s)
+}
+
+// highlightScript is embedded into pages when search is enabled: it wraps
+// words of search query given in highlightParam into <mark> elements and
+// scrolls to the first one following heading page URL points to
+const highlightScript = `document.addEventListener("DOMContentLoaded", function() {
+	var q = new URLSearchParams(location.search).get("` + highlightParam + `");
+	var root = document.querySelector("article");
+	if (!q || !root) return;
+	var words = q.split(/\s+/).filter(function(w) { return w.length > 1; }).map(function(w) {
+		return w.replace(/[.*+?^${}()|[\]\\]/g, "\\$&");
+	});
+	if (!words.length) return;
+	var re = new RegExp(words.join("|"), "gi");
+	var walker = document.createTreeWalker(root, NodeFilter.SHOW_TEXT);
+	var nodes = [];
+	while (walker.nextNode()) nodes.push(walker.currentNode);
+	var marks = [];
+	nodes.forEach(function(node) {
+		var text = node.nodeValue, last = 0, m;
+		var frag = document.createDocumentFragment();
+		re.lastIndex = 0;
+		while ((m = re.exec(text)) !== null) {
+			frag.appendChild(document.createTextNode(text.slice(last, m.index)));
+			var mark = document.createElement("mark");
+			mark.className = "search-hl";
+			mark.textContent = m[0];
+			frag.appendChild(mark);
+			marks.push(mark);
+			last = m.index + m[0].length;
+		}
+		if (last === 0) return;
+		frag.appendChild(document.createTextNode(text.slice(last)));
+		node.parentNode.replaceChild(frag, node);
+	});
+	if (!marks.length) return;
+	var target = location.hash && document.getElementById(decodeURIComponent(location.hash.slice(1)));
+	var first = marks[0];
+	if (target) {
+		for (var i = 0; i < marks.length; i++) {
+			if (target.compareDocumentPosition(marks[i]) & Node.DOCUMENT_POSITION_FOLLOWING) {
+				first = marks[i];
+				break;
+			}
+		}
+	}
+	first.scrollIntoView({block: "center"});
+});`
+
+var highlightScriptHash = styleHash(highlightScript)
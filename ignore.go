@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ignoreFileName is a name of file in served directory listing patterns of
+// markdown files to hide, in a format similar to .gitignore
+const ignoreFileName = ".mdignore"
+
+// ignoreFile holds patterns loaded from ignore file, reloading them when file
+// changes.
+type ignoreFile struct {
+	fsys fs.FS
+	name string
+
+	mu      sync.Mutex
+	checked time.Time // when file was last checked for modifications
+	mtime   time.Time // modification time of loaded file
+	size    int64     // size of loaded file
+	rules   ignoreList
+}
+
+// ignoreCheckInterval limits how often ignoreFile checks whether file was
+// modified
+const ignoreCheckInterval = time.Second
+
+// load returns current list of patterns, reloading it if file was modified
+// since the last load.
+func (f *ignoreFile) load() ignoreList {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if now.Sub(f.checked) < ignoreCheckInterval {
+		return f.rules
+	}
+	f.checked = now
+	st, err := fs.Stat(f.fsys, f.name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ignore file: %v", err)
+		}
+		f.rules, f.mtime, f.size = nil, time.Time{}, 0
+		return nil
+	}
+	if st.ModTime().Equal(f.mtime) && st.Size() == f.size {
+		return f.rules
+	}
+	fd, err := f.fsys.Open(f.name)
+	if err != nil {
+		log.Printf("ignore file: %v", err)
+		return f.rules
+	}
+	defer fd.Close()
+	f.rules, f.mtime, f.size = parseIgnore(fd), st.ModTime(), st.Size()
+	return f.rules
+}
+
+// ignoreList is a list of gitignore-style patterns
+type ignoreList []ignoreRule
+
+type ignoreRule struct {
+	pattern  string
+	negate   bool // pattern started with "!"
+	dirOnly  bool // pattern ended with "/", only matches directories
+	anchored bool // pattern contains "/", matched against full path
+}
+
+// parseIgnore reads gitignore-style patterns from r: empty lines and lines
+// starting with "#" are skipped, "!" prefix negates pattern, "/" suffix makes
+// pattern only match directories; patterns containing "/" are matched against
+// full path relative to served directory, and may use "**" to match any
+// number of directories, other patterns are matched against base names.
+func parseIgnore(r io.Reader) ignoreList {
+	var out ignoreList
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate, line = true, line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored, line = true, strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			log.Printf("ignore file: skipping invalid pattern %q: %v", sc.Text(), err)
+			continue
+		}
+		rule.pattern = line
+		out = append(out, rule)
+	}
+	return out
+}
+
+// match reports whether file with given / separated path is ignored, either
+// directly or because one of its parent directories is ignored.
+func (l ignoreList) match(name string) bool {
+	if len(l) == 0 {
+		return false
+	}
+	parts := strings.Split(name, "/")
+	for i := 1; i <= len(parts); i++ {
+		if l.matchPath(strings.Join(parts[:i], "/"), i < len(parts)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l ignoreList) matchPath(name string, isDir bool) bool {
+	var ignored bool
+	for _, rule := range l {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.match(name) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func (rule ignoreRule) match(name string) bool {
+	if !rule.anchored {
+		ok, _ := path.Match(rule.pattern, path.Base(name))
+		return ok
+	}
+	return matchSegments(strings.Split(rule.pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchSegments matches path segments against pattern segments, where "**"
+// pattern segment matches any number of path segments.
+func matchSegments(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			pat = pat[1:]
+			if len(pat) == 0 {
+				return true
+			}
+			for i := range name {
+				if matchSegments(pat, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
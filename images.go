@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artyom/mdserver/render"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// inlineImagesHook returns html.RenderNodeFunc which replaces destinations of
+// images referencing local files with data URIs holding their content, so
+// that rendered page is self-contained. name is a slash separated markdown
+// file path, relative image references are resolved against its directory.
+//
+// Remote images, files larger than h.inlineMax bytes, files outside of
+// served directory and files of types not allowed by sanitizing policy are
+// left as is.
+func (h *mdHandler) inlineImagesHook(name string) html.RenderNodeFunc {
+	return func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+		img, ok := node.(*ast.Image)
+		if !ok || !entering {
+			return ast.GoToNext, false
+		}
+		if uri := h.imageDataURI(name, string(img.Destination)); uri != "" {
+			img.Destination = []byte(uri)
+		}
+		return ast.GoToNext, false
+	}
+}
+
+// inlineImagesPolicy returns policy p, or render.DefaultPolicy if p is nil,
+// extended to keep data URIs of images embedded by inlineImagesHook. Other
+// policies drop such URIs, which documents could use to embed any content.
+func inlineImagesPolicy(p *bluemonday.Policy) *bluemonday.Policy {
+	if p == nil {
+		p = render.DefaultPolicy()
+	}
+	p.AllowDataURIImages()
+	return p
+}
+
+// imageDataURI returns data URI with content of image referenced by dst from
+// markdown file name, or an empty string if image cannot be inlined.
+func (h *mdHandler) imageDataURI(name, dst string) string {
+	u, err := url.Parse(dst)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return ""
+	}
+	typ := mime.TypeByExtension(path.Ext(u.Path))
+	if i := strings.IndexByte(typ, ';'); i >= 0 {
+		typ = typ[:i]
+	}
+	if _, ok := inlineImageTypes[typ]; !ok {
+		return ""
+	}
+	var file string
+	switch {
+	case path.IsAbs(u.Path):
+		file = fsName(path.Clean(u.Path))
+	default:
+		file = path.Join(path.Dir(name), u.Path)
+		if file == ".." || strings.HasPrefix(file, "../") {
+			return ""
+		}
+	}
+	if !h.insideRoot(file) {
+		return ""
+	}
+	f, err := h.files().Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || !st.Mode().IsRegular() || st.Size() > h.inlineMax {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("data:" + typ + ";base64,")
+	enc := base64.NewEncoder(base64.StdEncoding, &b)
+	if _, err := io.Copy(enc, f); err != nil {
+		return ""
+	}
+	if err := enc.Close(); err != nil {
+		return ""
+	}
+	return b.String()
+}
+
+// inlineImageTypes are image types which can be inlined as data URIs, matching
+// ones allowed by bluemonday.Policy.AllowDataURIImages
+var inlineImageTypes = map[string]struct{}{
+	"image/gif":  {},
+	"image/jpeg": {},
+	"image/png":  {},
+	"image/webp": {},
+}
+
+// resizedImagesHook returns html.RenderNodeFunc which adds "w" query
+// parameter to destinations of local images, so that images wider than
+// h.imageWidth are served resized, see serveResizedImage
+func (h *mdHandler) resizedImagesHook() html.RenderNodeFunc {
+	return func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+		img, ok := node.(*ast.Image)
+		if !ok || !entering {
+			return ast.GoToNext, false
+		}
+		u, err := url.Parse(string(img.Destination))
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || u.RawQuery != "" {
+			return ast.GoToNext, false
+		}
+		if _, ok := resizableImageTypes[strings.ToLower(path.Ext(u.Path))]; !ok {
+			return ast.GoToNext, false
+		}
+		u.RawQuery = "w=" + strconv.Itoa(h.imageWidth)
+		img.Destination = []byte(u.String())
+		return ast.GoToNext, false
+	}
+}
+
+// resizableImageTypes maps extensions of images which can be resized to
+// their formats, as reported by image.Decode
+var resizableImageTypes = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+}
+
+// maxResizedPixels limits size of images which are resized, larger ones are
+// served as is. Decoding and scaling take about 8 bytes per pixel.
+const maxResizedPixels = 24 << 20
+
+// resizeSlots limits number of images resized at once
+var resizeSlots = make(chan struct{}, 2)
+
+// serveResizedImage serves image file name scaled down to h.imageWidth if
+// "w" query parameter is set to it, keeping aspect ratio. It reports false
+// if image should be served as is instead: if other width is requested, or
+// image is not wider, or cannot be resized.
+func (h *mdHandler) serveResizedImage(w http.ResponseWriter, r *http.Request, name string) bool {
+	width, err := strconv.Atoi(r.URL.Query().Get("w"))
+	if err != nil || width != h.imageWidth {
+		return false
+	}
+	format, ok := resizableImageTypes[strings.ToLower(path.Ext(name))]
+	if !ok {
+		return false
+	}
+	st, err := fs.Stat(h.files(), name)
+	if err != nil || !st.Mode().IsRegular() {
+		return false
+	}
+	key := cacheKey{name: name, mtime: st.ModTime().UnixNano(), size: st.Size(), width: width}
+	if h.cache != nil {
+		if b, ok := h.cache.get(key); ok {
+			h.serveImage(w, r, format, st.ModTime(), b)
+			return true
+		}
+	}
+	select {
+	case resizeSlots <- struct{}{}:
+	case <-r.Context().Done():
+		return false
+	}
+	b, err := h.resizeImage(name, format, width)
+	<-resizeSlots
+	if err != nil {
+		if err != errNotResized {
+			log.Printf("resize %q: %v", name, err)
+		}
+		return false
+	}
+	if h.cache != nil {
+		h.cache.add(key, b)
+	}
+	h.serveImage(w, r, format, st.ModTime(), b)
+	return true
+}
+
+func (h *mdHandler) serveImage(w http.ResponseWriter, r *http.Request, format string, mtime time.Time, b []byte) {
+	w.Header().Set("Content-Type", "image/"+format)
+	if h.assetAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(h.assetAge.Seconds())))
+	}
+	http.ServeContent(w, r, "", mtime, bytes.NewReader(b))
+}
+
+// errNotResized is returned by resizeImage if image doesn't need resizing
+var errNotResized = errors.New("image is not resized")
+
+// resizeImage returns image file name of given format scaled down to width,
+// encoded in the same format
+func (h *mdHandler) resizeImage(name, format string, width int) ([]byte, error) {
+	b, err := fs.ReadFile(h.files(), name)
+	if err != nil {
+		return nil, err
+	}
+	cfg, cfgFormat, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if cfgFormat != format || cfg.Width <= width || cfg.Width*cfg.Height > maxResizedPixels {
+		return nil, errNotResized
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	switch dst := scaleImage(img, width); format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	default:
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleImage scales img down to width, keeping aspect ratio. Every pixel of
+// the result is an average of source pixels it covers.
+func scaleImage(img image.Image, width int) *image.RGBA {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	sw, sh := b.Dx(), b.Dy()
+	height := sh * width / sw
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, (y+1)*sh/height
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, (x+1)*sw/width
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					sum[0] += int(src.Pix[i])
+					sum[1] += int(src.Pix[i+1])
+					sum[2] += int(src.Pix[i+2])
+					sum[3] += int(src.Pix[i+3])
+					i += 4
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			j := dst.PixOffset(x, y)
+			for c := range sum {
+				dst.Pix[j+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artyom/mdserver/render"
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// includePattern matches text of paragraph which is an include directive,
+// like "{{include: other.md}}"
+var includePattern = regexp.MustCompile(`^\{\{\s*include:\s*(.+?)\s*\}\}$`)
+
+// includeTarget returns name of markdown file paragraph node of document name
+// includes. Paragraph must consist of either {{include: path}} directive,
+// where path is relative to document directory or starts with "/", or of
+// Obsidian-style ![[Page Name]] wiki link.
+func includeTarget(node ast.Node, name string) (string, bool) {
+	if _, ok := node.(*ast.Paragraph); !ok {
+		return "", false
+	}
+	var dst string
+	switch children := node.GetChildren(); len(children) {
+	case 1:
+		text, ok := children[0].(*ast.Text)
+		if !ok {
+			return "", false
+		}
+		m := includePattern.FindSubmatch(bytes.TrimSpace(text.Literal))
+		if m == nil {
+			return "", false
+		}
+		dst = string(m[1])
+	case 2:
+		text, ok := children[0].(*ast.Text)
+		link, ok2 := children[1].(*ast.Link)
+		if !ok || !ok2 || string(text.Literal) != "!" {
+			return "", false
+		}
+		u, err := url.Parse(string(link.Destination))
+		if err != nil || u.Scheme != "" || u.Host != "" {
+			return "", false
+		}
+		dst = u.Path
+	default:
+		return "", false
+	}
+	if !path.IsAbs(dst) {
+		dst = path.Join("/", path.Dir(name), dst)
+	}
+	if p := path.Clean(dst); strings.HasSuffix(p, mdSuffix) && !containsDotDot(p) {
+		return fsName(p), true
+	}
+	return "", false
+}
+
+// maxIncludeDepth limits nesting of included documents
+const maxIncludeDepth = 8
+
+// includeDocuments replaces include directives of parsed document name, see
+// includeTarget, with content of included documents, which may include other
+// ones. Relative links of included documents are made absolute if they're in
+// other directory than page. Directives including missing files, or leading
+// to cycles, are left as is. It returns names of included files.
+//
+// Stack holds names of documents being included, the first one is the page.
+func (h *mdHandler) includeDocuments(doc ast.Node, name string, opts render.Options, stack []string) []string {
+	if len(stack) == 0 {
+		stack = []string{name}
+	}
+	var included []string
+	var replace func(node ast.Node)
+	replace = func(node ast.Node) {
+		var children []ast.Node
+		var changed bool
+		for _, child := range node.GetChildren() {
+			target, ok := includeTarget(child, name)
+			if !ok {
+				replace(child)
+				children = append(children, child)
+				continue
+			}
+			sub := h.includedDocument(target, opts, stack)
+			if sub == nil {
+				children = append(children, child)
+				continue
+			}
+			if dir := path.Dir(target); dir != path.Dir(stack[0]) {
+				rebase := absoluteLinks(dir)
+				ast.WalkFunc(sub, func(n ast.Node, entering bool) ast.WalkStatus {
+					rebase(nil, n, entering)
+					return ast.GoToNext
+				})
+			}
+			included = append(included, target)
+			included = append(included, h.includeDocuments(sub, target, opts, append(stack, target))...)
+			for _, n := range sub.GetChildren() {
+				n.SetParent(node)
+				children = append(children, n)
+			}
+			changed = true
+		}
+		if changed {
+			node.SetChildren(children)
+		}
+	}
+	replace(doc)
+	return included
+}
+
+// includedDocument parses markdown file name included into the last document
+// of stack, returning nil if it cannot be included
+func (h *mdHandler) includedDocument(name string, opts render.Options, stack []string) ast.Node {
+	if len(stack) > maxIncludeDepth || !h.insideRoot(name) || h.excluded(name) ||
+		strings.HasPrefix(name, ".") || strings.Contains(name, "/.") {
+		return nil
+	}
+	for _, s := range stack {
+		if s == name {
+			return nil
+		}
+	}
+	b, err := fs.ReadFile(h.files(), name)
+	if err != nil || h.maxSize > 0 && int64(len(b)) > h.maxSize {
+		return nil
+	}
+	_, b = splitFrontMatter(h.substituteVars(b))
+	opts.WikiLinks = h.wikiLinkResolver(name)
+	opts.TaskIndexes = false // tasks of other files can't be toggled on page
+	return render.Parse(b, opts)
+}
+
+// includedFiles returns names of files included into markdown document src
+// of file name, see includeDocuments
+func (h *mdHandler) includedFiles(name string, src []byte) []string {
+	if !bytes.Contains(src, []byte("{{")) && !bytes.Contains(src, []byte("![[")) {
+		return nil
+	}
+	_, src = splitFrontMatter(h.substituteVars(src))
+	opts := h.renderOptions()
+	opts.WikiLinks = h.wikiLinkResolver(name)
+	return h.includeDocuments(render.Parse(src, opts), name, opts, nil)
+}
+
+// includedFilesCache caches names of files included into documents, so that
+// documents are only parsed for them once per modification
+type includedFilesCache struct {
+	mu    sync.Mutex
+	files map[string]includedFilesEntry
+}
+
+type includedFilesEntry struct {
+	mtime time.Time
+	size  int64
+	vars  string // mdHandler.varsKey, as variables may name included files
+	names []string
+}
+
+// cachedIncludedFiles returns names of files included into markdown document
+// name of given modification time and size, see includedFiles
+func (h *mdHandler) cachedIncludedFiles(name string, mtime time.Time, size int64) []string {
+	c := &h.includes
+	c.mu.Lock()
+	e, ok := c.files[name]
+	c.mu.Unlock()
+	if ok && e.mtime.Equal(mtime) && e.size == size && e.vars == h.varsKey {
+		return e.names
+	}
+	src, err := fs.ReadFile(h.files(), name)
+	if err != nil {
+		return nil
+	}
+	e = includedFilesEntry{mtime: mtime, size: size, vars: h.varsKey, names: h.includedFiles(name, src)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.files == nil {
+		c.files = make(map[string]includedFilesEntry)
+	}
+	c.files[name] = e
+	return e.names
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/artyom/mdserver/render"
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// brokenLink describes link or image of markdown document pointing to
+// missing file or heading
+type brokenLink struct {
+	File   string // document with link
+	Dest   string // link destination as written in document
+	Reason string
+}
+
+// linkChecker checks local links of markdown documents, caching headings of
+// documents they point to
+type linkChecker struct {
+	h        *mdHandler
+	headings map[string]map[string]bool // markdown file -> ids of its headings
+}
+
+// checkLinks parses all markdown documents and returns their links and
+// images which point to missing local files, or to missing headings of
+// markdown documents. Links are resolved the same way server resolves
+// requests, so links to renamed documents listed as their aliases are
+// not reported.
+func (h *mdHandler) checkLinks(ctx context.Context) ([]brokenLink, error) {
+	files, err := markdownFiles(ctx, h.files(), ".", h.unlisted)
+	if err != nil {
+		return nil, err
+	}
+	pages := newWikiPages(files)
+	c := &linkChecker{h: h, headings: make(map[string]map[string]bool)}
+	var out []brokenLink
+	for _, name := range files {
+		if err := ctx.Err(); err != nil {
+			return out, err
+		}
+		doc, err := c.parse(name, pages)
+		if err != nil {
+			return out, err
+		}
+		ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+			if !entering {
+				return ast.GoToNext
+			}
+			var dest []byte
+			what := "link"
+			switch n := node.(type) {
+			case *ast.Link:
+				dest = n.Destination
+			case *ast.Image:
+				dest, what = n.Destination, "image"
+			default:
+				return ast.GoToNext
+			}
+			if reason := c.check(ctx, name, string(dest), what); reason != "" {
+				out = append(out, brokenLink{File: name, Dest: string(dest), Reason: reason})
+			}
+			return ast.GoToNext
+		})
+	}
+	return out, nil
+}
+
+// parse parses markdown document name, remembering ids of its headings
+func (c *linkChecker) parse(name string, pages wikiPages) (ast.Node, error) {
+	b, err := fs.ReadFile(c.h.files(), name)
+	if err != nil {
+		return nil, err
+	}
+	_, b = splitFrontMatter(b)
+	opts := c.h.renderOptions()
+	opts.WikiLinks = pages.resolver(name)
+	doc := render.Parse(b, opts)
+	ids := make(map[string]bool)
+	for _, h := range render.Headings(doc) {
+		ids[h.ID] = true
+	}
+	c.headings[name] = ids
+	return doc, nil
+}
+
+// check returns why link destination dest of markdown document name is
+// broken, or an empty string if it's not
+func (c *linkChecker) check(ctx context.Context, name, dest, what string) string {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "invalid url"
+	}
+	if u.Scheme != "" || u.Host != "" || u.Opaque != "" {
+		return ""
+	}
+	target := name
+	if u.Path != "" {
+		p := u.Path
+		if !path.IsAbs(p) {
+			p = path.Join("/", path.Dir(name), p)
+		}
+		var ok bool
+		if target, ok = c.resolve(ctx, path.Clean(p), strings.HasSuffix(u.Path, "/")); !ok {
+			return "missing " + what
+		}
+	}
+	if u.Fragment == "" || !strings.HasSuffix(target, mdSuffix) {
+		return ""
+	}
+	ids, ok := c.headings[target]
+	if !ok {
+		ids = make(map[string]bool)
+		if b, err := fs.ReadFile(c.h.files(), target); err == nil {
+			_, b = splitFrontMatter(b)
+			for _, h := range render.Headings(render.Parse(b, c.h.renderOptions())) {
+				ids[h.ID] = true
+			}
+		}
+		c.headings[target] = ids
+	}
+	if !ids[u.Fragment] {
+		return "missing heading"
+	}
+	return ""
+}
+
+// resolve returns name of file URL path p is served from: markdown documents
+// may be linked without .md suffix and in different case, and moved ones by
+// their aliases. It returns false if p is not served.
+func (c *linkChecker) resolve(ctx context.Context, p string, dir bool) (string, bool) {
+	name := fsName(p)
+	if containsDotDot(p) || !c.h.insideRoot(name) {
+		return "", false
+	}
+	st, err := fs.Stat(c.h.files(), name)
+	switch {
+	case err == nil && dir:
+		return name, st.IsDir()
+	case err == nil && strings.HasSuffix(name, mdSuffix):
+		return name, !c.h.excluded(name)
+	case err == nil:
+		return name, true
+	case !errors.Is(err, fs.ErrNotExist):
+		return "", false
+	case isServerPath(p):
+		return "", true
+	}
+	if c.h.redirects != nil {
+		if dst, ok := c.h.redirects.lookup(ctx, p); ok {
+			if u, err := url.Parse(dst); err == nil && u.Host == "" && redirectKey(u.Path) != redirectKey(p) {
+				return c.resolve(ctx, path.Clean(u.Path), false)
+			}
+			return "", true
+		}
+	}
+	if dir {
+		return "", false
+	}
+	if !strings.HasSuffix(name, mdSuffix) {
+		name += mdSuffix
+		if st, err := fs.Stat(c.h.files(), name); err == nil && st.Mode().IsRegular() {
+			return name, !c.h.excluded(name)
+		}
+	}
+	return c.h.resolveName(name)
+}
+
+// isServerPath reports whether URL path p is served by mdserver itself
+// rather than from a file
+func isServerPath(p string) bool {
+	switch p {
+	case faviconPath, feedPath, openSearchPath, healthPath, strings.TrimSuffix(apiPrefix, "/"):
+		return true
+	}
+	for _, prefix := range []string{apiPrefix, historyPath, diffPath, editPath} {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// reportLinks writes broken links of all markdown documents to w, returning
+// an error if any were found
+func (h *mdHandler) reportLinks(w io.Writer) error {
+	links, err := h.checkLinks(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		fmt.Fprintf(w, "%s: %s %q\n", l.File, l.Reason, l.Dest)
+	}
+	if len(links) > 0 {
+		return fmt.Errorf("found %d broken links", len(links))
+	}
+	return nil
+}
+
+// serveLinkCheck serves report of broken links of all markdown documents
+func (h *mdHandler) serveLinkCheck(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Title     string
+		StyleHref string
+		Style     template.CSS
+		Links     []brokenLink
+		Files     int // number of documents with broken links
+	}{Title: "Broken links"}
+	var err error
+	if page.Links, err = h.checkLinks(r.Context()); err != nil {
+		log.Printf("link check: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	for i, l := range page.Links {
+		if i == 0 || page.Links[i-1].File != l.File {
+			page.Files++
+		}
+	}
+	style, _ := h.styles()
+	switch {
+	case h.linkStyle:
+		page.StyleHref = style
+	default:
+		page.Style = template.CSS(style)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", h.csp(false, false))
+	if err := linkCheckTemplate.Execute(w, page); err != nil {
+		log.Printf("link check: %v", err)
+	}
+}
+
+var linkCheckTemplate = template.Must(template.New("linkcheck").Parse(linkCheckTpl))
+
+const linkCheckTpl = `<!doctype html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="/favicon.ico">
+{{if .StyleHref}}<link rel="stylesheet" href="{{.StyleHref}}">{{end -}}
+{{if .Style}}<style>{{.Style}}</style>{{end}}
+</head><body id="mdserver-linkcheck"><nav id="site"><a href="/?index">index</a></nav>
+<h1>{{.Title}}</h1>
+{{with .Links}}{{$n := len .}}<p>{{$n}} broken {{if eq $n 1}}link{{else}}links{{end}} in {{$.Files}} {{if eq $.Files 1}}document{{else}}documents{{end}}.</p>
+<ul id="linkcheck">{{$prev := ""}}{{range .}}{{if ne .File $prev}}{{if $prev}}</ul></li>
+{{end}}{{$prev = .File}}<li><a href="/{{.File}}">{{.File}}</a><ul>
+{{end}}<li>{{.Reason}} <code>{{.Dest}}</code></li>
+{{end}}</ul></li>
+</ul>{{else}}<p>No broken links found.</p>{{end}}</body>
+`
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artyom/mdserver/render"
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// linkGraph tracks links between markdown documents. It's updated on access
+// for files modified since they were scanned, at most once per
+// linkGraphInterval.
+type linkGraph struct {
+	h *mdHandler
+
+	mu      sync.Mutex
+	docs    map[string]*linkedDoc
+	updated time.Time // when graph was last refreshed
+}
+
+type linkedDoc struct {
+	mtime time.Time
+	size  int64
+	title string
+	links []string // sorted paths of documents this one links to
+}
+
+// linkGraphInterval is how long link graph is considered fresh
+const linkGraphInterval = time.Second
+
+func newLinkGraph(h *mdHandler) *linkGraph {
+	return &linkGraph{h: h, docs: make(map[string]*linkedDoc)}
+}
+
+// refresh rescans new and modified files and drops removed ones, unless graph
+// was refreshed recently. Must be called with g.mu held.
+func (g *linkGraph) refresh(ctx context.Context) error {
+	if time.Since(g.updated) < linkGraphInterval {
+		return nil
+	}
+	fsys := g.h.files()
+	files, err := markdownFiles(ctx, fsys, ".", g.h.unlisted)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]struct{}, len(files))
+	for _, name := range files {
+		known[name] = struct{}{}
+	}
+	pages := newWikiPages(files)
+	for _, name := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		st, err := fs.Stat(fsys, name)
+		if err != nil {
+			delete(g.docs, name)
+			continue
+		}
+		if d, ok := g.docs[name]; ok && d.mtime.Equal(st.ModTime()) && d.size == st.Size() {
+			continue
+		}
+		d := &linkedDoc{mtime: st.ModTime(), size: st.Size()}
+		if b, err := fs.ReadFile(fsys, name); err == nil {
+			var fm frontMatter
+			fm, b = splitFrontMatter(b)
+			doc := render.Parse(b, render.Options{WikiLinks: pages.resolver(name)})
+			if d.title = fm.Title; d.title == "" {
+				d.title = render.Title(doc)
+			}
+			d.links = documentLinks(doc, name)
+		}
+		if d.title == "" {
+			d.title = nameToTitle(path.Base(name))
+		}
+		g.docs[name] = d
+	}
+	for name := range g.docs {
+		if _, ok := known[name]; !ok {
+			delete(g.docs, name)
+		}
+	}
+	// links to files which weren't markdown documents when linking document
+	// was scanned are kept, as such files may appear later
+	g.updated = time.Now()
+	return nil
+}
+
+// backlinks returns documents linking to markdown file name, sorted by path
+func (g *linkGraph) backlinks(ctx context.Context, name string) []pageLink {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.refresh(ctx); err != nil {
+		log.Printf("link graph: %v", err)
+	}
+	var files []string
+	for file, d := range g.docs {
+		if file == name {
+			continue
+		}
+		if i := sort.SearchStrings(d.links, name); i < len(d.links) && d.links[i] == name {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	out := make([]pageLink, 0, len(files))
+	for _, file := range files {
+		out = append(out, pageLink{Title: g.docs[file].title, Href: g.href(file)})
+	}
+	return out
+}
+
+// graph returns all documents and links between them
+func (g *linkGraph) graph(ctx context.Context) graphData {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.refresh(ctx); err != nil {
+		log.Printf("link graph: %v", err)
+	}
+	files := make([]string, 0, len(g.docs))
+	for file := range g.docs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	linked := make(map[string]bool)
+	data := graphData{Nodes: []graphNode{}, Links: []graphLink{}}
+	for _, file := range files {
+		for _, target := range g.docs[file].links {
+			if _, ok := g.docs[target]; !ok || target == file {
+				continue
+			}
+			data.Links = append(data.Links, graphLink{Source: file, Target: target})
+			linked[file], linked[target] = true, true
+		}
+	}
+	for _, file := range files {
+		data.Nodes = append(data.Nodes, graphNode{
+			ID:     file,
+			Title:  g.docs[file].title,
+			Href:   g.href(file),
+			Orphan: !linked[file],
+		})
+	}
+	return data
+}
+
+// linkCount holds numbers of documents linking to document and linked from
+// it, links of documents to themselves are not counted
+type linkCount struct {
+	in, out int
+}
+
+// linkCounts returns linkCount of every document
+func (g *linkGraph) linkCounts(ctx context.Context) map[string]linkCount {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.refresh(ctx); err != nil {
+		log.Printf("link graph: %v", err)
+	}
+	counts := make(map[string]linkCount, len(g.docs))
+	for file, d := range g.docs {
+		c := counts[file]
+		for _, target := range d.links {
+			if _, ok := g.docs[target]; !ok || target == file {
+				continue
+			}
+			c.out++
+			t := counts[target]
+			t.in++
+			counts[target] = t
+		}
+		counts[file] = c
+	}
+	return counts
+}
+
+// markOrphans sets Orphan field of index records of documents in dir no
+// other document links to, and DeadEnd field of ones not linking to other
+// documents, depending on -orphans and -deadends flags
+func (h *mdHandler) markOrphans(ctx context.Context, dir string, index []indexRecord) {
+	if !h.orphans && !h.deadEnds || h.links == nil {
+		return
+	}
+	counts := h.links.linkCounts(ctx)
+	for i := range index {
+		c, ok := counts[path.Join(dir, index[i].File)]
+		if !ok {
+			continue
+		}
+		index[i].Orphan = h.orphans && c.in == 0
+		index[i].DeadEnd = h.deadEnds && c.out == 0
+	}
+}
+
+// filterOrphans returns records marked by markOrphans
+func filterOrphans(index []indexRecord) []indexRecord {
+	var out []indexRecord
+	for _, rec := range index {
+		if rec.Orphan || rec.DeadEnd {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// href returns URL of document file
+func (g *linkGraph) href(file string) string {
+	p := "/" + file
+	if g.h.exporting {
+		p = strings.TrimSuffix(p, mdSuffix) + ".html"
+	}
+	return (&url.URL{Path: p}).String()
+}
+
+// documentLinks returns sorted unique paths of local markdown files parsed
+// document of file name links to. Links without .md suffix are treated as
+// links to markdown files, as these are served for such URLs.
+func documentLinks(doc ast.Node, name string) []string {
+	seen := make(map[string]struct{})
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		link, ok := node.(*ast.Link)
+		if !ok || !entering {
+			return ast.GoToNext
+		}
+		u, err := url.Parse(string(link.Destination))
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.HasSuffix(u.Path, "/") {
+			return ast.GoToNext
+		}
+		p := u.Path
+		if !path.IsAbs(p) {
+			p = path.Join("/", path.Dir(name), p)
+		}
+		if p = strings.TrimPrefix(path.Clean(p), "/"); !strings.HasSuffix(p, mdSuffix) {
+			p += mdSuffix
+		}
+		seen[p] = struct{}{}
+		return ast.GoToNext
+	})
+	links := make([]string, 0, len(seen))
+	for p := range seen {
+		links = append(links, p)
+	}
+	sort.Strings(links)
+	return links
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// listingEntry describes file or directory shown in directory listing
+type listingEntry struct {
+	Name    string
+	Href    string
+	Title   string // document title, for markdown and converted files
+	Size    string // formatted size, for files other than directories
+	IsDir   bool
+	ModTime time.Time
+}
+
+// serveListing serves listing of directory dir: subdirectories first, then
+// files, markdown files having titles and other files having sizes. Hidden
+// and excluded files are not listed.
+func (h *mdHandler) serveListing(w http.ResponseWriter, r *http.Request, dir string) {
+	entries, err := fs.ReadDir(h.files(), dir)
+	if err != nil {
+		log.Printf("listing %q: %v", dir, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	upath := path.Clean("/" + r.URL.Path)
+	page := struct {
+		Title     string
+		StyleHref string
+		Style     template.CSS
+		Crumbs    []breadcrumb
+		Parent    bool
+		Entries   []listingEntry
+		Format    string
+	}{
+		Title:  "Listing of " + strings.TrimSuffix(upath, "/") + "/",
+		Crumbs: h.breadcrumbs(upath),
+		Parent: upath != "/",
+		Format: h.dateFormat,
+	}
+	if page.Format == "" {
+		page.Format = "2006-01-02 15:04"
+	}
+	for _, d := range entries {
+		name := path.Join(dir, d.Name())
+		if strings.HasPrefix(d.Name(), ".") || !h.insideRoot(name) ||
+			strings.HasSuffix(name, mdSuffix) && h.excluded(name) || isConfigFile(name) {
+			continue
+		}
+		st, err := fs.Stat(h.files(), name)
+		if err != nil {
+			continue
+		}
+		e := listingEntry{Name: d.Name(), IsDir: st.IsDir(), ModTime: st.ModTime()}
+		e.Href = (&url.URL{Path: d.Name()}).String()
+		switch {
+		case e.IsDir:
+			e.Href += "/"
+		case strings.HasSuffix(name, mdSuffix):
+			if e.Title = documentMeta(h.files(), name).Title; e.Title == "" {
+				e.Title = nameToTitle(d.Name())
+			}
+		case h.converter(name) != nil:
+			e.Title = h.convertedTitle(name, st)
+		}
+		if !e.IsDir {
+			e.Size = formatSize(st.Size())
+		}
+		page.Entries = append(page.Entries, e)
+	}
+	sort.SliceStable(page.Entries, func(i, j int) bool {
+		a, b := page.Entries[i], page.Entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+	style, _ := h.styles()
+	switch {
+	case h.linkStyle:
+		page.StyleHref = style
+	default:
+		page.Style = template.CSS(style)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", h.csp(false, false))
+	if err := listingTemplate.Execute(w, page); err != nil {
+		log.Printf("listing %q: %v", dir, err)
+	}
+}
+
+// formatSize formats file size in bytes with binary unit prefixes
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(listingTpl))
+
+const listingTpl = `<!doctype html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="/favicon.ico">
+{{if .StyleHref}}<link rel="stylesheet" href="{{.StyleHref}}">{{end -}}
+{{if .Style}}<style>{{.Style}}</style>{{end}}
+</head><body id="mdserver-listing"><nav id="site"><a href="/?index">index</a>
+{{- range .Crumbs}} / {{if .Href}}<a href="{{.Href}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}{{end}} · <a href="?index">index of this folder</a></nav>
+<h1>{{.Title}}</h1>
+<table id="listing">
+{{- if .Parent}}
+<tr><td><a href="../">../</a></td><td></td><td></td></tr>{{end}}
+{{- range .Entries}}
+<tr><td><a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a>{{with .Title}} <small>{{.}}</small>{{end}}</td><td class="size">{{.Size}}</td><td><time datetime="{{.ModTime.Format "2006-01-02T15:04:05Z07:00"}}">{{.ModTime.Format $.Format}}</time></td></tr>
+{{- end}}
+</table></body>
+`
+
+// isListedDir reports whether dir is a directory without index.html, which
+// is served as listing with -listings flag
+func (h *mdHandler) isListedDir(dir string) bool {
+	if st, err := fs.Stat(h.files(), dir); err != nil || !st.IsDir() {
+		return false
+	}
+	_, err := fs.Stat(h.files(), path.Join(dir, "index.html"))
+	return err != nil
+}
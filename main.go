@@ -6,7 +6,287 @@
 // markdown format, i.e. local copy of Github wiki.
 //
 // To access automatically generated index, request "/?index" path, as
-// http://localhost:8080/?index.
+// http://localhost:8080/?index. Index of a subdirectory, listing only files
+// within it, is available at its path with the same query, i.e.
+// "/guides/?index".
+//
+// Search enabled with -search flag is case and accent insensitive: it finds
+// documents containing all words of query, or words starting with them, using
+// an in-memory full-text index, which checks files for changes every ten
+// seconds, or as soon as they change with -watch flag. Results are
+// ranked by relevance and show an excerpt with highlighted matches. To do
+// case-sensitive exact substring search, prefix query with "exact:", or
+// start server with -searchexact flag to make it the default. Prefixing
+// query with "regexp:" searches for lines matching Go regular expression, up
+// to 256 bytes long; search form also has selector of these modes. Search
+// can be limited to a directory and to documents with given tags by "path"
+// and "tag" query parameters, like "/?q=deploy&path=ops/&tag=runbook";
+// search forms on directory indexes and tag pages have checkboxes for that.
+// Loose search follows collation rules of the language preferred by
+// browser, as given in Accept-Language header, falling back to English; use
+// -lang flag to always use given BCP 47 language tag, i.e. "de" for German,
+// which matters for cases like German ß and ss, or Turkish dotless ı. Search
+// duration is limited by -searchtimeout flag; if search takes longer,
+// partial results are shown. Pressing "/" on index page focuses search box.
+// Pages link OpenSearch description at /opensearch.xml, so browsers can add
+// search to their search engines; its search url is built like feed links,
+// see -baseurl flag. Pages opened from search results highlight query words
+// and scroll to the first match; browsers supporting text fragments also do
+// that when scripts can't run.
+//
+// With -quickopen flag, pressing Ctrl+K (⌘K on macOS) on any page opens a
+// dialog finding documents by fuzzy matching of their names and titles, so
+// large wikis can be navigated without going back to the index.
+//
+// Instead of a directory, files can be served from a zip archive given with
+// -zip flag, which allows distributing documentation as a single file.
+// Archive is expected to have files at its root, not inside a single top
+// level directory. -dir can point to an archive as well, either .zip or
+// .tar.gz (.tgz) one, so wiki backups can be browsed without unpacking them.
+// Tar archives are repacked into a temporary file on start, they may have
+// up to 1 GiB of files.
+//
+// Documentation can also be compiled into mdserver binary: copy it into
+// "docs" directory of mdserver source tree and build with "embed" tag:
+//
+//	cp -R /path/to/docs docs
+//	go build -tags embed
+//
+// Resulting binary serves embedded files unless run with -dir, -zip or
+// -remote flag, and needs nothing else to run, which suits shipping product
+// documentation along with an appliance.
+//
+// Markdown files can also be accessed without .md suffix: if there's no file
+// matching request path, but there's one with .md suffix, it is rendered
+// instead, so both "/Page.md" and "/Page" render "Page.md" file.
+//
+// Files matching glob pattern given with -exclude flag, i.e. "*.draft.md", are
+// not listed in index and search results and cannot be accessed directly.
+// Pattern is matched against both slash separated path relative to -dir and
+// file base name.
+//
+// Markdown files can also be hidden by listing them in .mdignore file placed
+// in -dir, which uses format similar to .gitignore: each line is a glob
+// pattern, patterns without slash match file or directory base names,
+// patterns with slash match paths relative to -dir and can use "**" to match
+// any number of directories, pattern ending with slash only matches
+// directories, "!" prefix negates pattern, and lines starting with "#" are
+// comments. The file is reread when it changes.
+//
+// When documents are moved or renamed, their old paths can be kept working
+// by listing them in "aliases" front matter field, like "aliases: [old.md]",
+// with paths relative to document directory, or starting with "/" to be
+// relative to -dir. Old paths may also be listed in .mdredirects file in
+// -dir, one "old/path.md new/path.md" pair per line, where new path can also
+// be url of another site. Requests for missing files at such paths are
+// redirected with 301 Moved Permanently; .md suffix of old paths is optional.
+// Changes to these paths take effect within ten seconds.
+//
+// Text files with extensions or names listed in -plaintext flag, i.e.
+// "-plaintext=.txt,.log,LICENSE", are rendered as preformatted text within
+// the same page template as markdown files.
+//
+// CSV and TSV files are rendered as tables within page template, with their
+// first row as table header; add "?raw" to URL to get file as is, or use
+// -nocsv flag to always serve such files as is.
+//
+// With -listings flag, directories without index.html are listed with
+// subdirectories first, titles of markdown documents and sizes of files,
+// instead of plain file server listings.
+//
+// Files of other markup formats can be rendered within page template too,
+// with external programs given in -convert flag. Each program reads document
+// from stdin and writes html fragment to stdout, which is then sanitized:
+//
+//	-convert='.rst=pandoc -f rst -t html,.org=pandoc -f org -t html,.adoc=asciidoctor -s -o - -'
+//
+// Such files are listed in index, with titles taken from their first
+// headings once they were viewed, and from file names before that. They
+// are not searched. Add "?raw" to URL to get file as is. Text files can be
+// rendered with -plaintext flag.
+//
+// With -inlineimages flag, local images referenced from markdown documents are
+// embedded into rendered pages as data URIs, making them self-contained.
+// Only GIF, JPEG, PNG and WebP images not larger than -inlinemax bytes are
+// embedded.
+//
+// YAML or TOML front matter at the start of markdown document, delimited by
+// "---" or "+++" lines, is not rendered. Its title and description fields
+// take precedence over ones taken from document text; tags and date fields
+// are used by index.
+//
+// Index lists tags of documents, "?tags" gives list of all tags found in
+// directory and its subdirectories, and "?tag=name" limits index to
+// documents with this tag.
+//
+// Index is sorted by file name within each directory; "?sort=title" and
+// "?sort=mtime" sort it by document title or modification time instead, and
+// "?order=desc" reverses the order. Use -sort and -sortdesc flags to change
+// the default. Index shows modification time of each file in -datefmt
+// format.
+//
+// Like on GitHub wiki, pages can be requested without .md suffix and in any
+// case: "/getting-started" is served from "Getting Started.md" if there's no
+// exact match. With -redirect flag, such requests are redirected to the
+// canonical page urls with 301 Moved Permanently.
+//
+// Documents can include other markdown files with a paragraph consisting of
+// "{{include: other.md}}" directive, with path relative to document or
+// starting with "/", or of Obsidian-style "![[Page Name]]" link, so common
+// sections can be shared. Included files can include other ones; directives
+// leading to missing files or cycles are shown as is.
+//
+// Documents can reference variables like {{version}}, which are replaced
+// with values given by -vars flag as comma-separated name=value list, i.e.
+// "-vars=version=1.2.0,host=docs.example.com", before rendering, including
+// code blocks. Values of environment variables listed in -varsenv flag, i.e.
+// "-varsenv=VERSION", are available under their names. References to unknown
+// variables are left as is. Variables are only substituted in rendered pages;
+// document titles shown in indexes, feed and API responses, and text matched
+// by search keep references as written.
+//
+// Rendered pages link to previous and next documents of the same directory,
+// in default index order, so documentation can be read sequentially.
+//
+// Following GitHub wiki convention, _Sidebar.md and _Footer.md files are
+// rendered as sidebar and footer of every page in their directory and its
+// subdirectories; the closest ones to the page are used. These files are not
+// listed in index.
+//
+// Blockquotes starting with "[!NOTE]", "[!TIP]", "[!IMPORTANT]", "[!WARNING]"
+// or "[!CAUTION]" line are rendered as highlighted alert boxes, as on GitHub;
+// text following the marker on the same line replaces the default title.
+//
+// HTML in documents is sanitized, keeping only its safe subset, which is
+// right for files from untrusted sources. When serving your own files,
+// -sanitize=relaxed also allows iframes with https sources, like embedded
+// videos, style attributes and named anchors, and -sanitize=off keeps html
+// as is; Content-Security-Policy still blocks inline scripts. With
+// -sanitize=strict html is shown as text.
+//
+// Collapsible <details> sections with <summary> elements and open attribute
+// are kept by html sanitization, and markdown between their tags is rendered
+// as usual, as on GitHub.
+//
+// Emoji shortcodes like :tada: are replaced with emoji, as on GitHub; use
+// -noemoji flag to keep them as is.
+//
+// With -imagewidth flag, local JPEG and PNG images wider than given number of
+// pixels are shown on pages scaled down, which makes pages with large
+// screenshots load faster over slow connections. Pages request them with
+// "w" query parameter set to that width, like "/shot.png?w=800"; other
+// widths are ignored, and images over 24 megapixels are served as is.
+//
+// Markdown supports tables, fenced code blocks, strikethrough, definition lists
+// and custom heading ids, bare URLs and email addresses become links, and
+// straight quotes and dashes are replaced with typographic ones. Use
+// -extensions flag to change that, i.e.
+// -extensions=+footnotes,+hardbreaks,-deflists,-smartquotes enables
+// footnotes and line breaks on every newline, and disables definition lists
+// and typographic replacements. With -mentions flag, @username mentions link to
+// given URL, i.e. -mentions=https://github.com/{user} links them to GitHub
+// profiles.
+//
+// Wiki links like [[Page Name]] or [[Link text|Page Name]] link to markdown
+// files with matching names, compared case-insensitively and with spaces
+// matching hyphens, so [[getting started]] links to Getting-Started.md.
+// Added and removed files are picked up within ten seconds.
+//
+// With -backlinks flag, each page ends with "Linked from" section listing
+// documents which link to it.
+//
+// With any of -backlinks, -orphans or -deadends flags, link graph of
+// documents is also shown at "/?graph", with orphan pages that neither link
+// to nor are linked from other documents listed below it; its JSON
+// representation is served at /api/graph.
+//
+// With -orphans flag, index marks documents no other document links to, so
+// stranded content can be found and linked or removed; -deadends flag marks
+// documents which don't link to other documents. Index of marked documents
+// only is served at "/?orphans".
+//
+// JSON API is available for tools integrating with server: /api/index lists
+// markdown files with their titles, tags and modification times, /api/files
+// lists names and titles of all documents,
+// /api/search?q=term returns search results when search is enabled (add
+// "mode=exact" or "mode=regexp" to change search mode, "path" and "tag" to
+// limit its scope), and
+// /api/page/name.md returns document title, description and rendered html,
+// or its markdown source if "?raw" is added. These endpoints take precedence
+// over files in "api" subdirectory of -dir.
+//
+// Task lists like "- [ ] task" and "- [x] done" are rendered with
+// checkboxes. With -edit flag, checkboxes can be toggled in browser, and
+// their state is saved to markdown file.
+//
+// If served directory is in a git repository, pages and index show author and
+// date of the last commit changing each file, and /history/{page}.md lists
+// commits changing page, linking its old revisions.
+// /diff/{page}.md?from=A&to=B shows changes of page between commits A and B;
+// if "to" is not set, A is compared with current state of file, and if "from"
+// is not set, B is compared with the previous revision. Use -nogit to
+// disable git integration. With -gitpull=5m, git pull is run in served
+// directory every 5 minutes, keeping a clone of a wiki up to date.
+//
+// With -remote flag, mdserver clones git repository, like GitHub wiki
+// (https://github.com/user/project.wiki.git), into user cache directory and
+// serves it; repository cloned earlier is updated with git pull instead.
+// Use it along with -gitpull to keep the served copy up to date.
+//
+// With -edit flag, each page links an editor at /edit/{page}.md, which saves
+// changes back to markdown file. Files are replaced atomically, and saving
+// fails if file was changed since editor was opened. New pages can be created
+// from the index, or from the "not found" page of a missing markdown file.
+// As anyone who can reach the server can change files, use -edit only on
+// trusted networks.
+//
+// Source of markdown document is available by adding "?raw" to its URL, and
+// "?print" gives printable page without navigation and table of contents;
+// both views are linked from page navigation.
+//
+// Readers can adjust presentation with query parameters: "?plain" shows
+// document source within page, "?notoc" hides table of contents ("?toc"
+// brings it back), "?theme=dark" switches color theme of built-in
+// stylesheet (also "light" or "auto"), and "?width=wide" lifts limit on text
+// width ("normal" restores it). All but "?plain" are remembered in a cookie
+// and apply to subsequent pages.
+//
+// Markdown and plain text files larger than -maxsize bytes are not rendered,
+// requests to them are answered with 413 Request Entity Too Large.
+//
+// Recently rendered pages are kept in memory, up to -cachesize bytes in
+// total, and served from there until their source file is modified. Pages
+// are not cached when run with -inlineimages.
+//
+// Rendered pages have weak ETag computed from source file modification time,
+// size and rendering options, so clients can revalidate them with
+// If-None-Match as well as with If-Modified-Since. Pages with embedded images
+// have no ETag.
+//
+// With -numbered flag, document sections are numbered hierarchically (1, 1.1,
+// 1.2, 2, ...) in both document and its table of contents. Numbering starts
+// from second level headers, as first level header is usually a document
+// title. Since numbers are added with CSS rules appended to embedded
+// stylesheet, this flag has no effect with -csslink.
+//
+// Static files other than rendered ones are served with Cache-Control header
+// allowing clients to cache them for a duration set by -assetmaxage flag.
+// Rendered pages are always revalidated.
+//
+// If there's a file with the same name and additional .gz suffix next to the
+// requested static file, i.e. "page.html.gz" next to "page.html", and client
+// accepts gzip encoding, the precompressed file is served as is. The .gz file
+// is ignored if it's older than the original.
+//
+// Rendered pages show breadcrumb navigation trail with links to index pages of
+// their parent directories; a directory links to its index.html file if it
+// has one.
+//
+// Requests to files, which are symlinks pointing outside of -dir, or reside in
+// such symlinked directories, are rejected.
+//
+// With -pagesize flag set, autogenerated index is split into pages with up to
+// given number of entries each, use "/?index&page=N" to access N-th page.
 //
 // To create home page available at / either create index.html file or start
 // server with -rootindex flag to render automatically generated index.
@@ -15,41 +295,195 @@
 // wikis like "https://github.com/user/project/wiki/Page" to relative ones like
 // "Page.md".
 //
+// Built-in stylesheet follows system color scheme preference, switching to
+// dark theme if it's preferred; use -theme flag to always use "light" or
+// "dark" theme instead of "auto".
+//
+// With -mermaid flag set to URL of mermaid.js script, code blocks with
+// "mermaid" language are rendered as diagrams in browser. The script can be
+// loaded from CDN, like
+// https://cdn.jsdelivr.net/npm/mermaid@10/dist/mermaid.min.js, or served
+// from -dir, then its URL should be an absolute root-related path. Pages
+// with diagrams are allowed to use inline styles, as mermaid.js requires it.
+//
+// With -math flag set to a directory with KaTeX distribution files
+// (katex.min.js, katex.min.css and fonts), LaTeX formulas between $ and $$
+// delimiters are typeset in browser. These files are served under reserved
+// /.katex/ path, so pages don't depend on third-party hosts. Note that with
+// this flag single dollar signs in text may start a formula.
+//
+// To serve HTTPS, provide certificate and its private key files with -tlscert
+// and -tlskey flags, or use -tlsselfsigned flag to generate self-signed
+// certificate on start; its fingerprint is logged so that it can be checked
+// when browser warns about it.
+//
+// To restrict access, use -auth flag to require basic auth credentials given
+// as user:password, or -authtoken flag to require access token. Token can be
+// passed as "Authorization: Bearer" header, or as "token" query parameter of
+// any page to open in browser, in which case it's kept in a cookie. Either
+// credentials are accepted if both flags are set. Consider serving HTTPS when
+// using these flags.
+//
 // To apply custom styling provide css file with -css flag. By default, this
 // file is read on server start and then embedded into code of every page,
 // making them self-sufficient. If you instead wish to link stylesheet, provide
 // absolute root-related path to css file located under the same path as your
 // markdown files (-dir flag) and enable -csslink flag. This will link
 // stylesheet into head section of page with href being value of -css flag.
+// Embedded stylesheet is reloaded from file when server receives SIGHUP.
+//
+// With -export flag set to a directory name, server renders all markdown
+// files into html files in that directory, writes autogenerated index.html
+// into each directory having markdown files but no index.html, copies other
+// files as is, and exits. Relative links to markdown files are rewritten to
+// point to html files. Exported site uses absolute links to its index pages,
+// so it is expected to be published at the root of a web site.
+//
+// With -pdf flag set to a command line of HTML to PDF converter which reads
+// HTML from stdin and writes PDF to stdout, like "wkhtmltopdf --quiet - -",
+// adding "?pdf" to document URL gives it as PDF converted from its printable
+// page. With -exportpdf flag set to a directory name, server converts all
+// markdown files into PDF files in that directory and exits.
+//
+// Settings can be read from file given with -config flag, which has one
+// "name = value" (TOML) or "name: value" (YAML) line per setting, named after
+// flags:
+//
+//	addr = "localhost:9000"
+//	search = true
+//	plaintext = [".txt", "LICENSE"]
+//
+// Flags given on command line override settings from file. Without -config
+// flag, .mdserver.toml file in -dir is used if it exists; as anyone who can
+// add documents can write it, it may only change presentation and search
+// settings, not ones running commands or reading other files. Files named
+// .mdserver.toml are never served.
+//
+// Several directories can be served by one server by setting -dir to a
+// comma-separated list of name=path pairs, like "wiki=./wiki,specs=./specs";
+// each directory is then served under /name/ URL prefix with its own index,
+// while index at the root covers all of them.
+//
+// With -watch flag, server tracks changes of files in -dir and makes pages
+// open in browser reload automatically when any file changes, which is useful
+// when previewing documents while editing them.
+//
+// Each rendered page has a footer with file modification time, its format can
+// be changed with -datefmt flag, which takes Go reference time layout, see
+// https://golang.org/pkg/time/#pkg-constants. Empty -datefmt disables footer.
+//
+// Pages and index can be customized with -templates flag, which takes a
+// directory with page.tmpl and/or index.tmpl files in html/template syntax;
+// other *.tmpl files there may define templates these two share. Page
+// template gets .Title, .Description, .Body, .Style (or .StyleHref with
+// -csslink), .Crumbs, .Prev and .Next, .Sidebar, .Footer and .Modified fields;
+// index template gets .Title, .Style (or .StyleHref) and .Index with .Title,
+// .File, .Tags and .Updated of each page. See pageData and indexPage types in
+// source for all fields. Content-Security-Policy only allows built-in inline
+// scripts, so templates adding other scripts need -csp flag.
+//
+// Icon at /favicon.ico is served from file given with -favicon flag. If flag
+// is not set and there's no favicon.ico file in -dir, built-in icon is used.
+//
+// Atom feed of -feed most recently changed documents is served at /feed.xml
+// and linked from index, so changes can be followed in feed readers. If
+// directory is in git repository, documents are ordered by their last
+// commits, otherwise by modification time. Feed links are absolute, built
+// from Host header of request unless -baseurl flag sets url of site root,
+// like "https://docs.example.com/", which should be done when server is
+// reachable under names not trusted to be in Host header.
+//
+// When started with -metrics flag, server exposes request counts, request
+// durations and number of markdown files in Prometheus text format at
+// /metrics path.
 //
+// With -addr set to "unix:/path/to.sock", server listens on unix socket,
+// which is useful behind a reverse proxy; socket file is removed on shutdown.
 //
-// Note that table of contents generating javascript is a modified version of
-// code found at https://github.com/matthewkastor/html-table-of-contents which
-// is licensed under GNU GENERAL PUBLIC LICENSE Version 3.
+// Server shuts down gracefully on SIGINT or SIGTERM, waiting for active
+// requests to complete. When started by systemd with socket activation, it
+// serves on the passed socket instead of listening on -addr.
+//
+// Requests must be read within -readtimeout, one second by default; raise it
+// if slow clients or large edits time out. -writetimeout, -idletimeout and
+// -maxheaderbytes tune other server limits. With -h2c flag, server also
+// accepts HTTP/2 over plain TCP, which reverse proxies can use to talk to
+// it.
+//
+// Health check endpoint at /.healthz responds with 200 OK if -dir is
+// accessible, and with 503 Service Unavailable otherwise. Its requests are not
+// counted in metrics.
+//
+// Content-Security-Policy header sent with rendered pages is built from
+// enabled features and includes hashes of the embedded stylesheet and
+// scripts. It can be replaced verbatim with -csp flag; note that if you
+// override it, you're responsible for keeping required style-src and
+// script-src hashes, otherwise built-in scripts and styling would stop
+// working.
+//
+// Pages with two or more headers have table of contents with links to them.
+// It's shown above document, or in sidebar with -toc=sidebar, and -toc=off
+// disables it. Headers of levels up to -tocdepth are listed. Documents can
+// have "<!-- toc -->" line, which is then replaced with table of contents.
+//
+// Headers get ids generated from their text the same way GitHub does, used as
+// anchors by table of contents. Headers have "¶" links to themselves, shown
+// on hover, which also copy page link to clipboard when clicked; -noanchors
+// flag disables them. If a document has multiple headers with the same text,
+// later ones get numeric suffixes, i.e. "overview" and "overview-1". Run
+// with -checkanchors flag to list such headers in all markdown files and
+// exit; it exits with non-zero status if any are found.
+//
+// With -linkcheck flag, broken local links and missing images of all
+// documents are listed at "/?linkcheck"; as every request parses all
+// documents, it's off by default. Links are resolved the same way server
+// resolves requests, and links to headings of markdown documents are
+// checked as well. Run with -check flag to print such links and exit, with
+// non-zero status if any are found, i.e. in CI.
+//
+// Markdown rendering used by the server is available for other programs as
+// github.com/artyom/mdserver/render package, which allows changing parser
+// extensions, sanitization policy and render hooks, and has a minimal
+// http.Handler serving rendered files from any fs.FS, like embed.FS, created
+// with render.NewHandler.
 package main
 
 import (
-	"bufio"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/artyom/autoflags"
 	"github.com/artyom/httpgzip"
-	"github.com/gomarkdown/markdown"
+	"github.com/artyom/mdserver/render"
 	"github.com/gomarkdown/markdown/ast"
 	"github.com/gomarkdown/markdown/html"
 	"github.com/gomarkdown/markdown/parser"
@@ -60,8 +494,29 @@ import (
 )
 
 func main() {
-	args := runArgs{Dir: ".", Addr: "localhost:8080"}
+	args := runArgs{
+		Dir:           ".",
+		Addr:          "localhost:8080",
+		SearchTimeout: 2 * time.Second,
+		GzipLevel:     gzip.BestSpeed,
+		DateFormat:    "2006-01-02 15:04",
+		TOC:           tocTop,
+		Sanitize:      sanitizeUGC,
+		TOCDepth:      6,
+		AssetMaxAge:   time.Hour,
+		InlineMax:     256 << 10,
+		MaxSize:       4 << 20,
+		CacheSize:     32 << 20,
+		Feed:          20,
+		Theme:         "auto",
+		Sort:          sortByName,
+		ReadTimeout:   time.Second,
+	}
 	autoflags.Parse(&args)
+	if err := loadConfig(flag.CommandLine, args.Config, args.Dir); err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(1)
+	}
 	if err := run(args); err != nil {
 		os.Stderr.WriteString(err.Error() + "\n")
 		os.Exit(1)
@@ -69,27 +524,330 @@ func main() {
 }
 
 type runArgs struct {
-	Dir     string `flag:"dir,directory with markdown (.md) files"`
-	Addr    string `flag:"addr,address to listen"`
-	Open    bool   `flag:"open,open index page in default browser on start"`
-	Ghub    bool   `flag:"github,rewrite github wiki links to local when rendering"`
-	Grep    bool   `flag:"search,enable substring search"`
-	Idx     bool   `flag:"rootindex,render autogenerated index at / in addition to /?index"`
-	CSS     string `flag:"css,path to custom CSS file (embedded into page unless run with -csslink)"`
-	LinkCSS bool   `flag:"csslink,treat -css argument as local href inside <link rel=stylesheet>"`
-	HLJS    bool   `flag:"hljs,syntax-highlight code blocks with defined language using highlight.js"`
+	Config   string `flag:"config,read settings from this file, flags given on command line override them"`
+	Dir      string `flag:"dir,directory with markdown (.md) files, or comma-separated name=path list of directories to serve under /name/"`
+	Addr     string `flag:"addr,address to listen, or unix:/path/to.sock to listen on unix socket"`
+	Open     bool   `flag:"open,open index page in default browser on start"`
+	OpenFil  string `flag:"openfile,open this file in default browser on start instead of index page"`
+	Ghub     bool   `flag:"github,rewrite github wiki links to local when rendering"`
+	Redir    bool   `flag:"redirect,redirect requests for pages without .md suffix or in different case to their canonical urls"`
+	Grep     bool   `flag:"search,enable substring search"`
+	Idx      bool   `flag:"rootindex,render autogenerated index at / in addition to /?index"`
+	CSS      string `flag:"css,path to custom CSS file (embedded into page unless run with -csslink)"`
+	LinkCSS  bool   `flag:"csslink,treat -css argument as local href inside <link rel=stylesheet>"`
+	HLJS     bool   `flag:"hljs,syntax-highlight code blocks with defined language using highlight.js"`
+	CSP      string `flag:"csp,use this Content-Security-Policy instead of the autogenerated one"`
+	Sanitize string `flag:"sanitize,how to treat html in documents: strict (show as text), ugc (keep safe subset), relaxed (also allow iframes and style attributes) or off (keep as is, trusted files only)"`
+	Exclude  string `flag:"exclude,hide markdown files matching this glob pattern from index, search and rendering"`
+	Exact    bool   `flag:"searchexact,use case-sensitive exact substring search instead of loose matching"`
+	Lang     string `flag:"lang,BCP 47 language tag defining collation rules for loose search (default is taken from Accept-Language header)"`
+
+	SearchTimeout time.Duration `flag:"searchtimeout,stop search after this long and show partial results (0 to disable)"`
+
+	Metrics   bool   `flag:"metrics,expose Prometheus metrics at /metrics"`
+	Feed      int    `flag:"feed,number of recently changed documents listed in Atom feed at /feed.xml (0 to disable)"`
+	BaseURL   string `flag:"baseurl,absolute url of site root used in feed and OpenSearch links instead of one built from Host header"`
+	GzipLevel int    `flag:"gziplevel,gzip compression level of responses, from 1 (best speed) to 9 (best compression)"`
+	NoGzip    bool   `flag:"nogzip,disable gzip compression of responses"`
+
+	Favicon    string `flag:"favicon,path to icon file to serve as /favicon.ico"`
+	DateFormat string `flag:"datefmt,format of page modification time, as Go reference time layout"`
+	Plaintext  string `flag:"plaintext,comma-separated extensions (.txt) or names (LICENSE) of text files to render within page"`
+	NoCSV      bool   `flag:"nocsv,serve .csv and .tsv files as is instead of rendering them as tables"`
+	Listings   bool   `flag:"listings,render listings of directories without index.html with titles of documents instead of plain ones"`
+	Convert    string `flag:"convert,comma-separated .ext=command pairs of programs converting files of other markup formats from stdin to html on stdout"`
+
+	AssetMaxAge time.Duration `flag:"assetmaxage,max-age of Cache-Control header for static files other than markdown (0 to disable)"`
+	PageSize    int           `flag:"pagesize,split index into pages with up to this many entries each (0 to disable)"`
+
+	InlineImg bool   `flag:"inlineimages,embed local images into pages as data URIs"`
+	InlineMax int64  `flag:"inlinemax,max size in bytes of image to embed with -inlineimages"`
+	ImgWidth  int    `flag:"imagewidth,serve local JPEG and PNG images on pages scaled down to this width in pixels (0 to disable)"`
+	Numbered  bool   `flag:"numbered,number document sections"`
+	TOC       string `flag:"toc,where to show table of contents: top, sidebar or off"`
+	TOCDepth  int    `flag:"tocdepth,max level of headings listed in table of contents (1-6)"`
+
+	Extensions string `flag:"extensions,comma-separated markdown extensions to enable (+name) or disable (-name): footnotes, deflists, strikethrough, hardbreaks, autolinks, smartquotes"`
+	Mentions   string `flag:"mentions,link @username mentions to this URL, with {user} replaced by user name, like https://github.com/{user}"`
+	Vars       string `flag:"vars,comma-separated name=value variables replacing {{name}} references in documents"`
+	VarsEnv    string `flag:"varsenv,comma-separated names of environment variables replacing {{NAME}} references in documents"`
+
+	MaxSize int64 `flag:"maxsize,max size in bytes of file to render (0 to disable)"`
+
+	CacheSize int64 `flag:"cachesize,max total size in bytes of rendered pages kept in memory (0 to disable)"`
+
+	CheckAnchors bool `flag:"checkanchors,report headings with duplicate ids and exit"`
+	CheckLinks   bool `flag:"check,report broken links and missing images in markdown files and exit"`
+	LinkCheck    bool `flag:"linkcheck,list broken links and missing images of all documents at /?linkcheck"`
+
+	Zip   string `flag:"zip,serve files from this zip archive instead of -dir"`
+	Watch bool   `flag:"watch,reload open pages in browser when files change"`
+
+	Export string `flag:"export,render all files into static html site in this directory and exit"`
+	Theme  string `flag:"theme,color theme of built-in stylesheet: light, dark, or auto to follow system preference"`
+
+	Mermaid string `flag:"mermaid,URL of mermaid.js script to render diagrams in mermaid code blocks with"`
+	Math    string `flag:"math,directory with KaTeX distribution to typeset math formulas with"`
+
+	TLSCert       string `flag:"tlscert,path to TLS certificate file to serve HTTPS with (requires -tlskey)"`
+	TLSKey        string `flag:"tlskey,path to TLS private key file"`
+	TLSSelfSigned bool   `flag:"tlsselfsigned,serve HTTPS with self-signed certificate generated on start"`
+
+	ReadTimeout  time.Duration `flag:"readtimeout,max duration of reading entire request, including body (0 to disable)"`
+	WriteTimeout time.Duration `flag:"writetimeout,max duration of writing response (0 to disable); it also cuts off -watch event streams"`
+	IdleTimeout  time.Duration `flag:"idletimeout,how long to keep idle keep-alive connections open (0 to use -readtimeout)"`
+	MaxHeader    int           `flag:"maxheaderbytes,max size in bytes of request headers (0 for default of 1MB)"`
+	H2C          bool          `flag:"h2c,also accept HTTP/2 without TLS, for reverse proxies talking cleartext HTTP/2"`
+
+	Sort     string `flag:"sort,default sort order of index: name, title or mtime"`
+	SortDesc bool   `flag:"sortdesc,sort index in descending order by default"`
+
+	Auth      string `flag:"auth,require basic auth with these user:password credentials"`
+	AuthToken string `flag:"authtoken,require this access token, passed as bearer token or token query parameter"`
+
+	Backlinks bool `flag:"backlinks,list documents linking to page at its bottom"`
+	Orphans   bool `flag:"orphans,mark documents no other document links to in index"`
+	DeadEnds  bool `flag:"deadends,mark documents not linking to other documents in index"`
+
+	NoEmoji   bool `flag:"noemoji,do not replace emoji shortcodes like :smile: with emoji"`
+	NoAnchors bool `flag:"noanchors,do not add ¶ links to headers"`
+	QuickOpen bool `flag:"quickopen,add Ctrl+K dialog to pages which finds documents by fuzzy matching names and titles"`
+	Edit      bool `flag:"edit,allow changing markdown files from browser"`
+	NoGit     bool `flag:"nogit,do not show git history even if directory is in git repository"`
+
+	GitPull time.Duration `flag:"gitpull,run git pull in directory this often (0 to disable)"`
+	Remote  string        `flag:"remote,url of git repository to clone and serve instead of -dir, like https://github.com/user/project.wiki.git"`
+
+	Templates string `flag:"templates,directory with page.tmpl and index.tmpl templates overriding built-in ones"`
+
+	PDF       string `flag:"pdf,command converting HTML from stdin to PDF on stdout, to serve documents as PDF with ?pdf"`
+	ExportPDF string `flag:"exportpdf,convert all markdown files into PDF files in this directory with -pdf command and exit"`
 }
 
 func run(args runArgs) error {
+	if args.Remote != "" {
+		if args.Dir != "." || args.Zip != "" {
+			return errors.New("-remote cannot be used with -dir or -zip")
+		}
+		dir, err := cloneRemote(args.Remote)
+		if err != nil {
+			return fmt.Errorf("-remote: %v", err)
+		}
+		args.Dir = dir
+	}
 	h := &mdHandler{
 		dir:        args.Dir,
 		fileServer: http.FileServer(http.Dir(args.Dir)),
 		githubWiki: args.Ghub,
+		redirect:   args.Redir,
 		withSearch: args.Grep,
+		exactMatch: args.Exact,
+		searchTime: args.SearchTimeout,
 		rootIndex:  args.Idx,
 		hljs:       args.HLJS,
 		linkStyle:  args.LinkCSS,
 		style:      style,
+		cspValue:   args.CSP,
+		exclude:    args.Exclude,
+		favicon:    []byte(defaultFavicon),
+		faviconTyp: "image/svg+xml",
+		dateFormat: args.DateFormat,
+		plaintext:  make(map[string]struct{}),
+		assetAge:   args.AssetMaxAge,
+		pageSize:   args.PageSize,
+		inlineImg:  args.InlineImg,
+		inlineMax:  args.InlineMax,
+		imageWidth: args.ImgWidth,
+		maxSize:    args.MaxSize,
+		sortBy:     args.Sort,
+		sortDesc:   args.SortDesc,
+		noEmoji:    args.NoEmoji,
+		noAnchors:  args.NoAnchors,
+		quickOpen:  args.QuickOpen,
+		noCSV:      args.NoCSV,
+		listings:   args.Listings,
+		feedSize:   args.Feed,
+		edit:       args.Edit,
+		toc:        args.TOC,
+		tocDepth:   args.TOCDepth,
+		sanitize:   args.Sanitize,
+	}
+	if !validTOC(args.TOC) {
+		return fmt.Errorf("invalid -toc value %q, must be one of: top, sidebar, off", args.TOC)
+	}
+	if !validSanitize(args.Sanitize) {
+		return fmt.Errorf("invalid -sanitize value %q, must be one of: strict, ugc, relaxed, off", args.Sanitize)
+	}
+	if args.Sanitize == sanitizeRelaxed {
+		h.policy = render.RelaxedPolicy()
+	}
+	if args.InlineImg {
+		h.policy = inlineImagesPolicy(h.policy)
+	}
+	if args.BaseURL != "" {
+		var err error
+		if h.siteURL, err = parseBaseURL(args.BaseURL); err != nil {
+			return fmt.Errorf("-baseurl: %v", err)
+		}
+	}
+	if args.TOCDepth < 1 || args.TOCDepth > 6 {
+		return errors.New("-tocdepth must be in 1-6 range")
+	}
+	if args.Convert != "" {
+		var err error
+		if h.converters, err = parseConverters(args.Convert); err != nil {
+			return fmt.Errorf("-convert: %v", err)
+		}
+	}
+	if err := h.setExtensions(args.Extensions); err != nil {
+		return fmt.Errorf("-extensions: %v", err)
+	}
+	if err := h.setVars(args.Vars, args.VarsEnv); err != nil {
+		return fmt.Errorf("-vars: %v", err)
+	}
+	if args.Mentions != "" {
+		if !strings.Contains(args.Mentions, mentionPlaceholder) {
+			return fmt.Errorf("-mentions must have %s placeholder", mentionPlaceholder)
+		}
+		h.mentions = args.Mentions
+	}
+	if args.Templates != "" {
+		if err := h.loadTemplates(args.Templates); err != nil {
+			return fmt.Errorf("-templates: %v", err)
+		}
+	}
+	if !validSort(args.Sort) {
+		return fmt.Errorf("invalid -sort value %q, must be one of: name, title, mtime", args.Sort)
+	}
+	// pages with embedded images may change without their source file
+	// changing, so they're not cached
+	if args.CacheSize > 0 && !args.InlineImg {
+		h.cache = newRenderCache(args.CacheSize)
+	}
+	for _, s := range strings.Split(args.Plaintext, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			h.plaintext[s] = struct{}{}
+		}
+	}
+	if _, err := path.Match(args.Exclude, ""); err != nil {
+		return fmt.Errorf("invalid -exclude pattern %q: %v", args.Exclude, err)
+	}
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, args.GzipLevel); err != nil {
+		return fmt.Errorf("invalid -gziplevel value: %v", err)
+	}
+	var err error
+	if args.Lang != "" {
+		if h.lang, err = language.Parse(args.Lang); err != nil {
+			return fmt.Errorf("invalid -lang value %q: %v", args.Lang, err)
+		}
+	}
+	if args.Mermaid != "" {
+		src, err := scriptSource(args.Mermaid)
+		if err != nil {
+			return fmt.Errorf("invalid -mermaid value %q: %v", args.Mermaid, err)
+		}
+		h.mermaidSrc, h.mermaidCSP = args.Mermaid, src
+	}
+	if args.Math != "" {
+		if h.mathFiles, err = newMathHandler(args.Math); err != nil {
+			return fmt.Errorf("invalid -math directory: %v", err)
+		}
+		h.mathDir = args.Math
+	}
+	if st, err := os.Stat(args.Dir); err == nil && st.Mode().IsRegular() {
+		if args.Zip != "" {
+			return errors.New("-zip cannot be used with -dir pointing to archive")
+		}
+		switch {
+		case strings.HasSuffix(strings.ToLower(args.Dir), ".zip"):
+			args.Zip = args.Dir
+		case isTarGz(args.Dir):
+			if h.fsys, err = openTarGz(args.Dir); err != nil {
+				return fmt.Errorf("-dir: %v", err)
+			}
+			h.fileServer = http.FileServer(http.FS(h.fsys))
+			if h.edit {
+				return errors.New("-edit cannot be used with archive")
+			}
+		default:
+			return fmt.Errorf("-dir %q is neither a directory nor a .zip, .tar.gz or .tgz archive", args.Dir)
+		}
+	}
+	if _, err := os.Stat(args.Dir); err != nil && strings.Contains(args.Dir, "=") {
+		if args.Zip != "" {
+			return errors.New("-zip cannot be used with multiple directories")
+		}
+		if h.mounts, err = parseMounts(args.Dir); err != nil {
+			return fmt.Errorf("invalid -dir: %v", err)
+		}
+		h.fsys = h.mounts
+		h.fileServer = http.FileServer(http.FS(h.fsys))
+	}
+	if args.Zip != "" {
+		zr, err := zip.OpenReader(args.Zip)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		h.fsys = seekableFS{&zr.Reader}
+		h.fileServer = http.FileServer(http.FS(h.fsys))
+		if h.edit {
+			return errors.New("-edit cannot be used with -zip")
+		}
+	}
+	if embeddedFS != nil && args.Dir == "." && args.Zip == "" && args.Remote == "" {
+		h.fsys = embeddedFS
+		h.fileServer = http.FileServer(http.FS(h.fsys))
+		if h.edit {
+			return errors.New("-edit cannot be used with embedded files")
+		}
+	}
+	h.ignore = &ignoreFile{fsys: h.files(), name: ignoreFileName}
+	h.redirects = newRedirectMap(h)
+	if !args.NoGit && h.fsys == nil {
+		h.git = openGitRepo(args.Dir)
+	}
+	if args.GitPull > 0 && h.git == nil {
+		return errors.New("-gitpull requires -dir to be in git repository")
+	}
+	if h.withSearch {
+		h.textIndex = newTextIndex(h.files(), h.unlisted)
+	}
+	if args.Backlinks || args.Orphans || args.DeadEnds {
+		h.links = newLinkGraph(h)
+	}
+	h.backlinks = args.Backlinks
+	h.linkCheck = args.LinkCheck
+	h.orphans, h.deadEnds = args.Orphans, args.DeadEnds
+	if args.Watch {
+		dirs := []string{args.Dir}
+		switch {
+		case h.mounts != nil:
+			dirs = h.mounts.dirs()
+		case h.fsys != nil:
+			return fmt.Errorf("-watch cannot be used with -zip or archive")
+		}
+		if h.watch, err = newWatcher(dirs...); err != nil {
+			return fmt.Errorf("-watch: %v", err)
+		}
+		if h.textIndex != nil {
+			h.watch.onChange(h.textIndex.invalidate)
+		}
+		h.watch.onChange(h.redirects.invalidate)
+		h.watch.onChange(h.wikiFiles.invalidate)
+	}
+	if args.CheckAnchors {
+		return h.checkAnchors(os.Stdout)
+	}
+	if args.CheckLinks {
+		return h.reportLinks(os.Stdout)
+	}
+	if !validTheme(args.Theme) {
+		return fmt.Errorf("invalid -theme value %q, must be one of: light, dark, auto", args.Theme)
+	}
+	h.style += themeStyle(args.Theme)
+	if args.Numbered {
+		h.extraStyle += numberingStyle
 	}
 	if args.CSS != "" {
 		switch {
@@ -98,131 +856,1140 @@ func run(args runArgs) error {
 				return fmt.Errorf("with -csslink set, -css must be an absolute / separated path, but %q is not", args.CSS)
 			}
 			h.style = args.CSS
-			reportIfMissing(filepath.Join(args.Dir, filepath.FromSlash(args.CSS)))
+			reportIfMissing(h.files(), fsName(args.CSS))
 		default:
-			b, err := ioutil.ReadFile(args.CSS)
-			if err != nil {
+			h.cssFile = args.CSS
+			if err := h.loadStyle(); err != nil {
 				return err
 			}
-			h.style = string(b)
 		}
 	}
+	if args.Favicon != "" {
+		b, err := ioutil.ReadFile(args.Favicon)
+		if err != nil {
+			return err
+		}
+		h.favicon, h.faviconTyp = b, mime.TypeByExtension(filepath.Ext(args.Favicon))
+		if h.faviconTyp == "" {
+			h.faviconTyp = http.DetectContentType(b)
+		}
+		h.faviconSet = true
+	}
 	if !args.LinkCSS {
-		sum := sha256.Sum256([]byte(h.style))
-		h.styleHash = "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+		if h.cssFile == "" {
+			h.style += h.extraStyle
+			h.themes = make(map[string]themedStyle, len(themes))
+			for _, t := range themes {
+				s := style + themeStyle(t) + h.extraStyle
+				h.themes[t] = themedStyle{style: s, hash: styleHash(s)}
+			}
+		}
+		h.styleHash = styleHash(h.style)
+	}
+	if (args.TLSCert == "") != (args.TLSKey == "") {
+		return errors.New("-tlscert and -tlskey must be used together")
+	}
+	if args.TLSCert != "" && args.TLSSelfSigned {
+		return errors.New("-tlsselfsigned cannot be used with -tlscert")
+	}
+	if strings.HasPrefix(args.Addr, unixPrefix) && (args.Open || args.OpenFil != "") {
+		return errors.New("-open and -openfile cannot be used with unix socket address")
+	}
+	var authUser, authPassword string
+	if args.Auth != "" {
+		parts := strings.SplitN(args.Auth, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.New("-auth must be in user:password form")
+		}
+		authUser, authPassword = parts[0], parts[1]
+	}
+	if args.PDF != "" {
+		h.pdf = strings.Fields(args.PDF)
+	}
+	if args.Export != "" {
+		return h.export(args.Export)
+	}
+	if args.ExportPDF != "" {
+		if h.pdf == nil {
+			return errors.New("-exportpdf requires -pdf")
+		}
+		return h.exportPDF(args.ExportPDF)
+	}
+	if h.cssFile != "" {
+		go h.reloadOnSignal()
+	}
+	var handler http.Handler = h
+	if args.Metrics {
+		handler = newMetrics(h, handler)
+	}
+	if authUser != "" || args.AuthToken != "" {
+		handler = &auth{next: handler, user: authUser, password: authPassword, token: args.AuthToken}
+	}
+	if !args.NoGzip {
+		handler = httpgzip.New(handler, httpgzip.WithLevel(args.GzipLevel))
 	}
 	srv := http.Server{
-		Addr:        args.Addr,
-		Handler:     httpgzip.New(h),
-		ReadTimeout: time.Second,
+		Addr:           args.Addr,
+		Handler:        handler,
+		ReadTimeout:    args.ReadTimeout,
+		WriteTimeout:   args.WriteTimeout,
+		IdleTimeout:    args.IdleTimeout,
+		MaxHeaderBytes: args.MaxHeader,
 	}
-	if args.Open {
+	if args.H2C {
+		if args.TLSCert != "" || args.TLSSelfSigned {
+			return errors.New("-h2c cannot be used with TLS, which negotiates HTTP/2 itself")
+		}
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	scheme := "http"
+	if args.TLSSelfSigned {
+		var host string
+		if !strings.HasPrefix(args.Addr, unixPrefix) {
+			if host, _, err = net.SplitHostPort(args.Addr); err != nil {
+				return err
+			}
+		}
+		cert, err := selfSignedCert(host)
+		if err != nil {
+			return fmt.Errorf("generating self-signed certificate: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		log.Printf("self-signed certificate SHA-256 fingerprint: %X", sha256.Sum256(cert.Certificate[0]))
+	}
+	if args.TLSCert != "" || args.TLSSelfSigned {
+		scheme = "https"
+	}
+	if args.Open || args.OpenFil != "" {
+		openURL := scheme + "://" + args.Addr + "/?index"
+		if args.OpenFil != "" {
+			name := fsName(path.Clean("/" + filepath.ToSlash(args.OpenFil)))
+			if st, err := fs.Stat(h.files(), name); err != nil || !st.Mode().IsRegular() {
+				log.Printf("file %q given with -openfile does not exist or not a regular file, opening index instead", name)
+			} else {
+				u := url.URL{Scheme: scheme, Host: args.Addr, Path: path.Join("/", filepath.ToSlash(args.OpenFil))}
+				openURL = u.String()
+			}
+		}
 		go func() {
 			time.Sleep(100 * time.Millisecond)
-			browser.OpenURL("http://" + args.Addr + "/?index")
+			browser.OpenURL(openURL)
 		}()
 	}
-	return srv.ListenAndServe()
+	if h.watch != nil {
+		// event streams would otherwise keep server from shutting down
+		srv.RegisterOnShutdown(h.watch.close)
+	}
+	if args.GitPull > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		srv.RegisterOnShutdown(cancel)
+		go h.git.pull(ctx, args.GitPull, func() {
+			// pages depend on other files and last commits, so drop them all
+			if h.cache != nil {
+				h.cache.clear()
+			}
+		})
+	}
+	ln, err := listen(args.Addr)
+	if err != nil {
+		return err
+	}
+	// with -tlsselfsigned certificate is already in srv.TLSConfig
+	return serve(&srv, ln, args.TLSCert, args.TLSKey)
 }
 
 type mdHandler struct {
 	dir        string
 	fileServer http.Handler // initialized as http.FileServer(http.Dir(dir))
+	fsys       fs.FS        // if set, files are served from it instead of dir
+	mounts     mountFS      // if set, directories served, also set as fsys
 	githubWiki bool
+	redirect   bool // redirect page requests to canonical urls, see resolveName
 	withSearch bool
+	exactMatch bool          // use exact substring search instead of loose matching
+	lang       language.Tag  // collation rules for loose search, if not set taken from request
+	searchTime time.Duration // if positive, limits search duration
 	rootIndex  bool
 	hljs       bool
 	linkStyle  bool
-	style      string
-	styleHash  string // sha256-{HASH} value for CSP
+	cssFile    string                 // custom stylesheet file, reloaded on SIGHUP
+	extraStyle string                 // appended to embedded stylesheet by enabled features
+	themes     map[string]themedStyle // built-in stylesheet for each theme, nil if custom one is used
+
+	mu        sync.RWMutex // guards fields below
+	style     string
+	styleHash string    // sha256-{HASH} value for CSP
+	styleTime time.Time // when style was last reloaded
+
+	cspValue      string              // if set, used verbatim instead of autogenerated CSP
+	exclude       string              // glob pattern of markdown files to hide
+	ignore        *ignoreFile         // patterns of markdown files to hide, from .mdignore
+	redirects     *redirectMap        // old paths of moved documents, see serveRedirect
+	favicon       []byte              // served as /favicon.ico
+	faviconTyp    string              // Content-Type of favicon
+	faviconSet    bool                // favicon is explicitly set with -favicon flag
+	dateFormat    string              // time.Format layout of page modification time
+	plaintext     map[string]struct{} // extensions and names of files rendered as text
+	assetAge      time.Duration       // if positive, max-age for static files
+	pageSize      int                 // if positive, max number of index entries per page
+	inlineImg     bool                // embed local images as data URIs
+	inlineMax     int64               // max size of embedded image
+	imageWidth    int                 // if positive, width local images are scaled down to
+	maxSize       int64               // if positive, max size of rendered file
+	cache         *renderCache        // if not nil, keeps recently rendered pages
+	watch         *watcher            // if set, notifies pages about file changes
+	textIndex     *textIndex          // if set, used for loose search
+	links         *linkGraph          // links between documents
+	backlinks     bool                // list documents linking to page
+	orphans       bool                // mark documents without incoming links in index
+	deadEnds      bool                // mark documents without outgoing links in index
+	noEmoji       bool                // keep emoji shortcodes as is
+	noAnchors     bool                // don't add ¶ links to headings
+	quickOpen     bool                // include quick-open dialog script
+	noCSV         bool                // serve CSV and TSV files as is
+	listings      bool                // render directory listings
+	linkCheck     bool                // serve broken links report at /?linkcheck
+	feedSize      int                 // if positive, max number of documents in feed
+	siteURL       *url.URL            // url of site root set with -baseurl, see baseURL
+	extensions    parser.Extensions   // markdown parser extensions, see -extensions flag
+	mentions      string              // url template of @mentions, see -mentions flag
+	vars          map[string]string   // variables substituted into documents, see substituteVars
+	varsKey       string              // identifies vars
+	noSmartypants bool                // keep quotes and dashes as is
+	edit          bool                // allow changing markdown files
+	git           *gitRepo            // set if served directory is in git repository
+	toc           string              // where to show table of contents, see -toc flag
+	tocDepth      int                 // max level of headings in table of contents
+	sanitize      string              // how to treat html in documents, see -sanitize flag
+	policy        *bluemonday.Policy  // if set, replaces render.DefaultPolicy
+
+	converters map[string]markupConverter // file extension -> converter to html, see -convert flag
+	convTitles convertedTitles            // titles of files rendered with converters
+	includes   includedFilesCache         // files included into documents
+	wikiFiles  wikiFileList               // markdown files wiki links resolve to
+
+	pageTpl, indexTpl *template.Template // if set, override pageTemplate and indexTemplate
+	templateHash      string             // identifies pageTpl and indexTpl
+	editMu            sync.Mutex         // serializes file updates
+	pdf               pdfConverter       // if set, used to serve documents as PDF
+	exporting         bool               // rendering pages for static site, see export
+	mermaidSrc        string             // if set, URL of mermaid.js script
+	mermaidCSP        string             // CSP source matching mermaidSrc
+	mathDir           string             // if set, directory with KaTeX files
+	mathFiles         http.Handler       // serves files from mathDir under mathPath
+	sortBy            string             // default index sort order, see sortIndex
+	sortDesc          bool
+}
+
+// files returns file system with served files
+func (h *mdHandler) files() fs.FS {
+	if h.fsys != nil {
+		return h.fsys
+	}
+	return os.DirFS(h.dir)
+}
+
+// fsName converts cleaned slash separated URL path to a name of file as
+// expected by fs.FS
+func fsName(p string) string {
+	if p = strings.TrimPrefix(p, "/"); p == "" {
+		return "."
+	}
+	return p
 }
 
 func (h *mdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == healthPath {
+		h.serveHealth(w, r)
+		return
+	}
+	if r.URL.Path == watchPath && h.watch != nil {
+		h.watch.ServeHTTP(w, r)
+		return
+	}
+	if h.mathFiles != nil && strings.HasPrefix(r.URL.Path, mathPath) {
+		h.mathFiles.ServeHTTP(w, r)
+		return
+	}
 	w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	if r.URL.Path == faviconPath && h.serveFavicon(w, r) {
+		return
+	}
+	if r.URL.Path == feedPath && h.feedSize > 0 && !h.exporting {
+		if _, err := fs.Stat(h.files(), fsName(feedPath)); err != nil {
+			h.serveFeed(w, r)
+			return
+		}
+	}
+	if r.URL.Path == openSearchPath && h.withSearch && !h.exporting {
+		h.serveOpenSearch(w, r)
+		return
+	}
 	if h.withSearch && r.URL.Path == "/" && strings.HasPrefix(r.URL.RawQuery, "q=") {
 		q := r.URL.Query().Get("q")
-		if len(q) < 3 {
+		mode, term := h.searchMode(q, r.URL.Query().Get("mode"))
+		scope := readSearchScope(r.URL.Query())
+		index, err := h.search(r.Context(), h.searchLang(r), term, mode, scope)
+		if err == errShortQuery {
 			http.Error(w, "Search term is too short", http.StatusBadRequest)
 			return
 		}
-		pat := search.New(language.English, search.Loose).CompileString(q)
-		h.renderIndex(w, fmt.Sprintf("Search results for %q", q), dirIndex(h.dir, pat))
+		if qerr, ok := err.(queryError); ok {
+			http.Error(w, "Invalid search query: "+qerr.Error(), http.StatusBadRequest)
+			return
+		}
+		page := indexPage{
+			Title:      fmt.Sprintf("Search results for %q%s", q, scope.describe()),
+			Index:      index,
+			IsSearch:   true,
+			Mode:       mode,
+			ScopeTags:  scope.tags,
+			Scoped:     true,
+			Incomplete: err != nil,
+			view:       readView(w, r),
+		}
+		if mode != searchRegexp {
+			page.Query, page.Fragment = term, textFragment(term)
+		}
+		if scope.dir != "" {
+			page.ScopeDir = scope.dir + "/"
+		}
+		h.renderIndex(w, page)
 		return
 	}
-	if r.URL.Path == "/" && (h.rootIndex || r.URL.RawQuery == "index") {
-		h.renderIndex(w, "Index", dirIndex(h.dir, nil))
+	if h.git != nil && strings.HasPrefix(r.URL.Path, historyPath) {
+		h.serveHistory(w, r)
 		return
 	}
-	if !strings.HasSuffix(r.URL.Path, mdSuffix) {
-		h.fileServer.ServeHTTP(w, r)
+	if h.git != nil && strings.HasPrefix(r.URL.Path, diffPath) {
+		h.serveDiff(w, r)
 		return
 	}
+	if h.edit && strings.HasPrefix(r.URL.Path, editPath) {
+		h.serveEdit(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, apiPrefix) {
+		h.serveAPI(w, r)
+		return
+	}
+	if r.URL.Path == "/" && h.linkCheck && hasQueryKey(r.URL.RawQuery, "linkcheck") && !h.exporting {
+		h.serveLinkCheck(w, r)
+		return
+	}
+	if r.URL.Path == "/" && hasQueryKey(r.URL.RawQuery, "graph") && h.links != nil {
+		h.serveGraph(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/") &&
+		(hasQueryKey(r.URL.RawQuery, "index") || hasQueryKey(r.URL.RawQuery, "tags") ||
+			hasQueryKey(r.URL.RawQuery, "tag") || hasQueryKey(r.URL.RawQuery, "orphans") ||
+			r.URL.Path == "/" && h.rootIndex) {
+		h.serveIndex(w, r)
+		return
+	}
+	upath := r.URL.Path
+	if !strings.HasSuffix(upath, mdSuffix) {
+		if !h.markdownFallback(upath) {
+			name := fsName(path.Clean("/" + upath))
+			if !h.insideRoot(name) {
+				http.Error(w, "invalid URL path", http.StatusBadRequest)
+				return
+			}
+			// config file may have credentials
+			if isConfigFile(name) {
+				http.NotFound(w, r)
+				return
+			}
+			if h.listings && strings.HasSuffix(upath, "/") && h.isListedDir(name) {
+				h.serveListing(w, r, name)
+				return
+			}
+			if h.isPlaintext(name) {
+				h.servePlaintext(w, r, name, plainText)
+				return
+			}
+			if !hasQueryKey(r.URL.RawQuery, "raw") && h.isTable(name) {
+				h.servePlaintext(w, r, name, plainTable)
+				return
+			}
+			if !hasQueryKey(r.URL.RawQuery, "raw") && h.converter(name) != nil {
+				h.servePlaintext(w, r, name, plainConverted)
+				return
+			}
+			st, err := fs.Stat(h.files(), name)
+			if errors.Is(err, fs.ErrNotExist) && h.serveRedirect(w, r) {
+				return
+			}
+			if err == nil && st.Mode().IsRegular() && h.assetAge > 0 {
+				w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(h.assetAge.Seconds())))
+			}
+			if h.imageWidth > 0 && r.URL.Query().Get("w") != "" && h.serveResizedImage(w, r, name) {
+				return
+			}
+			if h.servePrecompressed(w, r, name) {
+				return
+			}
+			h.fileServer.ServeHTTP(w, r)
+			return
+		}
+		upath += mdSuffix
+	}
 	// only markdown files are handled below
+	p := path.Clean(upath)
+	if containsDotDot(p) {
+		http.Error(w, "invalid URL path", http.StatusBadRequest)
+		return
+	}
+	if name, ok := h.resolveName(fsName(p)); ok {
+		p = "/" + name
+	}
+	if h.redirect && p != r.URL.Path {
+		http.Redirect(w, r, (&url.URL{Path: p, RawQuery: r.URL.RawQuery}).String(), http.StatusMovedPermanently)
+		return
+	}
+	if h.excluded(strings.TrimPrefix(p, "/")) {
+		http.NotFound(w, r)
+		return
+	}
+	name := fsName(p)
+	if !h.insideRoot(name) {
+		http.Error(w, "invalid URL path", http.StatusBadRequest)
+		return
+	}
+	if hasQueryKey(r.URL.RawQuery, "raw") {
+		h.serveRaw(w, r, name)
+		return
+	}
+	if h.pdf != nil && hasQueryKey(r.URL.RawQuery, "pdf") {
+		h.servePDF(w, r, name)
+		return
+	}
+	rc, mtime, err := h.readerForFile(name)
+	if err != nil {
+		if os.IsNotExist(err) && h.serveRedirect(w, r) {
+			return
+		}
+		if os.IsNotExist(err) && h.edit {
+			h.serveMissing(w, r, name)
+			return
+		}
+		if os.IsNotExist(err) || errors.Is(err, fs.ErrInvalid) {
+			http.NotFound(w, r)
+			return
+		}
+		if err == errTooLarge {
+			h.tooLarge(w)
+			return
+		}
+		log.Printf("read %q: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	rc.urlPath = p
+	rc.print = hasQueryKey(r.URL.RawQuery, "print")
+	rc.view = readView(w, r)
+	if hasQueryKey(r.URL.RawQuery, "plain") {
+		rc.plain, rc.kind = true, plainText
+	}
+	etag := rc.etag()
+	// pages change often when documents are edited, so let clients cache
+	// them, but always revalidate
+	w.Header().Set("Cache-Control", "no-cache")
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	var inlineStyles bool
+	if h.mermaidSrc != "" || h.mathDir != "" {
+		// page has to be rendered to know whether it has diagrams or
+		// formulas needing inline styles
+		if err := rc.init(); err != nil {
+			log.Printf("read %q: %v", name, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		inlineStyles = rc.inlineStyles
+	}
+	w.Header().Set("Content-Security-Policy", h.csp(h.hljs, inlineStyles))
+	http.ServeContent(w, r, "page.html", mtime, rc)
+}
+
+// searchLang returns language which collation rules are used for loose
+// search: the one set with -lang flag, or the one most preferred by client,
+// or English
+func (h *mdHandler) searchLang(r *http.Request) language.Tag {
+	if h.lang != language.Und {
+		return h.lang
+	}
+	if tags, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language")); err == nil {
+		for _, tag := range tags {
+			// "*" is parsed as "mul" tag
+			if tag != language.Und && tag != language.Make("mul") {
+				return tag
+			}
+		}
+	}
+	return language.English
+}
+
+// errShortQuery is returned by search for queries too short to search for
+var errShortQuery = queryError("search term is too short")
+
+// search returns markdown files matching search term q in given mode, both
+// as returned by searchMode, which must be called first, so that query
+// prefixes are only parsed once. If search takes
+// longer than searchTime, it returns partial results along with an error.
+// Queries which can't be searched for are reported with queryError. Results
+// are limited to given scope.
+func (h *mdHandler) search(ctx context.Context, lang language.Tag, q, mode string, scope searchScope) ([]indexRecord, error) {
+	if len(q) < 3 {
+		return nil, errShortQuery
+	}
+	var m lineMatcher
+	switch mode {
+	case searchExact:
+		m = exactMatcher(q)
+	case searchRegexp:
+		var err error
+		if m, err = regexpMatcher(q); err != nil {
+			return nil, err
+		}
+	default:
+		m = looseMatcher(lang, q)
+	}
+	if h.searchTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.searchTime)
+		defer cancel()
+	}
+	var index []indexRecord
+	var err error
+	if h.textIndex != nil && mode == searchLoose {
+		index, err = h.textIndex.search(ctx, lang, q, scope.dir)
+	} else if scope.dir == "" {
+		index, err = dirIndex(ctx, h.files(), ".", m, h.unlisted)
+	} else {
+		// only walk scope directory, keeping paths relative to root
+		index, err = dirIndex(ctx, h.files(), scope.dir, m, h.unlisted)
+		for i := range index {
+			index[i].File = scope.dir + "/" + index[i].File
+			index[i].Subdir = path.Dir(index[i].File)
+		}
+	}
+	return scope.filter(h.files(), index), err
+}
+
+// serveHealth responds with 200 OK if served directory is accessible, and
+// with 503 Service Unavailable otherwise.
+func (h *mdHandler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if st, err := fs.Stat(h.files(), "."); err != nil || !st.IsDir() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "directory is not accessible\n")
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// serveFavicon serves icon set with -favicon flag, or a built-in default one
+// if served directory has no favicon.ico file. It returns false if request
+// should be handled by file server instead.
+func (h *mdHandler) serveFavicon(w http.ResponseWriter, r *http.Request) bool {
+	if h.favicon == nil {
+		return false
+	}
+	if !h.faviconSet {
+		if _, err := fs.Stat(h.files(), fsName(faviconPath)); err == nil {
+			return false
+		}
+	}
+	w.Header().Set("Content-Type", h.faviconTyp)
+	w.Header().Set("Cache-Control", "max-age=604800")
+	http.ServeContent(w, r, "", startTime, bytes.NewReader(h.favicon))
+	return true
+}
+
+// insideRoot reports whether file with slash separated name, after resolving
+// any symlinks, is located inside served directory. Names of non-existent
+// files are reported as being inside, so that they can be handled as usual.
+// When serving file system other than a directory, i.e. zip archive, all
+// names are inside.
+func (h *mdHandler) insideRoot(name string) bool {
+	if h.mounts != nil {
+		dir, rel, ok := h.mounts.resolve(name)
+		return !ok || insideDir(dir, rel)
+	}
+	if h.fsys != nil {
+		return true
+	}
+	return insideDir(h.dir, name)
+}
+
+// insideDir reports whether file name, relative to dir, resolves to a path
+// inside dir after following symlinks
+func insideDir(dir, name string) bool {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return false
+	}
+	real, err := filepath.EvalSymlinks(filepath.Join(dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	if real, err = filepath.Abs(real); err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, real)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// plainKind tells how non-markdown file is rendered within page template
+type plainKind int
+
+const (
+	plainText      plainKind = iota // as preformatted text
+	plainTable                      // CSV or TSV file as table, see renderTable
+	plainConverted                  // with converter, see renderConverted
+)
+
+// isPlaintext reports whether file should be rendered as preformatted text
+// within page template: its extension or name must be listed in -plaintext
+// flag and its content must look like text.
+func (h *mdHandler) isPlaintext(name string) bool {
+	if len(h.plaintext) == 0 {
+		return false
+	}
+	_, okExt := h.plaintext[path.Ext(name)]
+	_, okName := h.plaintext[path.Base(name)]
+	if !okExt && !okName {
+		return false
+	}
+	f, err := h.files().Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err != nil || !st.Mode().IsRegular() {
+		return false
+	}
+	b := make([]byte, 512)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false
+	}
+	return strings.HasPrefix(http.DetectContentType(b[:n]), "text/plain")
+}
+
+// serveRaw serves markdown file name as is, with text/markdown content type
+func (h *mdHandler) serveRaw(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := h.files().Open(name)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, fs.ErrInvalid) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("read %q: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	rs, ok := f.(io.ReadSeeker)
+	if err != nil || !st.Mode().IsRegular() || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", st.ModTime(), rs)
+}
+
+// servePlaintext serves non-markdown file name rendered within page template
+// the way kind tells
+func (h *mdHandler) servePlaintext(w http.ResponseWriter, r *http.Request, name string, kind plainKind) {
+	rc, mtime, err := h.readerForFile(name)
+	if err == errTooLarge {
+		h.tooLarge(w)
+		return
+	}
+	if err != nil {
+		log.Printf("read %q: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	rc.plain, rc.kind = true, kind
+	rc.urlPath = path.Clean("/" + r.URL.Path)
+	etag := rc.etag()
+	w.Header().Set("Cache-Control", "no-cache")
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Content-Security-Policy", h.csp(false, false))
+	http.ServeContent(w, r, "page.html", mtime, rc)
+}
+
+// tooLarge responds with 413 Request Entity Too Large explaining that file
+// exceeds -maxsize limit.
+func (h *mdHandler) tooLarge(w http.ResponseWriter) {
+	http.Error(w, fmt.Sprintf("file is larger than %d bytes and is too large to render", h.maxSize),
+		http.StatusRequestEntityTooLarge)
+}
+
+// markdownFallback reports whether request to upath, which file server would
+// answer with 404, should instead be served by rendering upath+".md" file, so
+// that "/Page" renders "Page.md". Existing files always take precedence.
+func (h *mdHandler) markdownFallback(upath string) bool {
+	if strings.HasSuffix(upath, "/") {
+		return false
+	}
+	p := path.Clean(upath)
+	if containsDotDot(p) {
+		return false
+	}
+	name := fsName(p)
+	if _, err := fs.Stat(h.files(), name); !os.IsNotExist(err) {
+		return false
+	}
+	if st, err := fs.Stat(h.files(), name+mdSuffix); err == nil {
+		return st.Mode().IsRegular()
+	}
+	_, ok := h.resolveName(name + mdSuffix)
+	return ok
+}
+
+// unlisted reports whether markdown file with given / separated path,
+// relative to served directory, is left out of indexes, search and other
+// lists of documents: either it's excluded, or it's a symlink resolving
+// outside of served directory. Functions walking documents, like dirIndex and
+// markdownFiles, are given it as their exclude argument.
+func (h *mdHandler) unlisted(name string) bool {
+	return h.excluded(name) || !h.insideRoot(name)
+}
+
+// excluded reports whether markdown file with given / separated path,
+// relative to served directory, should be hidden, either because it matches
+// patterns from .mdignore file, or -exclude pattern, or because it's a GitHub
+// wiki sidebar or footer. The -exclude pattern is matched against both full
+// relative path and base file name.
+func (h *mdHandler) excluded(name string) bool {
+	if isWikiPart(name) {
+		return true
+	}
+	if h.ignore != nil && h.ignore.load().match(name) {
+		return true
+	}
+	if h.exclude == "" {
+		return false
+	}
+	if ok, _ := path.Match(h.exclude, name); ok {
+		return true
+	}
+	ok, _ := path.Match(h.exclude, path.Base(name))
+	return ok
+}
+
+// pageData holds data used to render pageTemplate, or page.tmpl template
+// set with -templates flag
+type pageData struct {
+	Title         string        // from front matter, first header, or file name
+	Description   string        // from front matter, or first paragraph
+	StyleHref     string        // stylesheet url, if run with -csslink
+	Style         template.CSS  // stylesheet, if StyleHref is not set
+	Body          template.HTML // rendered document
+	TOC           template.HTML // table of contents, if page has 2 or more headings
+	SidebarTOC    bool          // show TOC in sidebar instead of above document
+	WithHL        bool          // include highlight.js
+	WithWatch     bool          // include script reloading page on changes
+	MermaidSrc    string        // mermaid.js url, if page has diagrams
+	WithMath      bool          // include KaTeX, page has formulas
+	Prev, Next    *pageLink     // neighbor pages in index order
+	Backlinks     []pageLink    // pages linking this one, if run with -backlinks
+	Commit        string        // author and date of the last commit
+	HistoryHref   string        // page history url
+	Sidebar       template.HTML // rendered _Sidebar.md
+	Footer        template.HTML // rendered _Footer.md
+	Print         bool          // printable page without navigation
+	ViewLinks     bool          // link source and printable views
+	WithPDF       bool          // link PDF view
+	EditHref      string        // editor url, if editing is allowed
+	WithTasks     bool          // make task list checkboxes editable
+	WithAnchors   bool          // include script copying heading links
+	WithHighlight bool          // include script highlighting search query, see highlightScript
+	QuickOpen     bool          // include quick-open dialog script
+	Wide          bool          // don't limit width of text
+	IndexHref     string        // url of index
+	SearchHref    string        // OpenSearch description url, if search is enabled
+	Modified      string        // ModTime formatted with -datefmt layout
+	ModTime       time.Time     // file modification time
+	Crumbs        []breadcrumb  // navigation trail from root to page
+}
+
+// indexPage holds data used to render indexTemplate, or index.tmpl template
+// set with -templates flag
+type indexPage struct {
+	Title      string
+	StyleHref  string
+	Style      template.CSS
+	Index      []indexRecord
+	WithSearch bool
+	IsSearch   bool         // Index holds search results
+	Query      string       // search query, highlighted on pages results link to
+	Mode       string       // search mode, see searchMode
+	ScopeDir   string       // directory search form offers to limit search to
+	ScopeTags  []string     // tags search form offers to limit search to
+	Scoped     bool         // search form limits search to ScopeDir and ScopeTags by default
+	Fragment   template.URL // text fragment directive of search query, see textFragment
+	Incomplete bool         // search was interrupted, Index holds partial results
+	Tags       []tagCount   // if set, page lists tags instead of Index
+	HasTags    bool         // some of Index records have tags
+	HasOrphans bool         // some of Index records are marked by markOrphans
+	SortLinks  []sortLink   // links to differently sorted index
+	WithTags   bool         // link tags of records
+	NewPageURL string       // where to post form creating new page, if editing is allowed
+	FeedHref   string       // Atom feed url, if run with -feed
+	SearchHref string       // OpenSearch description url, if search is enabled
+	QuickOpen  bool         // include quick-open dialog script
+	Wide       bool         // don't limit width of text
+
+	view viewPrefs // reader's presentation preferences, see readView
+
+	Page, Pages        int    // current page number and total number of pages, starting from 1
+	PrevHref, NextHref string // links to previous and next pages, if any
+}
+
+// paginate limits page.Index to n-th page of given size, filling pagination
+// related fields. Page numbers start from 1, out of range numbers are clamped
+// to the valid range. Links to other pages have query, like "index", followed
+// by page parameter.
+func (page *indexPage) paginate(n, size int, query string) {
+	page.Pages = (len(page.Index) + size - 1) / size
+	if page.Pages < 1 {
+		page.Pages = 1
+	}
+	switch {
+	case n < 1:
+		n = 1
+	case n > page.Pages:
+		n = page.Pages
+	}
+	page.Page = n
+	begin, end := (n-1)*size, n*size
+	if end > len(page.Index) {
+		end = len(page.Index)
+	}
+	page.Index = page.Index[begin:end]
+	if n > 1 {
+		page.PrevHref = "?" + query + "&page=" + strconv.Itoa(n-1)
+	}
+	if n < page.Pages {
+		page.NextHref = "?" + query + "&page=" + strconv.Itoa(n+1)
+	}
+}
+
+// serveIndex renders autogenerated index of markdown files found in
+// directory referenced by request path and its subdirectories.
+func (h *mdHandler) serveIndex(w http.ResponseWriter, r *http.Request) {
 	p := path.Clean(r.URL.Path)
 	if containsDotDot(p) {
 		http.Error(w, "invalid URL path", http.StatusBadRequest)
 		return
 	}
-	name := filepath.Join(h.dir, filepath.FromSlash(p))
-	rc, mtime, err := h.readerForFile(name)
-	if err != nil {
-		if os.IsNotExist(err) {
-			http.NotFound(w, r)
-			return
+	prefix := strings.TrimPrefix(p, "/")
+	if strings.HasPrefix(prefix, ".") || strings.Contains(prefix, "/.") {
+		http.NotFound(w, r)
+		return
+	}
+	dir := fsName(p)
+	if !h.insideRoot(dir) {
+		http.Error(w, "invalid URL path", http.StatusBadRequest)
+		return
+	}
+	if st, err := fs.Stat(h.files(), dir); err != nil || !st.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	var where string
+	if prefix != "" {
+		where = " of " + p + "/"
+	}
+	index, _ := dirIndex(r.Context(), h.files(), dir, nil, h.unlisted)
+	index = append(index, h.convertedIndex(r.Context(), dir)...)
+	if h.git != nil {
+		commits := h.git.lastCommits(r.Context())
+		for i := range index {
+			if c, ok := commits[path.Join(dir, index[i].File)]; ok {
+				index[i].Commit = h.commitInfo(c)
+			}
+		}
+	}
+	h.markOrphans(r.Context(), dir, index)
+	page := indexPage{Title: "Index" + where, Index: index, view: readView(w, r)}
+	if prefix != "" {
+		page.ScopeDir = prefix + "/"
+	}
+	query := "index"
+	q := r.URL.Query()
+	switch tag := q.Get("tag"); {
+	case hasQueryKey(r.URL.RawQuery, "orphans") && (h.orphans || h.deadEnds):
+		page.Title = "Orphan pages" + where
+		page.Index = filterOrphans(index)
+		query = "orphans"
+	case hasQueryKey(r.URL.RawQuery, "tags"):
+		page.Title, page.Index, page.Tags = "Tags"+where, nil, countTags(index)
+		h.renderIndex(w, page)
+		return
+	case tag != "":
+		page.Title = fmt.Sprintf("Pages%s tagged %q", where, tag)
+		page.Index = filterByTag(index, tag)
+		page.ScopeTags = []string{tag}
+		query = "tag=" + url.QueryEscape(tag)
+	default:
+		for _, rec := range index {
+			page.HasTags = page.HasTags || len(rec.Tags) != 0
+			page.HasOrphans = page.HasOrphans || rec.Orphan || rec.DeadEnd
+		}
+		if h.edit {
+			page.NewPageURL = path.Join(editPath, prefix) + "/"
+		}
+	}
+	by, desc := h.sortBy, h.sortDesc
+	if s := q.Get("sort"); validSort(s) {
+		by, desc = s, false
+	}
+	switch q.Get("order") {
+	case "asc":
+		desc = false
+	case "desc":
+		desc = true
+	}
+	sortIndex(page.Index, by, desc)
+	if len(page.Index) > 1 {
+		page.SortLinks = sortLinks(query, by, desc)
+	}
+	if h.pageSize > 0 {
+		order := "asc"
+		if desc {
+			order = "desc"
 		}
-		log.Printf("read %q: %v", name, err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		n, _ := strconv.Atoi(q.Get("page"))
+		page.paginate(n, h.pageSize, query+"&"+url.Values{"sort": {by}, "order": {order}}.Encode())
 	}
-	w.Header().Set("Content-Security-Policy", h.csp(h.hljs))
-	http.ServeContent(w, r, "page.html", mtime, rc)
+	h.renderIndex(w, page)
 }
 
-func (h *mdHandler) renderIndex(w io.Writer, title string, index []indexRecord) error {
-	page := struct {
-		Title      string
-		StyleHref  string
-		Style      template.CSS
-		Index      []indexRecord
-		WithSearch bool
-	}{
-		Title:      title,
-		Index:      index,
-		WithSearch: h.withSearch,
+// renderIndex renders index page, filling its style and search form related
+// fields.
+func (h *mdHandler) renderIndex(w io.Writer, page indexPage) error {
+	page.WithSearch = h.withSearch
+	if page.Mode == "" {
+		page.Mode, _ = h.searchMode("", "")
+	}
+	if h.feedSize > 0 && !h.exporting {
+		page.FeedHref = feedPath
+	}
+	if h.withSearch && !h.exporting {
+		page.SearchHref = openSearchPath
 	}
+	page.QuickOpen = h.quickOpen && !h.exporting
+	// tag pages are served dynamically
+	page.WithTags = !h.exporting
+	page.HasTags = page.HasTags && page.WithTags
+	for i := range page.Index {
+		if rec := &page.Index[i]; h.dateFormat != "" && !rec.ModTime.IsZero() {
+			rec.Updated = rec.ModTime.Format(h.dateFormat)
+		}
+	}
+	page.Wide = page.view.wide
+	style := h.viewStyle(page.view)
 	switch {
 	case h.linkStyle:
-		page.StyleHref = h.style
+		page.StyleHref = style
 	default:
-		page.Style = template.CSS(h.style)
+		page.Style = template.CSS(style)
+	}
+	if h.indexTpl != nil {
+		return h.indexTpl.Execute(w, page)
 	}
 	return indexTemplate.Execute(w, page)
 }
 
-func (h *mdHandler) csp(withHL bool) string {
-	csp := []string{"default-src 'self';img-src http: https: data:;media-src https:"}
+// styles returns stylesheet (or its href if run with -csslink) and its hash
+// for CSP.
+func (h *mdHandler) styles() (style, hash string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.style, h.styleHash
+}
+
+// loadStyle reads custom stylesheet from h.cssFile and updates style and its
+// hash.
+func (h *mdHandler) loadStyle() error {
+	b, err := ioutil.ReadFile(h.cssFile)
+	if err != nil {
+		return err
+	}
+	style := string(b) + h.extraStyle
+	hash := styleHash(style)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.style, h.styleHash = style, hash
+	return nil
+}
+
+// reloadOnSignal reloads custom stylesheet each time process receives SIGHUP.
+// On errors it logs them and keeps using previously loaded values.
+func (h *mdHandler) reloadOnSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		if err := h.loadStyle(); err != nil {
+			log.Printf("stylesheet reload: %v", err)
+			continue
+		}
+		h.mu.Lock()
+		h.styleTime = time.Now()
+		h.mu.Unlock()
+		log.Printf("stylesheet reloaded from %q", h.cssFile)
+	}
+}
+
+func styleHash(style string) string {
+	sum := sha256.Sum256([]byte(style))
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (h *mdHandler) csp(withHL, inlineStyles bool, extraScripts ...string) string {
+	if h.cspValue != "" {
+		return h.cspValue
+	}
+	_, styleHash := h.styles()
+	// mermaid.js and KaTeX style rendered elements with inline styles, so
+	// pages with diagrams or formulas allow them; 'unsafe-inline' has no
+	// effect along with hashes, so it replaces them
+	scripts := append([]string(nil), extraScripts...)
+	var styles []string
 	switch {
-	case withHL:
-		csp = append(csp, "script-src https://cdnjs.cloudflare.com "+
-			"'sha256-HGKuhVF4dzwg9Kt9XWXRYCoBYgGWsgnBiY1ynyCokzQ=' "+
+	case h.linkStyle:
+		styles = append(styles, "'self'")
+	case !inlineStyles:
+		styles = append(styles, "'"+styleHash+"'")
+		// stylesheets of themes readers can choose, see readView
+		for _, t := range themes {
+			if s, ok := h.themes[t]; ok && s.hash != styleHash {
+				styles = append(styles, "'"+s.hash+"'")
+			}
+		}
+	}
+	if inlineStyles {
+		styles = append(styles, "'unsafe-inline'")
+	}
+	if withHL {
+		scripts = append(scripts, "https://cdnjs.cloudflare.com",
 			"'sha256-qeFup2+SGOg8HaUXLE/qospaz+lv/lxjtZZVNa2AqTk='", // https://play.golang.org/p/0SUWatm_LGr
 		)
-		switch {
-		case h.linkStyle:
-			csp = append(csp, "style-src 'self' https://cdnjs.cloudflare.com")
-		default:
-			csp = append(csp, "style-src https://cdnjs.cloudflare.com '"+h.styleHash+"'")
-		}
-	default:
-		csp = append(csp, "script-src 'sha256-HGKuhVF4dzwg9Kt9XWXRYCoBYgGWsgnBiY1ynyCokzQ='")
-		switch {
-		case h.linkStyle:
-			csp = append(csp, "style-src 'self'")
-		default:
-			csp = append(csp, "style-src '"+h.styleHash+"'")
+		styles = append(styles, "https://cdnjs.cloudflare.com")
+	}
+	if h.watch != nil {
+		scripts = append(scripts, "'"+watchScriptHash+"'")
+	}
+	if h.edit {
+		scripts = append(scripts, "'"+taskScriptHash+"'")
+	}
+	if !h.noAnchors {
+		scripts = append(scripts, "'"+anchorScriptHash+"'")
+	}
+	if h.quickOpen {
+		scripts = append(scripts, "'"+quickOpenScriptHash+"'")
+	}
+	if h.withSearch {
+		scripts = append(scripts, "'"+highlightScriptHash+"'")
+	}
+	if h.mermaidSrc != "" {
+		scripts = append(scripts, h.mermaidCSP, "'"+mermaidScriptHash+"'")
+	}
+	if h.mathDir != "" {
+		scripts = append(scripts, "'self'", "'"+mathScriptHash+"'")
+		styles = append(styles, "'self'")
+	}
+	scriptSrc := "'none'"
+	if len(scripts) != 0 {
+		scriptSrc = strings.Join(scripts, " ")
+	}
+	var extra string
+	if h.sanitize == sanitizeRelaxed || h.sanitize == sanitizeOff {
+		// embedded videos and style attributes of documents
+		extra = ";frame-src https:;style-src-attr 'unsafe-inline'"
+	}
+	return "default-src 'self';img-src http: https: data:;media-src https:" +
+		";script-src " + scriptSrc +
+		";style-src " + strings.Join(styles, " ") + extra
+}
+
+// renderOptions returns markdown rendering options set by flags
+func (h *mdHandler) renderOptions() render.Options {
+	return render.Options{GithubWiki: h.githubWiki, HTMLLinks: h.exporting, Math: h.mathDir != "", Emoji: !h.noEmoji,
+		Extensions: h.extensions, NoSmartypants: h.noSmartypants, Mentions: h.mentionURL,
+		Policy: h.policy, EscapeHTML: h.sanitize == sanitizeStrict, NoSanitize: h.sanitize == sanitizeOff}
+}
+
+// renderBody renders markdown document b of file name into html, and returns
+// it along with document front matter, having title and description filled
+// from document itself if front matter has none. Hooks are called after
+// the ones set by flags.
+func (h *mdHandler) renderBody(name string, b []byte, hooks ...html.RenderNodeFunc) ([]byte, frontMatter, template.HTML) {
+	return h.renderBodyTOC(name, b, h.toc, hooks...)
+}
+
+// renderBodyTOC is like renderBody, but places table of contents as set by
+// toc instead of -toc flag
+func (h *mdHandler) renderBodyTOC(name string, b []byte, toc string, hooks ...html.RenderNodeFunc) ([]byte, frontMatter, template.HTML) {
+	opts := h.renderOptions()
+	opts.WikiLinks = h.wikiLinkResolver(name)
+	opts.HeadingAnchors = !h.noAnchors
+	opts.TaskIndexes = h.edit && !h.exporting
+	if h.inlineImg {
+		opts.Hooks = append(opts.Hooks, h.inlineImagesHook(name))
+	}
+	if h.imageWidth > 0 && !h.exporting {
+		opts.Hooks = append(opts.Hooks, h.resizedImagesHook())
+	}
+	opts.Hooks = append(opts.Hooks, hooks...)
+	var placed bool // table of contents replaced placeholder
+	if toc != tocOff {
+		opts.TOC = func(headings []render.Heading) []byte {
+			placed = true
+			return []byte(h.tableOfContents(headings))
 		}
 	}
-	return strings.Join(csp, ";")
+	fm, src := splitFrontMatter(h.substituteVars(b))
+	doc := render.Parse(src, opts)
+	h.includeDocuments(doc, name, opts, nil)
+	if fm.Title == "" {
+		fm.Title = render.Title(doc)
+	}
+	if fm.Title == "" {
+		fm.Title = nameToTitle(path.Base(name))
+	}
+	if fm.Description == "" {
+		fm.Description = truncateText(firstParagraphText(doc), 160)
+	}
+	body := render.Document(doc, opts)
+	var contents template.HTML
+	if !placed && toc != tocOff {
+		contents = h.tableOfContents(render.Headings(doc))
+	}
+	return body, fm, contents
 }
 
 // readerForFile returns lazy io.ReadSeeker and mtime to be used as arguments of
@@ -230,68 +1997,327 @@ func (h *mdHandler) csp(withHL bool) string {
 // has fresh content as signaled by "If-Modified-Since" request header;
 // lazyReadSeeker takes advantage of this by defering any file reading and
 // rendering until one of its method is called.
+//
+// If file is larger than h.maxSize, errTooLarge is returned.
 func (h *mdHandler) readerForFile(name string) (*lazyReadSeeker, time.Time, error) {
-	fi, err := os.Stat(name)
+	fi, err := fs.Stat(h.files(), name)
 	if err != nil {
 		return nil, time.Time{}, err
 	}
-	return &lazyReadSeeker{name: name, h: h}, fi.ModTime(), nil
+	if h.maxSize > 0 && fi.Size() > h.maxSize {
+		return nil, time.Time{}, errTooLarge
+	}
+	mtime := fi.ModTime()
+	h.mu.RLock()
+	styleTime := h.styleTime
+	h.mu.RUnlock()
+	// page embeds stylesheet, so it's modified when stylesheet is reloaded
+	if styleTime.After(mtime) {
+		mtime = styleTime
+	}
+	return &lazyReadSeeker{name: name, h: h, mtime: fi.ModTime(), size: fi.Size(), styleTime: styleTime}, mtime, nil
+}
+
+// etagSource holds everything rendered page depends on, see
+// lazyReadSeeker.etag. Fields are hashed by name, so new ones can be added in
+// any order.
+type etagSource struct {
+	Name          string
+	ModTime       int64 // of source file, in nanoseconds
+	Size          int64 // of source file
+	URLPath       string
+	Deps          string // pageDeps.key
+	Plain, Print  bool
+	Style         string // hash of stylesheet
+	Modified      string // page modification time as shown on page
+	GithubWiki    bool
+	HLJS          bool
+	LinkStyle     bool
+	Watch         bool
+	Mermaid       string
+	Math          bool
+	PDF           bool
+	NoEmoji       bool
+	NoAnchors     bool
+	Edit          bool
+	Templates     string
+	TOC           string
+	TOCDepth      int
+	Extensions    parser.Extensions
+	NoSmartypants bool
+	Mentions      string
+	ImageWidth    int
+	Converter     markupConverter
+	Search        bool
+	QuickOpen     bool
+	Vars          string
+	Sanitize      string
+	View          viewPrefs
+}
+
+// etag returns weak ETag of rendered page, computed from source file
+// modification time and size and options affecting rendering, without
+// reading the file. It's weak because file can be changed without changing
+// its size within resolution of its modification time. It returns an empty
+// string if page embeds images, as they may change without source file
+// changing.
+func (l *lazyReadSeeker) etag() string {
+	if l.h.inlineImg {
+		return ""
+	}
+	l.h.mu.RLock()
+	styleHash := l.h.styleHash
+	l.h.mu.RUnlock()
+	h := l.h
+	src := etagSource{
+		Name:          l.name,
+		ModTime:       l.mtime.UnixNano(),
+		Size:          l.size,
+		URLPath:       l.urlPath,
+		Deps:          l.dependencies().key,
+		Plain:         l.plain,
+		Print:         l.print,
+		Style:         styleHash,
+		Modified:      l.mtime.Format(h.dateFormat),
+		GithubWiki:    h.githubWiki,
+		HLJS:          h.hljs,
+		LinkStyle:     h.linkStyle,
+		Watch:         h.watch != nil,
+		Mermaid:       h.mermaidSrc,
+		Math:          h.mathDir != "",
+		PDF:           h.pdf != nil,
+		NoEmoji:       h.noEmoji,
+		NoAnchors:     h.noAnchors,
+		Edit:          h.edit,
+		Templates:     h.templateHash,
+		TOC:           h.toc,
+		TOCDepth:      h.tocDepth,
+		Extensions:    h.extensions,
+		NoSmartypants: h.noSmartypants,
+		Mentions:      h.mentions,
+		ImageWidth:    h.imageWidth,
+		Converter:     h.converter(l.name),
+		Search:        h.withSearch,
+		QuickOpen:     h.quickOpen,
+		Vars:          h.varsKey,
+		Sanitize:      h.sanitize,
+		View:          l.view,
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%+v", src)))
+	return `W/"` + base64.RawURLEncoding.EncodeToString(sum[:18]) + `"`
 }
 
 type lazyReadSeeker struct {
-	name string
-	h    *mdHandler
-	r    *bytes.Reader // initially nil, initialized with init()
+	name    string
+	h       *mdHandler
+	mtime   time.Time
+	size    int64
+	plain   bool          // render file as preformatted text instead of markdown
+	kind    plainKind     // how file is rendered if plain is set
+	print   bool          // render printable page, see pageTpl
+	view    viewPrefs     // reader's presentation preferences
+	urlPath string        // cleaned request path, used to build breadcrumbs
+	r       *bytes.Reader // initially nil, initialized with init()
+
+	styleTime time.Time // when stylesheet was reloaded, as of readerForFile call
+
+	inlineStyles bool // set by init() if page has diagrams or formulas
+
+	deps *pageDeps // initialized with dependencies()
+}
+
+// pageDeps describes other files markdown page is built with
+type pageDeps struct {
+	sidebar, footer string // wiki parts, see mdHandler.wikiPart
+	backlinks       []pageLink
+	commit          *gitCommit // the last commit changing page
+	key             string     // identifies all of the above in their current state
+}
+
+// dependencies finds other files page is built with
+func (l *lazyReadSeeker) dependencies() *pageDeps {
+	if l.deps != nil {
+		return l.deps
+	}
+	l.deps = new(pageDeps)
+	if l.plain {
+		return l.deps
+	}
+	d := l.deps
+	var b strings.Builder
+	for _, part := range []struct {
+		name string
+		dst  *string
+	}{{sidebarFile, &d.sidebar}, {footerFile, &d.footer}} {
+		if p, st := l.h.wikiPart(l.name, part.name); p != "" {
+			*part.dst = p
+			fmt.Fprintf(&b, "%s\x00%d\x00%d", p, st.ModTime().UnixNano(), st.Size())
+		}
+		b.WriteByte(0)
+	}
+	for _, p := range l.h.cachedIncludedFiles(l.name, l.mtime, l.size) {
+		if st, err := fs.Stat(l.h.files(), p); err == nil {
+			fmt.Fprintf(&b, "%s\x00%d\x00%d\x00", p, st.ModTime().UnixNano(), st.Size())
+		}
+	}
+	if l.h.backlinks && l.h.links != nil {
+		d.backlinks = l.h.links.backlinks(context.Background(), l.name)
+		for _, link := range d.backlinks {
+			b.WriteString(link.Href + "\x00" + link.Title + "\x00")
+		}
+	}
+	// wiki links and neighbor documents change as files are added or removed
+	_, gen := l.h.wikiFiles.get(context.Background(), l.h)
+	fmt.Fprintf(&b, "%d\x00", gen)
+	if l.h.git != nil {
+		if c, ok := l.h.git.lastCommit(context.Background(), l.name); ok {
+			d.commit = &c
+			b.WriteString(c.Hash)
+		}
+	}
+	d.key = b.String()
+	return d
 }
 
 func (l *lazyReadSeeker) init() error {
 	if l.r != nil {
 		return nil
 	}
+	key := cacheKey{
+		name:      l.name,
+		urlPath:   l.urlPath,
+		plain:     l.plain,
+		kind:      l.kind,
+		print:     l.print,
+		view:      l.view,
+		deps:      l.dependencies().key,
+		mtime:     l.mtime.UnixNano(),
+		size:      l.size,
+		styleTime: l.styleTime.UnixNano(),
+	}
+	if l.h.cache != nil {
+		if page, ok := l.h.cache.get(key); ok {
+			l.r = bytes.NewReader(page)
+			l.inlineStyles = l.h.needsInlineStyles(page)
+			return nil
+		}
+	}
 	if testRun {
 		log.Print("lazyReadSeeker init()")
 	}
-	b, err := ioutil.ReadFile(l.name)
+	b, err := fs.ReadFile(l.h.files(), l.name)
 	if err != nil {
 		return err
 	}
-	opts := rendererOpts
-	if l.h.githubWiki {
-		opts.RenderNodeHook = rewriteGithubWikiLinks
-	}
-	doc := parser.NewWithExtensions(extensions).Parse(b)
-	body := markdown.Render(doc, html.NewRenderer(opts))
-	body = policy.SanitizeBytes(body)
-	title := firstHeaderText(doc)
-	if title == "" {
-		title = nameToTitle(filepath.Base(l.name))
+	var body []byte
+	var title, description string
+	var sidebar, footer, toc template.HTML
+	var prev, next *pageLink
+	switch {
+	case l.plain && l.kind == plainTable:
+		body, title = renderTable(l.name, b), path.Base(l.name)
+	case l.plain && l.kind == plainConverted:
+		if body, title, err = l.h.renderConverted(context.Background(), l.name, b); err != nil {
+			return err
+		}
+		l.h.setConvertedTitle(l.name, l.mtime, l.size, title)
+	case l.plain:
+		buf := new(bytes.Buffer)
+		buf.WriteString("<pre>")
+		template.HTMLEscape(buf, b)
+		buf.WriteString("</pre>")
+		body, title = buf.Bytes(), path.Base(l.name)
+	default:
+		deps := l.dependencies()
+		sidebar = l.h.renderWikiPart(deps.sidebar, l.h.renderOptions())
+		footer = l.h.renderWikiPart(deps.footer, l.h.renderOptions())
+		prev, next = l.h.neighbors(l.name)
+		var meta frontMatter
+		tocPlace := l.h.toc
+		if l.view.noTOC {
+			tocPlace = tocOff
+		}
+		body, meta, toc = l.h.renderBodyTOC(l.name, b, tocPlace)
+		title, description = meta.Title, meta.Description
 	}
 	withHL := l.h.hljs && bytes.Contains(body, []byte(`<pre><code class=`))
-	page := struct {
-		Title     string
-		StyleHref string
-		Style     template.CSS
-		Body      template.HTML
-		WithHL    bool
-	}{
-		Title:  title,
-		Body:   template.HTML(body),
-		WithHL: withHL,
+	page := pageData{
+		Title:       title,
+		Description: description,
+		Body:        template.HTML(body),
+		TOC:         toc,
+		SidebarTOC:  l.h.toc == tocSidebar,
+		WithHL:      withHL,
+		WithWatch:   l.h.watch != nil,
+		Print:       l.print,
+		Wide:        l.view.wide,
+		Prev:        prev,
+		Next:        next,
+		Backlinks:   l.deps.backlinks,
+		Sidebar:     sidebar,
+		Footer:      footer,
+		ViewLinks:   !l.plain && !l.h.exporting,
+		WithPDF:     l.h.pdf != nil && !l.h.exporting,
+		IndexHref:   "/?index",
+		ModTime:     l.mtime,
+		Crumbs:      l.h.breadcrumbs(l.urlPath),
+	}
+	if l.h.exporting {
+		page.IndexHref = "/"
+	}
+	if l.h.withSearch && !l.h.exporting {
+		page.SearchHref = openSearchPath
+	}
+	if l.h.mermaidSrc != "" && bytes.Contains(body, []byte(mermaidMarker)) {
+		page.MermaidSrc = l.h.mermaidSrc
 	}
+	page.WithMath = l.h.mathDir != "" && bytes.Contains(body, []byte(mathMarker))
+	if c := l.deps.commit; c != nil {
+		page.Commit = l.h.commitInfo(*c)
+		if !l.h.exporting {
+			page.HistoryHref = historyPath + l.name
+		}
+	}
+	if l.h.edit && !l.plain && !l.h.exporting {
+		page.EditHref = editPath + l.name
+	}
+	page.WithTasks = l.h.edit && !l.print && bytes.Contains(body, []byte(taskMarker))
+	page.WithAnchors = !l.h.noAnchors && !l.print && bytes.Contains(body, []byte(anchorMarker))
+	page.QuickOpen = l.h.quickOpen && !l.print && !l.h.exporting
+	page.WithHighlight = l.h.withSearch && !l.plain && !l.print && !l.h.exporting
+	if l.h.dateFormat != "" && !l.mtime.IsZero() {
+		page.Modified = l.mtime.Format(l.h.dateFormat)
+	}
+	style := l.h.viewStyle(l.view)
 	switch {
 	case l.h.linkStyle:
-		page.StyleHref = l.h.style
+		page.StyleHref = style
 	default:
-		page.Style = template.CSS(l.h.style)
+		page.Style = template.CSS(style)
 	}
 	buf := bytes.NewBuffer(b[:0]) // reuse b to reduce allocations
-	if err := pageTemplate.Execute(buf, page); err != nil {
+	tpl := pageTemplate
+	if l.h.pageTpl != nil {
+		tpl = l.h.pageTpl
+	}
+	if err := tpl.Execute(buf, page); err != nil {
 		return err
 	}
+	if l.h.cache != nil {
+		l.h.cache.add(key, buf.Bytes())
+	}
 	l.r = bytes.NewReader(buf.Bytes())
+	l.inlineStyles = page.MermaidSrc != "" || page.WithMath
 	return nil
 }
 
+// needsInlineStyles reports whether rendered page has mermaid diagrams or
+// formulas, which are styled with inline styles
+func (h *mdHandler) needsInlineStyles(page []byte) bool {
+	return h.mermaidSrc != "" && bytes.Contains(page, []byte(mermaidMarker)) ||
+		h.mathDir != "" && bytes.Contains(page, []byte(mathMarker))
+}
+
 func (l *lazyReadSeeker) Read(p []byte) (n int, err error) {
 	if l.r == nil {
 		if err := l.init(); err != nil {
@@ -310,46 +2336,148 @@ func (l *lazyReadSeeker) Seek(offset int64, whence int) (int64, error) {
 	return l.r.Seek(offset, whence)
 }
 
-func dirIndex(dir string, pat *search.Pattern) []indexRecord {
-	var matches []string
-	fn := func(p string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// breadcrumb is a single element of page navigation trail
+type breadcrumb struct {
+	Name string
+	Href string // empty for the current page
+}
+
+// breadcrumbs returns navigation trail for a page at cleaned slash separated
+// URL path p: an element for each parent directory below the root, followed
+// by the page itself. Directories link to their index.html if they have one,
+// or to their autogenerated index otherwise.
+func (h *mdHandler) breadcrumbs(p string) []breadcrumb {
+	if p == "" || p == "/" {
+		return nil
+	}
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	out := make([]breadcrumb, 0, len(parts))
+	for i, name := range parts[:len(parts)-1] {
+		dir := "/" + strings.Join(parts[:i+1], "/") + "/"
+		href := (&url.URL{Path: dir}).String()
+		st, err := fs.Stat(h.files(), fsName(dir+"index.html"))
+		if (err != nil || !st.Mode().IsRegular()) && !h.exporting {
+			href += "?index"
+		}
+		out = append(out, breadcrumb{Name: name, Href: href})
+	}
+	name := parts[len(parts)-1]
+	if strings.HasSuffix(name, mdSuffix) {
+		name = nameToTitle(name)
+	}
+	return append(out, breadcrumb{Name: name})
+}
+
+// pageLink is a link to another document
+type pageLink struct{ Title, Href string }
+
+// neighbors returns links to markdown documents preceding and following
+// markdown file name among documents of the same directory, in default index
+// order. Either link is nil if there's no such document. Links are rendered
+// into cached page, so they're only updated along with it, or once markdown
+// files are added or removed.
+func (h *mdHandler) neighbors(name string) (prev, next *pageLink) {
+	fsys := h.files()
+	dir, base := path.Dir(name), path.Base(name)
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, nil
+	}
+	var index []indexRecord
+	for _, d := range entries {
+		p := path.Join(dir, d.Name())
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") || !strings.HasSuffix(d.Name(), mdSuffix) ||
+			h.excluded(p) {
+			continue
 		}
-		if info.IsDir() && p != "." && strings.HasPrefix(filepath.Base(p), ".") {
-			return filepath.SkipDir
+		rec := indexRecord{File: d.Name(), sortKey: strings.ToLower(strings.TrimSuffix(d.Name(), mdSuffix))}
+		if fi, err := d.Info(); err == nil {
+			rec.ModTime = fi.ModTime()
 		}
-		if info.IsDir() || !strings.HasSuffix(p, mdSuffix) {
-			return nil
+		if h.sortBy == sortByTitle {
+			rec.Title = documentMeta(fsys, p).Title
 		}
-		matches = append(matches, p)
-		return nil
+		index = append(index, rec)
 	}
-	if err := filepath.Walk(dir, fn); err != nil {
-		log.Printf("walk %q: %v", dir, err)
+	sortIndex(index, h.sortBy, h.sortDesc)
+	link := func(rec indexRecord) *pageLink {
+		title := rec.Title
+		if title == "" {
+			title = documentMeta(fsys, path.Join(dir, rec.File)).Title
+		}
+		if title == "" {
+			title = nameToTitle(rec.File)
+		}
+		file := rec.File
+		if h.exporting {
+			file = strings.TrimSuffix(file, mdSuffix) + ".html"
+		}
+		return &pageLink{Title: title, Href: (&url.URL{Path: file}).String()}
+	}
+	for i, rec := range index {
+		if rec.File != base {
+			continue
+		}
+		if i > 0 {
+			prev = link(index[i-1])
+		}
+		if i < len(index)-1 {
+			next = link(index[i+1])
+		}
+		break
 	}
+	return prev, next
+}
+
+// dirIndex walks dir of fsys and returns sorted index of markdown files found,
+// with paths relative to dir. If m is not nil, only files having lines
+// matching it are returned. If exclude is not nil, it is called with path of
+// each file relative to fsys root, and files for which it returns true are
+// skipped.
+//
+// If ctx is canceled, dirIndex returns index built so far along with
+// ctx.Err().
+func dirIndex(ctx context.Context, fsys fs.FS, dir string, m lineMatcher, exclude func(string) bool) ([]indexRecord, error) {
+	matches, _ := markdownFiles(ctx, fsys, dir, exclude)
 	var index []indexRecord
-	if pat == nil {
+	if m == nil {
 		index = make([]indexRecord, 0, len(matches))
 	}
 	for _, s := range matches {
-		if pat != nil && !matchPattern(pat, s) {
-			continue
+		if ctx.Err() != nil {
+			break
+		}
+		var match textMatch
+		if m != nil {
+			if match = matchFile(m, fsys, s); match.count == 0 {
+				continue
+			}
 		}
-		title := documentTitle(s)
+		meta := documentMeta(fsys, s)
+		title := meta.Title
 		if title == "" {
-			title = nameToTitle(filepath.Base(s))
+			title = nameToTitle(path.Base(s))
 		}
-		file, err := filepath.Rel(dir, s)
-		if err != nil {
-			continue
+		var mtime time.Time
+		if st, err := fs.Stat(fsys, s); err == nil {
+			mtime = st.ModTime()
+		}
+		file := s
+		if dir != "." {
+			file = strings.TrimPrefix(s, dir+"/")
 		}
 		index = append(index, indexRecord{
-			Title:  title,
-			File:   filepath.ToSlash(file),
-			Subdir: filepath.ToSlash(filepath.Dir(file)),
+			Title:   title,
+			File:    file,
+			Subdir:  path.Dir(file),
+			Count:   match.count,
+			Snippet: match.snippet,
+			Anchor:  match.anchor,
+			Tags:    meta.Tags,
+			Date:    meta.Date,
+			ModTime: mtime,
 			// precalculate sort key to speed up comparisons on sort
-			sortKey: strings.ToLower(strings.TrimSuffix(filepath.Base(file), mdSuffix)),
+			sortKey: strings.ToLower(strings.TrimSuffix(path.Base(file), mdSuffix)),
 		})
 	}
 	sort.Slice(index, func(i, j int) bool {
@@ -359,111 +2487,192 @@ func dirIndex(dir string, pat *search.Pattern) []indexRecord {
 		}
 		return si < sj
 	})
-	return index
+	return index, ctx.Err()
+}
+
+// markdownFiles walks dir of fsys and returns paths of markdown files found,
+// relative to fsys root, skipping hidden directories. If exclude is not nil,
+// it is called with path of each file, and files for which it returns true
+// are skipped. If ctx is canceled, markdownFiles returns files found so far
+// along with ctx.Err().
+func markdownFiles(ctx context.Context, fsys fs.FS, dir string, exclude func(string) bool) ([]string, error) {
+	var matches []string
+	fn := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() && p != "." && strings.HasPrefix(d.Name(), ".") {
+			return fs.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(p, mdSuffix) {
+			return nil
+		}
+		if exclude != nil && exclude(p) {
+			return nil
+		}
+		matches = append(matches, p)
+		return nil
+	}
+	if err := fs.WalkDir(fsys, dir, fn); err != nil && err != ctx.Err() {
+		log.Printf("walk %q: %v", dir, err)
+	}
+	return matches, ctx.Err()
 }
 
 type indexRecord struct {
 	Title, File string
-	Subdir      string // groups index records when rendering template
-	sortKey     string // if File is "dir/FileName.md", then sortKey is "filename"
+	Subdir      string        // groups index records when rendering template
+	sortKey     string        // if File is "dir/FileName.md", then sortKey is "filename"
+	Count       int           // number of lines matching search query
+	Snippet     template.HTML // search result excerpt with highlighted matches
+	Anchor      string        // id of heading preceding the first match
+	score       float64       // search result relevance
+	Tags        []string      // from document front matter
+	Date        time.Time     // from document front matter
+	ModTime     time.Time     // file modification time
+	Updated     string        // formatted ModTime, shown in index
+	Commit      string        // author and date of the last commit changing file
+	Orphan      bool          // no other document links to this one, see markOrphans
+	DeadEnd     bool          // document doesn't link to other documents
 }
 
-// documentTitle extracts h1 header from markdown document
-func documentTitle(file string) string {
-	f, err := os.Open(file)
+// documentMeta returns front matter of markdown document, with title
+// extracted from document with render.Title if front matter has none
+func documentMeta(fsys fs.FS, file string) frontMatter {
+	f, err := fsys.Open(file)
 	if err != nil {
-		return ""
+		return frontMatter{}
 	}
 	defer f.Close()
 	b, err := ioutil.ReadAll(io.LimitReader(f, 1<<17))
 	if err != nil {
-		return ""
+		return frontMatter{}
 	}
-	return firstHeaderText(parser.New().Parse(b))
+	fm, b := splitFrontMatter(b)
+	if fm.Title == "" {
+		fm.Title = render.Title(parser.New().Parse(b))
+	}
+	return fm
 }
 
-func firstHeaderText(doc ast.Node) string {
-	var title string
+// firstParagraphText returns text of the first paragraph of document, outside
+// of block quotes and lists, with whitespace collapsed.
+func firstParagraphText(doc ast.Node) string {
+	var text string
 	walkFn := func(node ast.Node, entering bool) ast.WalkStatus {
 		if !entering {
 			return ast.GoToNext
 		}
 		switch n := node.(type) {
-		case *ast.Heading:
-			if n.Level != 1 {
-				return ast.GoToNext
+		case *ast.Paragraph:
+			text = strings.Join(strings.Fields(nodeText(n)), " ")
+			if text == "" {
+				return ast.SkipChildren
 			}
-			title = string(childLiterals(n))
 			return ast.Terminate
-		case *ast.Code, *ast.CodeBlock, *ast.BlockQuote:
+		case *ast.Heading, *ast.BlockQuote, *ast.List, *ast.Table, *ast.Aside:
 			return ast.SkipChildren
 		}
 		return ast.GoToNext
 	}
 	_ = ast.Walk(doc, ast.NodeVisitorFunc(walkFn))
-	return title
+	return text
+}
+
+// nodeText returns text of node and its children, with line breaks replaced
+// by spaces.
+func nodeText(node ast.Node) string {
+	var b strings.Builder
+	walkFn := func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch n := node.(type) {
+		case *ast.Softbreak, *ast.Hardbreak:
+			b.WriteByte(' ')
+		case *ast.HTMLSpan:
+		default:
+			if l := n.AsLeaf(); l != nil {
+				b.Write(l.Literal)
+			}
+		}
+		return ast.GoToNext
+	}
+	_ = ast.Walk(node, ast.NodeVisitorFunc(walkFn))
+	return b.String()
 }
 
-func childLiterals(node ast.Node) []byte {
-	if l := node.AsLeaf(); l != nil {
-		return l.Literal
+// truncateText truncates s to at most max runes on a word boundary, adding
+// ellipsis if text was truncated.
+func truncateText(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
 	}
-	var out [][]byte
-	for _, n := range node.GetChildren() {
-		if lit := childLiterals(n); lit != nil {
-			out = append(out, lit)
+	var cut, n int
+	for i, r := range s {
+		if n == max {
+			break
+		}
+		if unicode.IsSpace(r) {
+			cut = i
 		}
+		n++
 	}
-	if out == nil {
-		return nil
+	if cut == 0 {
+		return string([]rune(s)[:max-1]) + "…"
 	}
-	return bytes.Join(out, nil)
+	return strings.TrimRightFunc(s[:cut], unicode.IsPunct) + "…"
 }
 
-// matchPattern reports whether any line in file matches given pattern. On any
-// errors function return false.
-func matchPattern(pat *search.Pattern, file string) bool {
-	f, err := os.Open(file)
-	if err != nil {
-		return false
-	}
-	defer f.Close()
-	sc := bufio.NewScanner(io.LimitReader(f, 1<<20))
-	for sc.Scan() {
-		if _, end := pat.Index(sc.Bytes()); end > 0 {
-			return true
+// lineMatcher returns start and end offsets of the first match in line, or
+// -1, -1 if line does not match.
+type lineMatcher func(line []byte) (start, end int)
+
+// looseMatcher returns lineMatcher doing case and accent insensitive search of
+// q, using collation rules of given language.
+func looseMatcher(lang language.Tag, q string) lineMatcher {
+	pat := search.New(lang, search.Loose).CompileString(q)
+	return func(line []byte) (int, int) { return pat.Index(line) }
+}
+
+// exactMatcher returns lineMatcher doing case-sensitive search of q as an
+// exact substring.
+func exactMatcher(q string) lineMatcher {
+	sub := []byte(q)
+	return func(line []byte) (int, int) {
+		i := bytes.Index(line, sub)
+		if i < 0 {
+			return -1, -1
 		}
+		return i, i + len(sub)
 	}
-	return false
 }
 
-// rewriteGithubWikiLinks is a html.RenderNodeFunc which renders links
-// with github wiki destinations as local ones.
-//
-// Link with "https://github.com/user/project/wiki/Page" destination would be
-// rendered as a link to "Page.md"
-func rewriteGithubWikiLinks(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
-	link, ok := node.(*ast.Link)
-	if !ok || !entering {
-		return ast.GoToNext, false
+// matchFile searches first maxIndexedSize bytes of file for lines matching
+// m. On any errors function returns zero textMatch.
+func matchFile(m lineMatcher, fsys fs.FS, file string) textMatch {
+	f, err := fsys.Open(file)
+	if err != nil {
+		return textMatch{}
 	}
-	if u, err := url.Parse(string(link.Destination)); err == nil &&
-		u.Host == "github.com" && strings.HasSuffix(path.Dir(u.Path), "/wiki") {
-		dst := path.Base(u.Path) + mdSuffix
-		switch u.Fragment {
-		case "":
-			fmt.Fprintf(w, "<a href=\"%s\">", url.QueryEscape(dst))
-		default:
-			fmt.Fprintf(w, "<a href=\"%s#%s\">", url.QueryEscape(dst), url.QueryEscape(u.Fragment))
-		}
-		return ast.GoToNext, true
+	defer f.Close()
+	text, err := ioutil.ReadAll(io.LimitReader(f, maxIndexedSize))
+	if err != nil {
+		return textMatch{}
 	}
-	return ast.GoToNext, false
+	return matchText(text, []lineMatcher{m})
 }
 
+// maxMatchesPerFile limits how many matching lines are counted in a single
+// file
+const maxMatchesPerFile = 1000
+
 // reportIfMissing tests whether file exists and logs if not
-func reportIfMissing(name string) {
-	if st, err := os.Stat(name); os.IsNotExist(err) || (st != nil && !st.Mode().IsRegular()) {
+func reportIfMissing(fsys fs.FS, name string) {
+	if st, err := fs.Stat(fsys, name); os.IsNotExist(err) || (st != nil && !st.Mode().IsRegular()) {
 		log.Printf("called with -csslink, but path %q does not exist or not a regular file", name)
 	}
 }
@@ -479,46 +2688,80 @@ var repl = strings.NewReplacer("-", " ")
 
 const mdSuffix = ".md"
 
+const faviconPath = "/favicon.ico"
+
+// healthPath is a path of health check endpoint
+const healthPath = "/.healthz"
+
+// startTime is used as modification time of built-in resources
+var startTime = time.Now()
+
+// exactPrefix is a search query prefix forcing exact substring search
+const exactPrefix = "exact:"
+
 var indexTemplate = template.Must(template.New("index").Parse(indexTpl))
 var pageTemplate = template.Must(template.New("page").Parse(pageTpl))
 
 const indexTpl = `<!doctype html><head><meta charset="utf-8"><title>{{.Title}}</title>
 <meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="/favicon.ico">
 {{if .StyleHref}}<link rel="stylesheet" href="{{.StyleHref}}">{{end -}}
-{{if .Style}}<style>{{.Style}}</style>{{end}}</head><body id="mdserver-autoindex">{{if .WithSearch}}<form method="get">
-<input type="search" name="q" minlength="3" placeholder="Substring search" autofocus required>
+{{if .Style}}<style>{{.Style}}</style>{{end}}{{with .FeedHref}}
+<link rel="alternate" type="application/atom+xml" title="Recently changed documents" href="{{.}}">{{end}}{{with .SearchHref}}
+<link rel="search" type="application/opensearchdescription+xml" title="mdserver" href="{{.}}">{{end}}{{if .WithSearch}}
+<script>` + searchKeyScript + `</script>{{end}}{{if .QuickOpen}}
+<script>` + quickOpenScript + `</script>{{end}}</head><body id="mdserver-autoindex"{{if .Wide}} class="wide"{{end}}>{{if .WithSearch}}<form method="get" action="/">
+<input type="search" name="q" minlength="3" placeholder="Search documents" aria-keyshortcuts="/" autofocus required>
+<select name="mode" aria-label="Search mode">
+<option value="` + searchLoose + `"{{if eq .Mode "` + searchLoose + `"}} selected{{end}}>Loose</option>
+<option value="` + searchExact + `"{{if eq .Mode "` + searchExact + `"}} selected{{end}}>Case-sensitive substring</option>
+<option value="` + searchRegexp + `"{{if eq .Mode "` + searchRegexp + `"}} selected{{end}}>Regular expression</option>
+</select>{{with .ScopeDir}}
+<label><input type="checkbox" name="path" value="{{.}}"{{if $.Scoped}} checked{{end}}> in {{.}}</label>{{end}}{{range .ScopeTags}}
+<label><input type="checkbox" name="tag" value="{{.}}"{{if $.Scoped}} checked{{end}}> tagged {{.}}</label>{{end}}
 <input type="submit"></form>{{end}}
-<h1>{{.Title}}</h1><ul>{{$prev := "."}}
-{{range .Index}}{{if ne .Subdir $prev}}{{$prev = .Subdir}}</ul><h2>{{.Subdir}}</h2><ul>{{end}}<li><a href="{{.File}}">{{.Title}}</a></li>
-{{end}}</ul></body>
+<h1>{{.Title}}</h1>{{with .NewPageURL}}
+<form id="newpage" method="post" action="{{.}}"><input type="text" name="title" placeholder="Page title" required>
+<input type="submit" value="New page"></form>{{end}}{{if .HasTags}}
+<p><a href="?tags">Browse by tag</a></p>{{end}}{{if .HasOrphans}}
+<p><a href="?orphans">Show orphan pages only</a></p>{{end}}{{with .Tags}}
+<ul id="tags">{{range .}}<li><a href="?tag={{.Name}}">{{.Name}}</a> <small>({{.Count}})</small></li>{{end}}</ul>{{end}}{{with .SortLinks}}
+<p id="sort">Sort by {{range $i, $l := .}}{{if $i}} · {{end}}<a href="{{.Href}}"{{if .Current}} class="current"{{end}}>{{.Name}}</a>{{end}}</p>{{end}}{{if .IsSearch}}{{$n := len .Index}}
+<p>{{$n}} {{if eq $n 1}}file matches{{else}}files match{{end}}
+{{- if .Incomplete}}, search took too long and results are incomplete{{end}}</p>{{end}}<ul>{{$prev := "."}}
+{{range .Index}}{{if and (not $.IsSearch) (ne .Subdir $prev)}}{{$prev = .Subdir}}</ul><h2>{{.Subdir}}</h2><ul>{{end}}<li><a href="{{.File}}{{with $.Query}}?` + highlightParam + `={{.}}{{end}}{{if or .Anchor $.Fragment}}#{{.Anchor}}{{$.Fragment}}{{end}}">{{.Title}}</a>
+{{- if $.IsSearch}} <small>{{.File}}</small>{{end}}
+{{- if .Count}} <small>({{.Count}} {{if eq .Count 1}}line{{else}}lines{{end}})</small>{{end}}
+{{- if $.WithTags}}{{range .Tags}} <a class="tag" href="?tag={{.}}">#{{.}}</a>{{end}}{{end}}
+{{- with .Updated}} <small class="updated">{{.}}</small>{{end}}
+{{- with .Commit}} <small class="commit">{{.}}</small>{{end}}
+{{- if .Orphan}} <small class="orphan">orphan</small>{{end}}
+{{- if .DeadEnd}} <small class="deadend">no links</small>{{end}}
+{{- with .Snippet}}<p class="snippet">{{.}}</p>{{end}}</li>
+{{end}}</ul>{{if gt .Pages 1}}
+<nav id="pages">{{if .PrevHref}}<a href="{{.PrevHref}}" rel="prev">&larr; previous</a> {{end -}}
+page {{.Page}} of {{.Pages}}{{if .NextHref}} <a href="{{.NextHref}}" rel="next">next &rarr;</a>{{end}}</nav>{{end}}</body>
 `
 
 const pageTpl = `<!doctype html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<meta property="og:title" content="{{.Title}}">{{with .Description}}
+<meta name="description" content="{{.}}">
+<meta property="og:description" content="{{.}}">{{end}}
 <meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="/favicon.ico">{{with .SearchHref}}
+<link rel="search" type="application/opensearchdescription+xml" title="mdserver" href="{{.}}">{{end}}
 {{if .StyleHref}}<link rel="stylesheet" href="{{.StyleHref}}">{{end -}}
-{{if .Style}}<style>{{.Style}}</style>{{end}}<script>
-document.addEventListener('DOMContentLoaded', function() {
-	htmlTableOfContents();
-} );
-function htmlTableOfContents( documentRef ) {
-	var documentRef = documentRef || document;
-	var headings = [].slice.call(documentRef.body.querySelectorAll('article h1, article h2, article h3, article h4, article h5, article h6'));
-	if (headings.length < 2) { return };
-	var toc = documentRef.querySelector("nav#toc details");
-	var ul = documentRef.createElement( "ul" );
-	headings.forEach(function (heading, index) {
-		var ref = heading.getAttribute( "id" );
-		var link = documentRef.createElement( "a" );
-		link.setAttribute( "href", "#"+ ref );
-		link.textContent = heading.textContent;
-		var li = documentRef.createElement( "li" );
-		li.setAttribute( "class", heading.tagName.toLowerCase() );
-		li.appendChild( link );
-		ul.appendChild( li );
-	});
-	toc.appendChild( ul );
-}
-</script>{{if .WithHL}}
+{{if .Style}}<style>{{.Style}}</style>{{end}}{{if .WithWatch}}
+<script>` + watchScript + `</script>{{end}}{{if .MermaidSrc}}
+<script src="{{.MermaidSrc}}"></script>
+<script>` + mermaidScript + `</script>{{end}}{{if .WithMath}}
+<link rel="stylesheet" href="` + mathPath + `katex.min.css">
+<script src="` + mathPath + `katex.min.js"></script>
+<script>` + mathScript + `</script>{{end}}{{if .WithTasks}}
+<script>` + taskScript + `</script>{{end}}{{if .WithAnchors}}
+<script>` + anchorScript + `</script>{{end}}{{if .WithHighlight}}
+<script>` + highlightScript + `</script>{{end}}{{if .QuickOpen}}
+<script>` + quickOpenScript + `</script>{{end}}{{if .WithHL}}
 <link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/highlight.js/9.15.6/styles/default.min.css" integrity="sha256-zcunqSn1llgADaIPFyzrQ8USIjX2VpuxHzUwYisOwo8=" crossorigin="anonymous" referrerpolicy="no-referrer">
 <script src="https://cdnjs.cloudflare.com/ajax/libs/highlight.js/9.15.6/highlight.min.js" integrity="sha256-aYTdUrn6Ow1DDgh5JTc3aDGnnju48y/1c8s1dgkYPQ8=" crossorigin="anonymous" referrerpolicy="no-referrer"></script>
 <script>
@@ -528,18 +2771,37 @@ document.addEventListener('DOMContentLoaded', (event) => {
 	});
 });
 </script>{{end}}
-</head><body><nav id="site"><a href="/?index">index</a></nav>
-<nav id="toc"><details open><summary>Contents</summary></details></nav>
-<ul id="toc"></ul>
-<article>
+</head><body{{if .Wide}} class="wide"{{end}}>{{if not .Print}}<nav id="site"><a href="{{.IndexHref}}">index</a>
+{{- range .Crumbs}} / {{if .Href}}<a href="{{.Href}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}{{end}}
+{{- if .ViewLinks}} · <a href="?raw">source</a> · <a href="?print">print</a>{{end}}
+{{- if .WithPDF}} · <a href="?pdf">pdf</a>{{end}}
+{{- with .EditHref}} · <a href="{{.}}">edit</a>{{end}}</nav>
+{{if not .SidebarTOC}}{{with .TOC}}{{.}}
+{{end}}{{end}}{{if or .Sidebar (and .SidebarTOC .TOC)}}<aside id="sidebar">
+{{if .SidebarTOC}}{{.TOC}}{{end}}{{.Sidebar}}</aside>
+{{end}}{{end}}<article>
 {{.Body}}
-</article></body>
+</article>{{if not .Print}}{{with .Footer}}
+<footer id="wiki">
+{{.}}</footer>{{end}}{{with .Backlinks}}
+<section id="backlinks"><h2>Linked from</h2><ul>
+{{- range .}}<li><a href="{{.Href}}">{{.Title}}</a></li>{{end}}</ul></section>{{end}}{{end}}{{if and (not .Print) (or .Prev .Next)}}
+<nav id="pager">{{with .Prev}}<a href="{{.Href}}" rel="prev">&larr; {{.Title}}</a>{{end}}
+{{- with .Next}}<a href="{{.Href}}" rel="next">{{.Title}} &rarr;</a>{{end}}</nav>{{end}}{{if .Modified}}
+<footer id="modified">Last modified: <time datetime="{{.ModTime.Format "2006-01-02T15:04:05Z07:00"}}">{{.Modified}}</time></footer>{{end}}{{if and .Commit (not .Print)}}
+<footer id="commit">Last commit: {{.Commit}}{{with .HistoryHref}} · <a href="{{.}}">history</a>{{end}}</footer>{{end}}</body>
 `
 
-const extensions = parser.CommonExtensions | parser.AutoHeadingIDs ^ parser.MathJax
-
-var rendererOpts = html.RendererOptions{Flags: html.CommonFlags}
-var policy = bluemonday.UGCPolicy().AllowAttrs("class").OnElements("code")
+// hasQueryKey reports whether raw url query has given key, with or without
+// value.
+func hasQueryKey(rawQuery, key string) bool {
+	vals, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return false
+	}
+	_, ok := vals[key]
+	return ok
+}
 
 func containsDotDot(v string) bool {
 	if !strings.Contains(v, "..") {
@@ -565,6 +2827,7 @@ const style = `body {
 	background: white;
 	text-rendering: optimizeLegibility;
 }
+body.wide {max-width: none;}
 
 @media only screen and (max-width: 480px) {
 	body {
@@ -646,22 +2909,20 @@ table, td, th {
 	vertical-align:middle;
 }
 td, th {padding:0.2em 0.5em}
+table#listing td.size {text-align:right; white-space:nowrap}
+div.table {overflow-x:auto}
 tr:nth-child(even) {background-color: rgba(200,200,200,0.2)}
 
 nav#toc {margin:1em 0 1em 0}
 nav#toc summary {font-weight:bold; color:gray}
-nav#toc ul:after {
+nav#toc details > ul:after {
 	content:"\2042";
 	text-align:center;
 	display:block;
 	color:gray;
 }
 nav#toc ul {margin:0; list-style:none; padding-left:0}
-nav#toc ul li.h2 {padding-left:1em}
-nav#toc ul li.h3 {padding-left:2em}
-nav#toc ul li.h4 {padding-left:3em}
-nav#toc ul li.h5 {padding-left:4em}
-nav#toc ul li.h6 {padding-left:5em}
+nav#toc ul ul {padding-left:1em}
 
 nav#site {
 	font-size:90%;
@@ -669,18 +2930,200 @@ nav#site {
 	padding:.5em;
 	border-bottom: 1px solid gray;
 }
-nav#site a:before {content:"\2767\0020"}
+nav#site a:first-child:before {content:"\2767\0020"}
+
+ul#tags {padding:0}
+ul#tags li {display:inline-block; margin:0 1em .5em 0}
+a.tag {font-size:80%; color:gray}
+small.updated {float:right; color:gray}
+small.orphan, small.deadend {color:#d73a49}
+p#sort {font-size:90%}
+p#sort a.current {font-weight:bold}
+
+p.snippet {
+	margin:.2em 0 .6em 0;
+	font-size:90%;
+	color:#555;
+}
+
+aside#sidebar {
+	font-size:90%;
+	margin:1em 0;
+	padding:0 .5em;
+	border-left:thin solid lightgrey;
+}
+@media screen and (min-width: 75em) {
+	aside#sidebar {
+		position:absolute;
+		top:3em;
+		left:1em;
+		width:calc((100% - 45em) / 2 - 3em);
+		margin:0;
+	}
+}
+footer#wiki {
+	font-size:90%;
+	margin:1em 0;
+	padding-top:.5em;
+	border-top: 1px solid lightgrey;
+}
+
+section#backlinks {
+	font-size:90%;
+	margin:1em 0;
+}
+section#backlinks h2 {font-size:inherit}
+
+body#mdserver-editor textarea {
+	box-sizing:border-box;
+	width:100%;
+	height:70vh;
+	font-family:monospace;
+}
+
+pre#diff span {display:block}
+pre#diff span.add {background-color:#e6ffec}
+pre#diff span.del {background-color:#ffebe9}
+pre#diff span.hunk {color:grey}
+
+aside.alert {margin:1em 0; padding:0 1em; border-left:.25em solid #0969da}
+aside.alert-tip {border-color:#1a7f37}
+aside.alert-important {border-color:#8250df}
+aside.alert-warning {border-color:#9a6700}
+aside.alert-caution {border-color:#d1242f}
+p.alert-title {font-weight:bold}
+aside.alert-note p.alert-title:before {content:"ℹ️ "}
+aside.alert-tip p.alert-title:before {content:"💡 "}
+aside.alert-important p.alert-title:before {content:"❗ "}
+aside.alert-warning p.alert-title:before {content:"⚠️ "}
+aside.alert-caution p.alert-title:before {content:"🛑 "}
+
+li.task-list-item {list-style-type:none}
+li.task-list-item input {margin:0 .2em .25em -1.6em; vertical-align:middle}
+a.anchor {color:gray; text-decoration:none; font-weight:normal; visibility:hidden}
+:hover > a.anchor, a.anchor:focus {visibility:visible}
+a.anchor.copied:after {content:" link copied"; font-size:small}
+
+div#quickopen {
+	position:fixed;
+	top:10vh;
+	left:50%;
+	transform:translateX(-50%);
+	width:min(40em, 90vw);
+	background:white;
+	border:1px solid lightgrey;
+	box-shadow:0 .5em 2em rgba(0,0,0,.2);
+	z-index:10;
+}
+div#quickopen input {box-sizing:border-box; width:100%; font-size:1.2em; padding:.3em}
+div#quickopen ul {list-style:none; margin:0; padding:0; max-height:60vh; overflow-y:auto}
+div#quickopen li a {display:block; padding:0 .5em; text-decoration:none}
+div#quickopen li.selected {background-color:#eef}
+div#quickopen small {color:grey}
+
+svg#graph {
+	width:100%;
+	height:70vh;
+	border:1px solid lightgrey;
+}
+svg#graph line {stroke:#999}
+svg#graph circle {fill:#0366d6}
+svg#graph a.orphan circle {fill:#d73a49}
+svg#graph text {font-size:12px; fill:currentColor}
+
+nav#pager {
+	display:flex;
+	justify-content:space-between;
+	margin:1em 0;
+}
+nav#pager a[rel=next] {margin-left:auto}
+
+nav#pages {
+	font-size:90%;
+	text-align:center;
+	padding:.5em;
+	border-top: 1px solid gray;
+}
+
+article details {
+	margin:1em 0;
+	padding:0 .5em;
+	border-left:thin solid lightgrey;
+}
+article details[open] summary {margin-bottom:.5em}
+article summary {font-weight:bold; color:gray}
 
 footer summary {font-weight:bold; color:gray}
+footer#modified {
+	font-size:90%;
+	color:gray;
+	margin:1em 0;
+	padding-top:.5em;
+	border-top: 1px solid lightgrey;
+}
 
 summary {cursor:pointer; outline:none}
 summary:only-child {display:none}
 
 @media print {
-	nav {display: none}
+	nav, a.anchor {display: none}
 	pre {overflow-wrap:break-word; white-space:pre-wrap}
+	pre, table, blockquote, img {break-inside: avoid}
+	h1, h2, h3, h4, h5, h6 {break-after: avoid}
+	article h1 {break-before: page}
+	article h1:first-child {break-before: auto}
+	article a[href^="http:"]:after, article a[href^="https:"]:after {
+		content: " (" attr(href) ")";
+		font-size: 90%;
+		color: gray;
+		overflow-wrap: break-word;
+	}
 }`
 
+const defaultFavicon = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 16 16">
+<path d="M3 1h7l3 3v11H3z" fill="#fff" stroke="#a08941"/>
+<path d="M5 6h6M5 8h6M5 10h6M5 12h4" stroke="#333"/>
+</svg>`
+
+// darkStyle overrides colors of built-in stylesheet for dark theme, see -theme
+// flag. Printed pages always use light theme.
+const darkStyle = `
+:root {color-scheme: dark}
+body {color: #ccc; background: #1e1e1e}
+a {color: #c6b754}
+a:hover {color: #e0d27a}
+pre {background-color: #2a2a2a; color: #ddd}
+blockquote {color: #ddd; border-left-color: #555}
+table, td, th {border-color: #555}
+tr:nth-child(even) {background-color: rgba(100,100,100,0.2)}
+p.snippet {color: #aaa}
+article details, footer#modified {border-color: #555}
+div#quickopen {background: #1e1e1e; border-color: #555}
+div#quickopen li.selected {background-color: #333}
+`
+
+// numberingStyle is appended to embedded stylesheet when run with -numbered
+// flag. Sections are numbered starting from h2, as h1 is usually a document
+// title; each h1 restarts numbering. The same counters are used for table of
+// contents entries.
+const numberingStyle = `
+article, nav#toc details > ul {counter-reset: h2}
+article h1, nav#toc li.h1 {counter-reset: h2}
+article h2, nav#toc li.h2 {counter-reset: h3; counter-increment: h2}
+article h3, nav#toc li.h3 {counter-reset: h4; counter-increment: h3}
+article h4, nav#toc li.h4 {counter-reset: h5; counter-increment: h4}
+article h5, nav#toc li.h5 {counter-reset: h6; counter-increment: h5}
+article h6, nav#toc li.h6 {counter-increment: h6}
+article h2:before, nav#toc li.h2 a:before {content: counter(h2) ". "}
+article h3:before, nav#toc li.h3 a:before {content: counter(h2) "." counter(h3) ". "}
+article h4:before, nav#toc li.h4 a:before {content: counter(h2) "." counter(h3) "." counter(h4) ". "}
+article h5:before, nav#toc li.h5 a:before {content: counter(h2) "." counter(h3) "." counter(h4) "." counter(h5) ". "}
+article h6:before, nav#toc li.h6 a:before {content: counter(h2) "." counter(h3) "." counter(h4) "." counter(h5) "." counter(h6) ". "}
+`
+
 var testRun bool // used in tests
 
+// errTooLarge is returned by readerForFile for files larger than -maxsize
+var errTooLarge = errors.New("file is too large to render")
+
 //go:generate sh -c "go doc >README"
@@ -1,14 +1,40 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"html/template"
+	"image"
+	"image/png"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/artyom/autoflags"
+	"github.com/artyom/mdserver/render"
+	"github.com/gomarkdown/markdown/parser"
+	"golang.org/x/text/language"
 )
 
 func TestLazyRendering(t *testing.T) {
@@ -49,4 +75,1838 @@ func TestLazyRendering(t *testing.T) {
 	}
 }
 
+func TestMarkdownFallback(t *testing.T) {
+	srv := httptest.NewServer(&mdHandler{dir: "testdata", fileServer: http.FileServer(http.Dir("testdata"))})
+	defer srv.Close()
+	r, err := http.Get(srv.URL + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status, want 200, got: %q", r.Status)
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("Hello, world!")) {
+		t.Fatalf("response does not contain rendered document:\n%s", b)
+	}
+	r2, err := http.Get(srv.URL + "/nonexistent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2.Body.Close()
+	if r2.StatusCode != http.StatusNotFound {
+		t.Fatalf("invalid status for missing page, want 404, got: %q", r2.Status)
+	}
+}
+
+func TestDetailsRendering(t *testing.T) {
+	srv := httptest.NewServer(&mdHandler{dir: "testdata"})
+	defer srv.Close()
+	r, err := http.Get(srv.URL + "/details.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"<details open=\"\">\n\n<summary>Collapsible</summary>",
+		"<p>Hidden <em>content</em>.</p>\n\n</details>",
+	} {
+		if !bytes.Contains(b, []byte(s)) {
+			t.Errorf("response does not contain %q:\n%s", s, b)
+		}
+	}
+	for _, s := range []string{"<p><details", "alert", "ontoggle", "onclick"} {
+		if bytes.Contains(b, []byte(s)) {
+			t.Errorf("response contains %q:\n%s", s, b)
+		}
+	}
+}
+
+func TestSymlinkEscape(t *testing.T) {
+	outside, err := ioutil.TempDir("", "mdserver-outside-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	dir, err := ioutil.TempDir("", "mdserver-root-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, text := range map[string]string{
+		filepath.Join(outside, "secret.md"):  "# Secret\n\n[page](page.md)",
+		filepath.Join(outside, "secret.txt"): "secret",
+		filepath.Join(dir, "page.md"):        "# Page",
+	} {
+		if err := ioutil.WriteFile(name, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for oldname, newname := range map[string]string{
+		filepath.Join(outside, "secret.md"):  filepath.Join(dir, "link.md"),
+		filepath.Join(outside, "secret.txt"): filepath.Join(dir, "link.txt"),
+		outside:                              filepath.Join(dir, "linkdir"),
+		filepath.Join(dir, "page.md"):        filepath.Join(dir, "inside.md"),
+	} {
+		if err := os.Symlink(oldname, newname); err != nil {
+			t.Skipf("cannot create symlink: %v", err)
+		}
+	}
+	h := &mdHandler{dir: dir, fileServer: http.FileServer(http.Dir(dir)), feedSize: 10, withSearch: true}
+	h.textIndex = newTextIndex(h.files(), h.unlisted)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	for p, code := range map[string]int{
+		"/page.md":            http.StatusOK,
+		"/inside.md":          http.StatusOK,
+		"/link.md":            http.StatusBadRequest,
+		"/link":               http.StatusBadRequest,
+		"/link.txt":           http.StatusBadRequest,
+		"/linkdir/secret.md":  http.StatusBadRequest,
+		"/linkdir/secret.txt": http.StatusBadRequest,
+		"/linkdir/":           http.StatusBadRequest,
+	} {
+		r, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.StatusCode != code {
+			t.Errorf("%s: want status %d, got %q", p, code, r.Status)
+		}
+	}
+	// documents listing served files must not list ones outside of root
+	get := func(p string) string {
+		t.Helper()
+		r, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	for _, p := range []string{"/feed.xml", "/?index"} {
+		body := get(p)
+		if !strings.Contains(body, "page.md") || strings.Contains(body, "link.md") || strings.Contains(body, "Secret") {
+			t.Errorf("%s lists file outside of root:\n%s", p, body)
+		}
+	}
+	for _, p := range []string{"/?q=secret", "/?q=exact:Secret"} {
+		if body := get(p); strings.Contains(body, "link.md") {
+			t.Errorf("%s finds file outside of root:\n%s", p, body)
+		}
+	}
+	for _, p := range []string{"/api/files", "/api/index", "/api/search?q=secret"} {
+		if body := get(p); strings.Contains(body, "link.md") || strings.Contains(body, "Secret") {
+			t.Errorf("%s lists file outside of root: %s", p, body)
+		}
+	}
+	if body := get("/api/index"); !strings.Contains(body, "page.md") {
+		t.Errorf("/api/index does not list files inside root: %s", body)
+	}
+	if links := newLinkGraph(h).backlinks(context.Background(), "page.md"); len(links) != 0 {
+		t.Errorf("page is linked from files outside of root: %+v", links)
+	}
+}
+
+func TestIgnoreList(t *testing.T) {
+	rules := parseIgnore(strings.NewReader(`
+# comment
+*.draft.md
+drafts/
+/notes/private/**/*.md
+!keep.draft.md
+`))
+	for name, want := range map[string]bool{
+		"page.md":                   false,
+		"page.draft.md":             true,
+		"sub/page.draft.md":         true,
+		"keep.draft.md":             false,
+		"drafts/page.md":            true,
+		"sub/drafts/page.md":        true,
+		"drafts.md":                 false,
+		"notes/private/page.md":     true,
+		"notes/private/a/b/page.md": true,
+		"notes/page.md":             false,
+		"sub/notes/private/page.md": false,
+	} {
+		if got := rules.match(name); got != want {
+			t.Errorf("%q: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		max  int
+		want string
+	}{
+		{"short text", 20, "short text"},
+		{"some longer text, to be cut", 20, "some longer text…"},
+		{"unbreakablewordwithoutspaces", 10, "unbreakab…"},
+	} {
+		if got := truncateText(tc.text, tc.max); got != tc.want {
+			t.Errorf("truncateText(%q, %d) = %q, want %q", tc.text, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestBreadcrumbs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdserver-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "guides", "setup"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "guides", "index.html"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	h := &mdHandler{dir: dir}
+	got := h.breadcrumbs("/guides/setup/install-notes.md")
+	want := []breadcrumb{
+		{Name: "guides", Href: "/guides/"},
+		{Name: "setup", Href: "/guides/setup/?index"},
+		{Name: "install notes"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDuplicateHeadingIDs(t *testing.T) {
+	src := []byte("# Title\n\n## Overview\n\nFirst.\n\n## Details\n\n## Overview\n\nSecond.\n")
+	doc := render.Parse(src, render.Options{})
+	want := []duplicateID{{id: "overview", count: 2}}
+	if got := duplicateHeadingIDs(doc); !reflect.DeepEqual(got, want) {
+		t.Fatalf("duplicateHeadingIDs: got %+v, want %+v", got, want)
+	}
+	b := render.Document(doc, render.Options{})
+	for _, s := range []string{`<h2 id="overview">Overview</h2>`, `<h2 id="overview-1">Overview</h2>`} {
+		if !bytes.Contains(b, []byte(s)) {
+			t.Errorf("rendered document does not contain %q:\n%s", s, b)
+		}
+	}
+}
+
+func TestTableOfContents(t *testing.T) {
+	headings := []render.Heading{
+		{Level: 1, ID: "a", Text: "A"},
+		{Level: 2, ID: "b", Text: "B"},
+		{Level: 4, ID: "c", Text: "C"},
+		{Level: 3, ID: "d", Text: "D"},
+		{Level: 1, ID: "e", Text: "E"},
+	}
+	h := &mdHandler{}
+	want := `<nav id="toc"><details open><summary>Contents</summary><ul>` +
+		`<li class="h1"><a href="#a">A</a><ul>` +
+		`<li class="h2"><a href="#b">B</a><ul>` +
+		`<li class="h4"><a href="#c">C</a></li>` +
+		`<li class="h3"><a href="#d">D</a></li></ul></li></ul></li>` +
+		`<li class="h1"><a href="#e">E</a></li>` +
+		`</ul></details></nav>`
+	if got := string(h.tableOfContents(headings)); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	h.tocDepth = 1
+	if got := h.tableOfContents(headings); !strings.Contains(string(got), `<a href="#e">E</a></li></ul>`) || strings.Contains(string(got), "#b") {
+		t.Errorf("with -tocdepth=1 got:\n%s", got)
+	}
+}
+
+func TestZipFS(t *testing.T) {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for name, text := range map[string]string{
+		"guides/page.md": "# Zipped page",
+		"guides/a.txt":   "static file",
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := seekableFS{zr}
+	srv := httptest.NewServer(&mdHandler{fsys: fsys, fileServer: http.FileServer(http.FS(fsys))})
+	defer srv.Close()
+	for p, want := range map[string]string{
+		"/guides/page":    "<h1 id=\"zipped-page\">Zipped page <a class=\"anchor\" href=\"#zipped-page\" rel=\"nofollow\">¶</a></h1>",
+		"/guides/a.txt":   "static file",
+		"/guides/?index":  "<a href=\"page.md\">Zipped page</a>",
+		"/guides/page.md": "<a href=\"/guides/?index\">guides</a>",
+	} {
+		r, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != http.StatusOK || !bytes.Contains(b, []byte(want)) {
+			t.Errorf("%s: got status %q, want body containing %q:\n%s", p, r.Status, want, b)
+		}
+	}
+}
+
+func TestNestedFiles(t *testing.T) {
+	srv := httptest.NewServer(&mdHandler{dir: "testdata"})
+	defer srv.Close()
+	for p, want := range map[string]string{
+		"/?index":         "<h2>nested</h2><ul><li><a href=\"nested/page.md\">Nested page</a></li>",
+		"/nested/page.md": "<h1 id=\"nested-page\">Nested page <a class=\"anchor\" href=\"#nested-page\" rel=\"nofollow\">¶</a></h1>",
+	} {
+		r, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != http.StatusOK || !bytes.Contains(b, []byte(want)) {
+			t.Errorf("%s: got status %q, want body containing %q:\n%s", p, r.Status, want, b)
+		}
+	}
+}
+
+func TestTextIndex(t *testing.T) {
+	fsys := fstest.MapFS{
+		"setup.md":       {Data: []byte("# Setup\n\nInstall the Café <server> first.\n"), ModTime: time.Unix(1, 0)},
+		"guides/misc.md": {Data: []byte("# Misc\n\nNothing to see.\n"), ModTime: time.Unix(1, 0)},
+	}
+	ix := newTextIndex(fsys, nil)
+	index, err := ix.search(context.Background(), language.English, "cafe inst", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 1 || index[0].File != "setup.md" {
+		t.Fatalf("unexpected results: %+v", index)
+	}
+	want := template.HTML("<mark>Inst</mark>all the <mark>Café</mark> &lt;server&gt; first.")
+	if index[0].Snippet != want {
+		t.Errorf("got snippet %q, want %q", index[0].Snippet, want)
+	}
+	fsys["guides/misc.md"] = &fstest.MapFile{Data: []byte("# Misc\n\nInstall nothing.\n"), ModTime: time.Unix(2, 0)}
+	if index, _ = ix.search(context.Background(), language.English, "install", ""); len(index) != 1 {
+		t.Fatalf("files are checked for changes too often, results: %+v", index)
+	}
+	ix.invalidate()
+	if index, _ = ix.search(context.Background(), language.English, "install", ""); len(index) != 2 {
+		t.Fatalf("modified file is not reindexed, results: %+v", index)
+	}
+	delete(fsys, "setup.md")
+	ix.invalidate()
+	if index, _ = ix.search(context.Background(), language.English, "install", ""); len(index) != 1 || index[0].File != "guides/misc.md" {
+		t.Fatalf("removed file is not dropped from index, results: %+v", index)
+	}
+	fsys["de.md"] = &fstest.MapFile{Data: []byte("Die Straße ist lang.\n")}
+	fsys["tr.md"] = &fstest.MapFile{Data: []byte("Kısa bir yazı.\n")}
+	ix.invalidate()
+	for _, tc := range []struct {
+		lang, q string
+		want    int
+	}{
+		{"de", "strasse", 1},
+		{"de", "STRASSE", 1},
+		{"tr", "kısa", 1},
+		{"tr", "kisa", 0},
+	} {
+		if index, _ = ix.search(context.Background(), language.MustParse(tc.lang), tc.q, ""); len(index) != tc.want {
+			t.Errorf("%q in %s: got %d results, want %d", tc.q, tc.lang, len(index), tc.want)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	outdir, err := ioutil.TempDir("", "mdserver-export-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outdir)
+	h := &mdHandler{fsys: fstest.MapFS{
+		"page.md":         {Data: []byte("# Page\n\nSee [guide](guides/guide.md).\n")},
+		"guides/guide.md": {Data: []byte("# Guide\n")},
+		"guides/pic.png":  {Data: []byte("png")},
+		".git/config":     {Data: []byte("hidden")},
+	}}
+	if err := h.export(outdir); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"page.html":         `<a href="guides/guide.html"`,
+		"guides/guide.html": `<a href="/guides/">guides</a>`,
+		"guides/pic.png":    "png",
+		"index.html":        `<a href="guides/guide.html">Guide</a>`,
+		"guides/index.html": `<a href="guide.html">Guide</a>`,
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(outdir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Contains(b, []byte(want)) {
+			t.Errorf("%s does not contain %q:\n%s", name, want, b)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outdir, ".git")); !os.IsNotExist(err) {
+		t.Errorf("hidden directory is exported")
+	}
+}
+
+func TestRenderCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdserver-cache-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "page.md")
+	if err := ioutil.WriteFile(name, []byte("# Old\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(&mdHandler{dir: dir, cache: newRenderCache(1 << 20)})
+	defer srv.Close()
+	logBuf := new(bytes.Buffer)
+	log.SetOutput(logBuf)
+	get := func() string {
+		t.Helper()
+		r, err := http.Get(srv.URL + "/page.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	get()
+	get()
+	if cnt := strings.Count(logBuf.String(), "lazyReadSeeker init()"); cnt != 1 {
+		t.Fatalf("want 1 rendering of unmodified page, got %d", cnt)
+	}
+	if err := ioutil.WriteFile(name, []byte("# New\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(name, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(); !strings.Contains(body, "New") {
+		t.Fatalf("modified page is served from cache:\n%s", body)
+	}
+
+	c := newRenderCache(10)
+	c.add(cacheKey{name: "a"}, []byte("12345"))
+	c.add(cacheKey{name: "b"}, []byte("12345"))
+	c.get(cacheKey{name: "a"})
+	c.add(cacheKey{name: "c"}, []byte("1"))
+	if _, ok := c.get(cacheKey{name: "b"}); ok {
+		t.Fatal("least recently used page is not evicted")
+	}
+	if _, ok := c.get(cacheKey{name: "a"}); !ok {
+		t.Fatal("recently used page is evicted")
+	}
+}
+
+func TestETag(t *testing.T) {
+	srv := httptest.NewServer(&mdHandler{dir: "testdata"})
+	defer srv.Close()
+	logBuf := new(bytes.Buffer)
+	log.SetOutput(logBuf)
+	r, err := http.Get(srv.URL + "/hello.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	etag := r.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("no weak ETag header; response headers are:\n%v", r.Header)
+	}
+	for _, tc := range []struct {
+		etag string
+		want int
+	}{
+		{etag, http.StatusNotModified},
+		{`"other"`, http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/hello.md", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("If-None-Match", tc.etag)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.StatusCode != tc.want {
+			t.Errorf("If-None-Match %s: got status %q, want %d", tc.etag, r.Status, tc.want)
+		}
+	}
+	if cnt := strings.Count(logBuf.String(), "lazyReadSeeker init()"); cnt != 2 {
+		t.Fatalf("want 2 logged lazyReadSeeker init calls, got %d", cnt)
+	}
+}
+
+func TestMermaid(t *testing.T) {
+	const src = "https://cdn.example.com/mermaid.min.js?v=10"
+	csp, err := scriptSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &mdHandler{dir: "testdata", mermaidSrc: src, mermaidCSP: csp}
+	if got := h.csp(false, false); !strings.Contains(got, " https://cdn.example.com/mermaid.min.js '"+mermaidScriptHash+"'") {
+		t.Errorf("CSP does not allow mermaid script: %s", got)
+	}
+	for name, want := range map[string]bool{"mermaid.md": true, "hello.md": false} {
+		rc, _, err := h.readerForFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.Contains(b, []byte(`<script src="`+template.HTMLEscapeString(src)+`">`)); got != want {
+			t.Errorf("%s: mermaid script included: %v, want %v", name, got, want)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		if got := strings.Contains(rec.Header().Get("Content-Security-Policy"), "'unsafe-inline'"); got != want {
+			t.Errorf("%s: CSP allows inline styles: %v, want %v", name, got, want)
+		}
+	}
+	if _, err := scriptSource("javascript:alert(1)"); err == nil {
+		t.Error("javascript: url is accepted")
+	}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	cert, err := selfSignedCert("docs.example.com", "192.0.2.1", "0.0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"docs.example.com", "localhost", "192.0.2.1", "127.0.0.1"} {
+		if err := leaf.VerifyHostname(host); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := leaf.VerifyHostname("0.0.0.0"); err == nil {
+		t.Error("certificate is valid for unspecified address")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	a := &auth{next: next, user: "user", password: "secret", token: "token"}
+	for _, tc := range []struct {
+		name   string
+		target string
+		setup  func(*http.Request)
+		want   int
+	}{
+		{"no credentials", "/", func(*http.Request) {}, http.StatusUnauthorized},
+		{"health check", healthPath, func(*http.Request) {}, http.StatusOK},
+		{"basic auth", "/", func(r *http.Request) { r.SetBasicAuth("user", "secret") }, http.StatusOK},
+		{"wrong password", "/", func(r *http.Request) { r.SetBasicAuth("user", "token") }, http.StatusUnauthorized},
+		{"bearer token", "/", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }, http.StatusOK},
+		{"cookie", "/", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: tokenCookie, Value: "token"}) }, http.StatusOK},
+		{"token parameter", "/?index&token=token", func(*http.Request) {}, http.StatusFound},
+		{"wrong token parameter", "/?token=secret", func(*http.Request) {}, http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		tc.setup(r)
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, tc.want)
+		}
+		if w.Code == http.StatusFound && w.Header().Get("Location") != "/?index=" {
+			t.Errorf("%s: redirected to %q", tc.name, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRawAndPrintViews(t *testing.T) {
+	srv := httptest.NewServer(&mdHandler{dir: "testdata"})
+	defer srv.Close()
+	get := func(url string) (*http.Response, string) {
+		t.Helper()
+		r, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r, string(b)
+	}
+	src, err := ioutil.ReadFile(filepath.Join("testdata", "hello.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, body := get(srv.URL + "/hello.md?raw")
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/markdown") {
+		t.Errorf("raw view has Content-Type %q", ct)
+	}
+	if body != string(src) {
+		t.Errorf("raw view differs from source file:\n%s", body)
+	}
+	_, body = get(srv.URL + "/hello.md")
+	if !strings.Contains(body, `<nav id="site">`) || !strings.Contains(body, `<a href="?print">`) {
+		t.Errorf("page has no navigation with link to printable view:\n%s", body)
+	}
+	_, body = get(srv.URL + "/hello.md?print")
+	if strings.Contains(body, "<nav") || !strings.Contains(body, "Hello, world!") {
+		t.Errorf("unexpected printable view:\n%s", body)
+	}
+}
+
+func TestFrontMatter(t *testing.T) {
+	for _, tc := range []struct {
+		doc  string
+		want frontMatter
+		rest string
+	}{
+		{"# Title\n", frontMatter{}, "# Title\n"},
+		{"---\ntitle: \"Hello: world\"\ntags: [go, 'web']\ndate: 2020-05-01\n---\n# Doc\n",
+			frontMatter{Title: "Hello: world", Tags: []string{"go", "web"}, Date: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)},
+			"# Doc\n"},
+		{"---\ndescription: About\ntags:\n  - one\n  - two\nauthor: me\n---\ntext",
+			frontMatter{Description: "About", Tags: []string{"one", "two"}}, "text"},
+		{"+++\ntitle = \"Toml\"\ntags = [\"a\", \"b\"]\n+++\n", frontMatter{Title: "Toml", Tags: []string{"a", "b"}}, ""},
+		{"---\nno closing delimiter\n", frontMatter{}, "---\nno closing delimiter\n"},
+	} {
+		fm, rest := splitFrontMatter([]byte(tc.doc))
+		if !reflect.DeepEqual(fm, tc.want) || string(rest) != tc.rest {
+			t.Errorf("splitFrontMatter(%q) = %+v, %q; want %+v, %q", tc.doc, fm, rest, tc.want, tc.rest)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	index := []indexRecord{
+		{File: "a.md", Tags: []string{"Go", "web"}},
+		{File: "b.md"},
+		{File: "c.md", Tags: []string{"go"}},
+	}
+	want := []tagCount{{"Go", 2}, {"web", 1}}
+	if got := countTags(index); !reflect.DeepEqual(got, want) {
+		t.Errorf("countTags: got %+v, want %+v", got, want)
+	}
+	var files []string
+	for _, rec := range filterByTag(index, "GO") {
+		files = append(files, rec.File)
+	}
+	if want := []string{"a.md", "c.md"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("filterByTag: got %q, want %q", files, want)
+	}
+}
+
+func TestSortIndex(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+	index := []indexRecord{
+		{File: "b.md", Title: "Alpha", Subdir: ".", sortKey: "b", ModTime: day(3)},
+		{File: "a.md", Title: "Beta", Subdir: ".", sortKey: "a", ModTime: day(1)},
+		{File: "c.md", Title: "Gamma", Subdir: ".", sortKey: "c", ModTime: day(2)},
+		{File: "sub/d.md", Title: "Delta", Subdir: "sub", sortKey: "d", ModTime: day(4)},
+	}
+	for _, tc := range []struct {
+		by   string
+		desc bool
+		want []string
+	}{
+		{sortByName, false, []string{"a.md", "b.md", "c.md", "sub/d.md"}},
+		{sortByName, true, []string{"c.md", "b.md", "a.md", "sub/d.md"}},
+		{sortByTitle, false, []string{"b.md", "a.md", "c.md", "sub/d.md"}},
+		{sortByMtime, true, []string{"b.md", "c.md", "a.md", "sub/d.md"}},
+	} {
+		sortIndex(index, tc.by, tc.desc)
+		var got []string
+		for _, rec := range index {
+			got = append(got, rec.File)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("sort by %s (desc: %v): got %q, want %q", tc.by, tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	h := &mdHandler{dir: "testdata"}
+	prev, next := h.neighbors("hello.md")
+	if prev == nil || prev.Href != "details.md" {
+		t.Errorf("unexpected previous page link: %+v", prev)
+	}
+	if next == nil || next.Href != "mermaid.md" || next.Title != "Diagram" {
+		t.Errorf("unexpected next page link: %+v", next)
+	}
+	if prev, _ := h.neighbors("details.md"); prev != nil {
+		t.Errorf("first page has previous page link: %+v", prev)
+	}
+	h.sortDesc = true
+	if prev, _ := h.neighbors("hello.md"); prev == nil || prev.Href != "mermaid.md" {
+		t.Errorf("unexpected previous page link with descending order: %+v", prev)
+	}
+}
+
+func TestWikiParts(t *testing.T) {
+	h := &mdHandler{fsys: fstest.MapFS{
+		"_Sidebar.md":     {Data: []byte("[Home](Home.md) [Dir](sub/)")},
+		"sub/_Footer.md":  {Data: []byte("Sub footer")},
+		"sub/Page.md":     {Data: []byte("# Page")},
+		"other/Page.md":   {Data: []byte("# Other")},
+		"other/_Footer.x": {Data: []byte("not a footer")},
+	}}
+	render := func(name string) string {
+		rc, _, err := h.readerForFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	page := render("sub/Page.md")
+	for _, want := range []string{
+		`<aside id="sidebar">`,
+		`<a href="/Home.md" rel="nofollow">Home</a>`,
+		`<a href="/sub/" rel="nofollow">Dir</a>`,
+		"<footer id=\"wiki\">\n<p>Sub footer</p>",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page does not contain %q:\n%s", want, page)
+		}
+	}
+	if page := render("other/Page.md"); strings.Contains(page, `<footer id="wiki">`) {
+		t.Errorf("footer of other directory is rendered:\n%s", page)
+	}
+	if !h.excluded("sub/_Footer.md") {
+		t.Error("wiki footer is not excluded from index")
+	}
+}
+
+func TestWikiLinkResolver(t *testing.T) {
+	h := &mdHandler{fsys: fstest.MapFS{
+		"Home.md":            {Data: []byte("# Home")},
+		"Getting-Started.md": {Data: []byte("# Start")},
+		"sub/Home.md":        {Data: []byte("# Sub home")},
+	}}
+	resolve := h.wikiLinkResolver("sub/Page.md")
+	for page, want := range map[string]string{
+		"home":                    "/sub/Home.md",
+		"Getting Started":         "/Getting-Started.md",
+		"Getting Started#Install": "/Getting-Started.md#install",
+		"New Page":                "New-Page.md",
+		"#Top Section":            "#top-section",
+	} {
+		if got := resolve(page); got != want {
+			t.Errorf("%q resolved to %q, want %q", page, got, want)
+		}
+	}
+	fsys := h.fsys.(fstest.MapFS)
+	key := (&lazyReadSeeker{h: h, name: "Home.md"}).dependencies().key
+	fsys["New-Page.md"] = &fstest.MapFile{Data: []byte("# New")}
+	h.wikiFiles.invalidate()
+	if (&lazyReadSeeker{h: h, name: "Home.md"}).dependencies().key == key {
+		t.Error("dependencies key did not change after markdown file was added")
+	}
+	if got := h.wikiLinkResolver("Home.md")("New Page"); got != "/New-Page.md" {
+		t.Errorf("link to added page resolved to %q", got)
+	}
+}
+
+func TestBacklinks(t *testing.T) {
+	h := &mdHandler{fsys: fstest.MapFS{
+		"a.md":     {Data: []byte("# Page A\n\n[b](b.md) and [again](/b.md#top)")},
+		"b.md":     {Data: []byte("# Page B\n\n[[c]]")},
+		"sub/c.md": {Data: []byte("[up](../b) [self](c.md) [site](https://example.com/b.md)")},
+		"c.md":     {Data: []byte("---\ntitle: Page C\n---\n[a](a.md)")},
+	}}
+	g := newLinkGraph(h)
+	for name, want := range map[string][]pageLink{
+		"a.md":     {{Title: "Page C", Href: "/c.md"}},
+		"b.md":     {{Title: "Page A", Href: "/a.md"}, {Title: "c", Href: "/sub/c.md"}},
+		"c.md":     {{Title: "Page B", Href: "/b.md"}},
+		"sub/c.md": {},
+	} {
+		if got := g.backlinks(context.Background(), name); !reflect.DeepEqual(got, want) {
+			t.Errorf("backlinks of %s: got %+v, want %+v", name, got, want)
+		}
+	}
+}
+
+func TestGraph(t *testing.T) {
+	h := &mdHandler{fsys: fstest.MapFS{
+		"a.md": {Data: []byte("[b](b.md) [missing](c.md)")},
+		"b.md": {Data: []byte("# B")},
+		"o.md": {Data: []byte("# Orphan")},
+	}}
+	h.links = newLinkGraph(h)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, graphPath, nil))
+	var got graphData
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := graphData{
+		Nodes: []graphNode{
+			{ID: "a.md", Title: "a", Href: "/a.md"},
+			{ID: "b.md", Title: "B", Href: "/b.md"},
+			{ID: "o.md", Title: "Orphan", Href: "/o.md", Orphan: true},
+		},
+		Links: []graphLink{{Source: "a.md", Target: "b.md"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	mtime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := &mdHandler{withSearch: true, fsys: fstest.MapFS{
+		"a.md":     {Data: []byte("# Alpha\n\nSome *text*"), ModTime: mtime},
+		"sub/b.md": {Data: []byte("---\ntags: [x]\n---\nmore text"), ModTime: mtime},
+	}}
+	h.textIndex = newTextIndex(h.fsys, h.excluded)
+	for _, tc := range []struct {
+		url, want string
+		code      int
+	}{
+		{"/api/index", `[{"path":"a.md","title":"Alpha","mtime":"2021-01-02T03:04:05Z"},` +
+			`{"path":"sub/b.md","title":"b","tags":["x"],"mtime":"2021-01-02T03:04:05Z"}]`, http.StatusOK},
+		{"/api/page/a", `{"path":"a.md","title":"Alpha","mtime":"2021-01-02T03:04:05Z","description":"Some text",` +
+			`"html":"<h1 id=\"alpha\">Alpha <a class=\"anchor\" href=\"#alpha\" rel=\"nofollow\">¶</a></h1>\n\n<p>Some <em>text</em></p>\n"}`, http.StatusOK},
+		{"/api/page/sub/b.md?raw", `{"path":"sub/b.md","title":"b","tags":["x"],"mtime":"2021-01-02T03:04:05Z",` +
+			`"description":"more text","markdown":"---\ntags: [x]\n---\nmore text"}`, http.StatusOK},
+		{"/api/page/missing.md", `{"error":"not found"}`, http.StatusNotFound},
+		{"/api/search?q=more", `{"results":[{"path":"sub/b.md","title":"b","count":1,"snippet":"<mark>more</mark> text"}]}`, http.StatusOK},
+		{"/api/search?q=x", `{"error":"search term is too short"}`, http.StatusBadRequest},
+		{"/api/graph", `{"error":"unknown API endpoint"}`, http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if got := strings.TrimSpace(rec.Body.String()); rec.Code != tc.code || got != tc.want {
+			t.Errorf("%s: got %d %s\nwant %d %s", tc.url, rec.Code, got, tc.code, tc.want)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdserver-config-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := "# settings\nfeed = 5 \nsearch: true\nplaintext = [\".txt\", \"LICENSE\"]\nlang = de # comment\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, configFileName), []byte(conf), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var args runArgs
+	fset := flag.NewFlagSet("test", flag.ContinueOnError)
+	autoflags.DefineFlagSet(fset, &args)
+	if err := fset.Parse([]string{"-lang", "fr"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fset, "", dir); err != nil {
+		t.Fatal(err)
+	}
+	want := runArgs{Feed: 5, Grep: true, Plaintext: ".txt,LICENSE", Lang: "fr"}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("got %+v, want %+v", args, want)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "explicit.toml"), []byte("pdf = wkhtmltopdf - -"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fset, filepath.Join(dir, "explicit.toml"), dir); err != nil || args.PDF != "wkhtmltopdf - -" {
+		t.Fatalf("explicit config: %v, pdf = %q", err, args.PDF)
+	}
+	for _, conf := range []string{"pdf = rm -rf /", "convert = .rst=sh", "css = /etc/passwd", "sanitize = off"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, configFileName), []byte(conf), 0666); err != nil {
+			t.Fatal(err)
+		}
+		fset := flag.NewFlagSet("test", flag.ContinueOnError)
+		autoflags.DefineFlagSet(fset, &runArgs{})
+		if err := loadConfig(fset, "", dir); err == nil {
+			t.Errorf("%q accepted from %s in served directory", conf, configFileName)
+		}
+	}
+	for _, name := range []string{".mdserver.toml", ".MDSERVER.TOML", "sub/.Mdserver.toml"} {
+		if !isConfigFile(name) {
+			t.Errorf("%s not recognized as config file", name)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.toml"), []byte("nosuchflag = 1"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fset, filepath.Join(dir, "bad.toml"), dir); err == nil {
+		t.Fatal("unknown setting accepted")
+	}
+}
+
+func TestMountFS(t *testing.T) {
+	var pairs []string
+	for _, name := range []string{"a", "b"} {
+		dir, err := ioutil.TempDir("", "mdserver-mount-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".md"), []byte("# "+name), 0666); err != nil {
+			t.Fatal(err)
+		}
+		pairs = append(pairs, name+"="+dir)
+	}
+	m, err := parseMounts(strings.Join(pairs, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(m, "a/a.md", "b/b.md"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"a", "=dir", ".a=" + os.TempDir(), "a/b=" + os.TempDir(), pairs[0] + "," + pairs[0]} {
+		if _, err := parseMounts(s); err == nil {
+			t.Errorf("parseMounts(%q) succeeded", s)
+		}
+	}
+}
+
+func TestMatchText(t *testing.T) {
+	text := "---\ntitle: needle\n---\n# Intro\n\n" +
+		"```\n# not a heading\n```\n" +
+		"Second part\n-----------\n\n#tag is not a heading\n\nfind the needle here\nand another needle\n"
+	got := matchText([]byte(text), []lineMatcher{exactMatcher("needle")})
+	want := textMatch{count: 3, snippet: "title: <mark>needle</mark>"}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	_, body := splitFrontMatter([]byte(text))
+	got = matchText(body, []lineMatcher{exactMatcher("needle")})
+	want = textMatch{count: 2, snippet: "find the <mark>needle</mark> here", anchor: "second-part"}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestSearchLang(t *testing.T) {
+	for _, tc := range []struct {
+		lang, header string
+		want         language.Tag
+	}{
+		{"", "", language.English},
+		{"", "*", language.English},
+		{"", "tr-TR,tr;q=0.9,en;q=0.5", language.MustParse("tr-TR")},
+		{"", "en;q=0.5, de", language.German},
+		{"de", "tr", language.German},
+	} {
+		h := &mdHandler{}
+		if tc.lang != "" {
+			h.lang = language.MustParse(tc.lang)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/?q=test", nil)
+		r.Header.Set("Accept-Language", tc.header)
+		if got := h.searchLang(r); got != tc.want {
+			t.Errorf("lang %q, Accept-Language %q: got %v, want %v", tc.lang, tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestToggleTask(t *testing.T) {
+	const src = "---\ntitle: x\n---\n- [ ] one\n\n```\n- [ ] code\n```\n\n    - [ ] indented code\n\n<div>\n- [ ] html\n</div>\n\n1. [x] two\n\n> - [ ] three\n"
+	h := &mdHandler{}
+	b, err := h.toggleTask([]byte(src), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Replace(src, "[x] two", "[ ] two", 1); string(b) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", b, want)
+	}
+	if b, err = h.toggleTask([]byte(src), 2, true); err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Replace(src, "[ ] three", "[x] three", 1); string(b) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", b, want)
+	}
+	for _, n := range []int{0, 3} {
+		if _, err := h.toggleTask([]byte(src), n, n == 3); err != errTaskState {
+			t.Fatalf("task %d: got error %v, want %v", n, err, errTaskState)
+		}
+	}
+	// footnotes are rendered at the end of page, so are their tasks
+	if err := h.setExtensions("+footnotes"); err != nil {
+		t.Fatal(err)
+	}
+	const notes = "Note[^1].\n\n[^1]: Footnote:\n\n    - [ ] in note\n\n- [ ] last\n"
+	for n, want := range []string{"- [x] last", "- [x] in note"} {
+		b, err := h.toggleTask([]byte(notes), n, true)
+		if err != nil {
+			t.Fatalf("task %d with footnotes: %v", n, err)
+		}
+		if !strings.Contains(string(b), want) {
+			t.Errorf("task %d with footnotes: got:\n%s\nwant %q toggled", n, b, want)
+		}
+	}
+}
+
+func TestEdit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdserver-edit-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "page.md")
+	if err := ioutil.WriteFile(name, []byte("# Old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h := &mdHandler{dir: dir, edit: true}
+	save := func(content, sum string) *httptest.ResponseRecorder {
+		form := url.Values{"content": {content}, "sum": {sum}}
+		req := httptest.NewRequest(http.MethodPost, editPath+"page", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := save("# New\r\n", contentSum([]byte("# Old\n"))); rec.Code != http.StatusSeeOther {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	if b, err := ioutil.ReadFile(name); err != nil || string(b) != "# New\n" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+	if st, err := os.Stat(name); err != nil || st.Mode().Perm() != 0600 {
+		t.Fatalf("file permissions not preserved: %v, %v", st.Mode(), err)
+	}
+	if rec := save("# Newer\n", contentSum([]byte("# Old\n"))); rec.Code != http.StatusConflict {
+		t.Fatalf("saving outdated content: got status %d, want %d", rec.Code, http.StatusConflict)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, editPath+"page.md", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "# New\n</textarea>") {
+		t.Fatalf("editor page: status %d, body:\n%s", rec.Code, rec.Body)
+	}
+	if err := ioutil.WriteFile(name, []byte("    - [ ] code\n\n- [ ] task\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page.md", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `data-task="0" disabled=""> task`) || !strings.Contains(body, taskScript) {
+		t.Fatalf("page has no editable task:\n%s", body)
+	}
+	form := url.Values{"task": {"0"}, "checked": {"1"}}
+	req := httptest.NewRequest(http.MethodPost, editPath+"page.md", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if b, err := ioutil.ReadFile(name); rec.Code != http.StatusNoContent || string(b) != "    - [ ] code\n\n- [x] task\n" {
+		t.Fatalf("toggling task: status %d, file %q, %v", rec.Code, b, err)
+	}
+}
+
+func TestPageFileName(t *testing.T) {
+	for title, want := range map[string]string{
+		"Hello, World!":      "Hello-World",
+		"  multiple  spaces": "multiple-spaces",
+		"../etc/passwd":      "etcpasswd",
+		"notes.md":           "notes",
+		"Über v1.2":          "Über-v1.2",
+		"???":                "",
+	} {
+		if got := pageFileName(title); got != want {
+			t.Errorf("pageFileName(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestParseGitLog(t *testing.T) {
+	out := "\x1eaaa\x00Alice\x0010\x00second\n\nb.md\nsub/c.md\n\x1ebbb\x00Bob\x0020\x00first: a, b\n\na.md\nb.md\n"
+	type entry struct {
+		c     gitCommit
+		files []string
+	}
+	var got []entry
+	parseGitLog([]byte(out), func(c gitCommit, files []string) { got = append(got, entry{c, files}) })
+	want := []entry{
+		{gitCommit{Hash: "aaa", Author: "Alice", Time: time.Unix(10, 0), Subject: "second"}, []string{"b.md", "sub/c.md"}},
+		{gitCommit{Hash: "bbb", Author: "Bob", Time: time.Unix(20, 0), Subject: "first: a, b"}, []string{"a.md", "b.md"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestGitDiff(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "mdserver-git-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	write := func(name, text string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q")
+	write("a.md", "# A\n\none\n")
+	git("add", "a.md")
+	git("commit", "-qm", "add a")
+	git("mv", "a.md", "b.md")
+	write("b.md", "# A\n\ntwo\n")
+	git("commit", "-qam", "rename a to b")
+	g := openGitRepo(dir)
+	if g == nil {
+		t.Fatal("repository not detected")
+	}
+	commits, err := g.history(context.Background(), "b.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 2 || commits[0].Subject != "rename a to b" || commits[1].file != "a.md" {
+		t.Fatalf("unexpected history: %+v", commits)
+	}
+	lines, err := g.diff(context.Background(), &commits[1], &commits[0], "b.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []diffLine{{"hunk", "@@ -1,3 +1,3 @@"}, {"", " # A"}, {"", " "}, {"del", "-one"}, {"add", "+two"}}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got diff %q, want %q", lines, want)
+	}
+}
+
+func TestGitPullNoPrompt(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "mdserver-git-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"commit", "-q", "--allow-empty", "-m", "init"},
+		{"remote", "add", "origin", srv.URL + "/repo.git"},
+		{"config", "credential.helper", ""},
+		{"config", "branch.main.remote", "origin"},
+		{"config", "branch.main.merge", "refs/heads/main"},
+	} {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	g := openGitRepo(dir)
+	if g == nil {
+		t.Fatal("repository not detected")
+	}
+	_, err = g.pullOnce(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "terminal prompts disabled") {
+		t.Fatalf("got error %v, want one about disabled prompts", err)
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdserver-templates-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, text := range map[string]string{
+		"index.tmpl":  `{{template "title" .}}:{{range .Index}} {{.File}}{{end}}`,
+		"common.tmpl": `{{define "title"}}<h1>{{.Title}}</h1>{{end}}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := &mdHandler{}
+	if err := h.loadTemplates(dir); err != nil {
+		t.Fatal(err)
+	}
+	if h.pageTpl != nil {
+		t.Fatal("page template is set without page.tmpl")
+	}
+	var buf bytes.Buffer
+	if err := h.renderIndex(&buf, indexPage{Title: "A & B", Index: []indexRecord{{File: "a.md"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "<h1>A &amp; B</h1>: a.md"; buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestSetExtensions(t *testing.T) {
+	h := &mdHandler{}
+	if err := h.setExtensions("+footnotes, hardbreaks,-deflists,-smartquotes"); err != nil {
+		t.Fatal(err)
+	}
+	if h.extensions&parser.Footnotes == 0 || h.extensions&parser.HardLineBreak == 0 ||
+		h.extensions&parser.DefinitionLists != 0 || h.extensions&parser.Tables == 0 {
+		t.Errorf("unexpected extensions: %b", h.extensions)
+	}
+	if !h.noSmartypants {
+		t.Error("smartquotes not disabled")
+	}
+	body, _, _ := h.renderBody("a.md", []byte("\"a\" -- b\nc[^1]\n\n[^1]: note\n"))
+	if want := "<p>&#34;a&#34; -- b<br>\nc<sup id=\"fnref:1\">"; !strings.HasPrefix(string(body), want) {
+		t.Errorf("got %q, want it to start with %q", body, want)
+	}
+	if err := h.setExtensions("+tables"); err == nil {
+		t.Error("unknown extension accepted")
+	}
+	h.mentions = "https://github.com/{user}"
+	body, _, _ = h.renderBody("a.md", []byte("hi @octocat"))
+	if want := `<a href="https://github.com/octocat" rel="nofollow">@octocat</a>`; !strings.Contains(string(body), want) {
+		t.Errorf("got %q, want it to contain %q", body, want)
+	}
+}
+
+func TestInlineImages(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.md":    {Data: []byte("![local](img.png) ![user](data:image/png;base64,AAAA)")},
+		"img.png": {Data: []byte("png")},
+	}
+	h := &mdHandler{fsys: fsys, inlineImg: true, inlineMax: 1 << 10, policy: inlineImagesPolicy(nil)}
+	body, _, _ := h.renderBody("a.md", fsys["a.md"].Data)
+	if want := `src="data:image/png;base64,cG5n"`; !bytes.Contains(body, []byte(want)) {
+		t.Errorf("image is not inlined:\n%s", body)
+	}
+	h = &mdHandler{fsys: fsys}
+	if body, _, _ = h.renderBody("a.md", fsys["a.md"].Data); bytes.Contains(body, []byte("data:")) {
+		t.Errorf("data URI is kept without -inlineimages:\n%s", body)
+	}
+}
+
+func TestResizedImages(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"sub/page.md":  {Data: []byte("![shot](shot.png) ![icon](/icon.gif) ![remote](https://example.com/a.png)")},
+		"sub/shot.png": {Data: buf.Bytes()},
+	}
+	h := &mdHandler{fsys: fsys, fileServer: http.FileServer(http.FS(fsys)), imageWidth: 10}
+	body, _, _ := h.renderBody("sub/page.md", fsys["sub/page.md"].Data)
+	for _, want := range []string{`src="shot.png?w=10"`, `src="/icon.gif"`, `src="https://example.com/a.png"`} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("page has no %s:\n%s", want, body)
+		}
+	}
+	for w, want := range map[string]int{"10": 10, "80": 40, "5": 40} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sub/shot.png?w="+w, nil))
+		cfg, err := png.DecodeConfig(rec.Body)
+		if err != nil {
+			t.Fatalf("w=%s: %v", w, err)
+		}
+		if cfg.Width != want || cfg.Height != want/2 {
+			t.Errorf("w=%s: got %dx%d image, want %dx%d", w, cfg.Width, cfg.Height, want, want/2)
+		}
+	}
+}
+
+func TestCSVTable(t *testing.T) {
+	fsys := fstest.MapFS{
+		"data/a.csv": {Data: []byte("name,size\n\"<b>x</b>\",\"1,5\"\ny\n")},
+		"data/b.tsv": {Data: []byte("k\tv\n")},
+	}
+	h := &mdHandler{fsys: fsys, fileServer: http.FileServer(http.FS(fsys))}
+	for _, tc := range []struct{ url, want string }{
+		{"/data/a.csv", "<thead>\n<tr><th>name</th><th>size</th></tr>\n</thead>\n<tbody>\n" +
+			"<tr><td>&lt;b&gt;x&lt;/b&gt;</td><td>1,5</td></tr>\n<tr><td>y</td></tr>\n</tbody>\n"},
+		{"/data/b.tsv", "<tr><th>k</th><th>v</th></tr>"},
+		{"/data/a.csv?raw", "name,size\n"},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), tc.want) {
+			t.Errorf("%s: got %d, want body containing %q:\n%s", tc.url, rec.Code, tc.want, rec.Body)
+		}
+	}
+}
+
+func TestConverters(t *testing.T) {
+	if _, err := exec.LookPath("sed"); err != nil {
+		t.Skip(err)
+	}
+	for _, s := range []string{"rst=sed", ".md=sed", ".rst=", ".rst=no-such-program-here"} {
+		if _, err := parseConverters(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+	conv, err := parseConverters(`.adoc=sed -e s/^=\x20\(.*\)/<h1>\1<\/h1><script>x<\/script>/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"docs/guide.adoc":      {Data: []byte("= Guide & more\n")},
+		"docs/not-viewed.adoc": {Data: []byte("= Other\n")},
+	}
+	h := &mdHandler{fsys: fsys, fileServer: http.FileServer(http.FS(fsys)), converters: conv}
+	for _, tc := range []struct{ url, want string }{
+		{"/docs/guide.adoc", "<title>Guide &amp; more</title>"},
+		{"/docs/guide.adoc", "<h1>Guide &amp; more</h1>\n"},
+		{"/docs/guide.adoc?raw", "= Guide & more\n"},
+		{"/?index", `<a href="docs/guide.adoc">Guide &amp; more</a>`},
+		{"/?index", `<a href="docs/not-viewed.adoc">not viewed</a>`},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if body := rec.Body.String(); rec.Code != http.StatusOK || !strings.Contains(body, tc.want) || strings.Contains(body, "<script>x") {
+			t.Errorf("%s: got %d, want body containing %q:\n%s", tc.url, rec.Code, tc.want, body)
+		}
+	}
+}
+
+func TestListing(t *testing.T) {
+	fsys := fstest.MapFS{
+		"docs/b.md":          {Data: []byte("# Bee")},
+		"docs/a.txt":         {Data: []byte("12345")},
+		"docs/zsub/c.md":     {Data: []byte("# C")},
+		"docs/.hidden.md":    {Data: []byte("# Hidden")},
+		"docs/draft.md":      {Data: []byte("# Draft")},
+		"site/index.html":    {Data: []byte("<p>site")},
+		"site/other/page.md": {Data: []byte("# Page")},
+	}
+	h := &mdHandler{fsys: fsys, fileServer: http.FileServer(http.FS(fsys)), listings: true, exclude: "docs/draft.md"}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/docs/", nil))
+	body := rec.Body.String()
+	for _, want := range []string{`<a href="zsub/">zsub/</a>`, `<a href="a.txt">a.txt</a></td><td class="size">5 B</td>`,
+		`<a href="b.md">b.md</a> <small>Bee</small>`, `<a href="../">../</a>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing has no %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "hidden") || strings.Contains(body, "draft") {
+		t.Errorf("listing has hidden or excluded files:\n%s", body)
+	}
+	if strings.Index(body, "zsub/") > strings.Index(body, "a.txt") {
+		t.Errorf("directories are not listed first:\n%s", body)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/site/", nil))
+	if body := rec.Body.String(); body != "<p>site" {
+		t.Errorf("directory with index.html: got %q", body)
+	}
+}
+
+func TestFeed(t *testing.T) {
+	fsys := fstest.MapFS{
+		"old.md":     {Data: []byte("# Old\n\nOld text."), ModTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"sub/new.md": {Data: []byte("---\ndescription: Fresh\n---\n# New"), ModTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"mid.md":     {Data: []byte("# Mid"), ModTime: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	h := &mdHandler{fsys: fsys, feedSize: 2}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/feed.xml", nil))
+	var feed atomFeed
+	if err := xml.Unmarshal(rec.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("%v:\n%s", err, rec.Body)
+	}
+	want := []atomEntry{
+		{Title: "New", ID: "http://example.com/sub/new.md", Link: atomLink{Href: "http://example.com/sub/new.md"},
+			Updated: "2021-01-01T00:00:00Z", Summary: "Fresh"},
+		{Title: "Mid", ID: "http://example.com/mid.md", Link: atomLink{Href: "http://example.com/mid.md"},
+			Updated: "2020-06-01T00:00:00Z"},
+	}
+	if !reflect.DeepEqual(feed.Entries, want) || feed.Updated != "2021-01-01T00:00:00Z" {
+		t.Errorf("got %+v, want entries %+v", feed, want)
+	}
+	h.maxSize = 10
+	if s := h.documentSummary(context.Background(), "old.md"); s != "" {
+		t.Errorf("summary of file larger than -maxsize: %q", s)
+	}
+	h.maxSize = 0
+	var err error
+	if h.siteURL, err = parseBaseURL("https://docs.example.org/wiki"); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://evil.example/feed.xml", nil))
+	feed = atomFeed{}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &feed); err != nil {
+		t.Fatal(err)
+	}
+	if feed.Links[0].Href != "https://docs.example.org/wiki/feed.xml" || feed.Entries[0].ID != "https://docs.example.org/wiki/sub/new.md" {
+		t.Errorf("with -baseurl got %+v", feed)
+	}
+	for _, s := range []string{"/relative/", "ftp://example.com/", "https:///x"} {
+		if _, err := parseBaseURL(s); err == nil {
+			t.Errorf("parseBaseURL(%q) succeeded", s)
+		}
+	}
+}
+
+func TestOpenSearch(t *testing.T) {
+	h := &mdHandler{fsys: fstest.MapFS{"a.md": {Data: []byte("# A")}}, withSearch: true}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+openSearchPath, nil))
+	var desc openSearchDescription
+	if err := xml.Unmarshal(rec.Body.Bytes(), &desc); err != nil {
+		t.Fatalf("%v:\n%s", err, rec.Body)
+	}
+	if want := "http://example.com/?q={searchTerms}"; desc.URL.Template != want {
+		t.Errorf("got template %q, want %q", desc.URL.Template, want)
+	}
+	h.siteURL = &url.URL{Scheme: "https", Host: "docs.example.org", Path: "/wiki/"}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://evil.example"+openSearchPath, nil))
+	desc = openSearchDescription{}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &desc); err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://docs.example.org/wiki/?q={searchTerms}"; desc.URL.Template != want || strings.Contains(desc.Description, "evil") {
+		t.Errorf("with -baseurl got %+v", desc)
+	}
+	h.siteURL = nil
+	for _, p := range []string{"/a.md", "/?index"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		if !strings.Contains(rec.Body.String(), `<link rel="search" type="application/opensearchdescription+xml" title="mdserver" href="/opensearch.xml">`) {
+			t.Errorf("%s does not link OpenSearch description:\n%s", p, rec.Body)
+		}
+	}
+}
+
+func TestQuickOpen(t *testing.T) {
+	fsys := fstest.MapFS{
+		"b.md":       {Data: []byte("# Beta")},
+		"sub/a.md":   {Data: []byte("# Alpha")},
+		"hidden.md":  {Data: []byte("# Hidden")},
+		"notes.txt":  {Data: []byte("text")},
+		"sub/c.html": {Data: []byte("<h1>C</h1>")},
+	}
+	h := &mdHandler{fsys: fsys, exclude: "hidden.md", quickOpen: true}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/files", nil))
+	var files []apiFile
+	if err := json.Unmarshal(rec.Body.Bytes(), &files); err != nil {
+		t.Fatalf("%v:\n%s", err, rec.Body)
+	}
+	want := []apiFile{{Path: "b.md", Title: "Beta"}, {Path: "sub/a.md", Title: "Alpha"}}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got %+v, want %+v", files, want)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/b.md", nil))
+	if !strings.Contains(rec.Body.String(), quickOpenScript) {
+		t.Error("page does not include quick-open script")
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); !strings.Contains(csp, quickOpenScriptHash) {
+		t.Errorf("CSP %q does not allow quick-open script", csp)
+	}
+}
+
+func TestResolveName(t *testing.T) {
+	fsys := fstest.MapFS{
+		"Getting Started.md": {Data: []byte("# Start")},
+		"Guides/Setup.md":    {Data: []byte("# Setup")},
+		"dup/a.md":           {Data: []byte("# a")},
+		"dup/A.md":           {Data: []byte("# A")},
+		"dup/b.md":           {Data: []byte("# b")},
+		"dup/B.md":           {Data: []byte("# B")},
+	}
+	h := &mdHandler{fsys: fsys}
+	for _, tc := range []struct {
+		name, want string
+		ok         bool
+	}{
+		{"getting-started.md", "Getting Started.md", true},
+		{"guides/setup.md", "Guides/Setup.md", true},
+		{"Guides/Setup.md", "", false}, // exact match needs no resolution
+		{"dup/a.md", "", false},
+		{"dup/B.md", "", false},
+		{"dup/c.md", "", false},
+		{"setup.md", "", false},
+	} {
+		got, ok := h.resolveName(tc.name)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("resolveName(%q) = %q, %t, want %q, %t", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/guides/SETUP", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<h1") {
+		t.Errorf("got %d response:\n%s", rec.Code, rec.Body)
+	}
+	h.redirect = true
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/getting-started?print", nil))
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusMovedPermanently || loc != "/Getting%20Started.md?print" {
+		t.Errorf("got %d response redirecting to %q", rec.Code, loc)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	fsys := fstest.MapFS{
+		"guides/setup.md": {Data: []byte("---\naliases:\n  - install.md\n  - /old/setup.md\n---\n# Setup")},
+		".mdredirects":    {Data: []byte("# moved\nfaq.md guides/faq.md\nblog https://blog.example.com/\n")},
+	}
+	h := &mdHandler{fsys: fsys}
+	h.redirects = newRedirectMap(h)
+	for _, tc := range []struct{ path, want string }{
+		{"/guides/install.md", "/guides/setup.md"},
+		{"/guides/install?print", "/guides/setup.md?print"},
+		{"/old/setup", "/guides/setup.md"},
+		{"/faq.md", "/guides/faq.md"},
+		{"/blog", "https://blog.example.com/"},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if loc := rec.Header().Get("Location"); rec.Code != http.StatusMovedPermanently || loc != tc.want {
+			t.Errorf("%s: got %d response redirecting to %q, want %q", tc.path, rec.Code, loc, tc.want)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/missing.md", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got %d response for missing file", rec.Code)
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.md": {Data: []byte("# Index\n\n[ok](guide.md#setup) [ok](Guide) [ok](/sub/) [ok](#index) " +
+			"[ok](https://example.com/missing.md) [ok](old.md) [ok](/history/guide.md) [[Guide]]\n\n" +
+			"[bad](missing.md) [bad](guide.md#nope) [bad](#nope) [[Missing Page]] ![bad](img/x.png)")},
+		"guide.md":     {Data: []byte("---\naliases: [old.md]\n---\n# Guide\n\n## Setup\n\n[bad](../up.md) ![ok](sub/x.png)")},
+		"sub/x.png":    {Data: []byte("png")},
+		"draft.md":     {Data: []byte("# Draft")},
+		"sub/links.md": {Data: []byte("[bad](../draft.md) [ok](x.png) [bad](y/)")},
+	}
+	h := &mdHandler{fsys: fsys, fileServer: http.FileServer(http.FS(fsys)), exclude: "draft.md"}
+	h.redirects = newRedirectMap(h)
+	got, err := h.checkLinks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []brokenLink{
+		{File: "guide.md", Dest: "../up.md", Reason: "missing link"},
+		{File: "index.md", Dest: "missing.md", Reason: "missing link"},
+		{File: "index.md", Dest: "guide.md#nope", Reason: "missing heading"},
+		{File: "index.md", Dest: "#nope", Reason: "missing heading"},
+		{File: "index.md", Dest: "Missing-Page.md", Reason: "missing link"},
+		{File: "index.md", Dest: "img/x.png", Reason: "missing image"},
+		{File: "sub/links.md", Dest: "../draft.md", Reason: "missing link"},
+		{File: "sub/links.md", Dest: "y/", Reason: "missing link"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%+v\nwant:\n%+v", got, want)
+	}
+	for _, enabled := range []bool{false, true} {
+		h.linkCheck = enabled
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?linkcheck", nil))
+		if got := strings.Contains(rec.Body.String(), "8 broken links in 3 documents"); got != enabled {
+			t.Errorf("-linkcheck %t: report served: %t", enabled, got)
+		}
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.md":     {Data: []byte("# A\n\n[b](b.md) [self](a.md)")},
+		"b.md":     {Data: []byte("# B\n\n[a](a.md)")},
+		"c.md":     {Data: []byte("# C\n\n[a](/a.md)")},
+		"sub/d.md": {Data: []byte("# D")},
+	}
+	h := &mdHandler{fsys: fsys, orphans: true, deadEnds: true}
+	h.links = newLinkGraph(h)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sub/?index", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `<small class="orphan">orphan</small> <small class="deadend">no links</small>`) {
+		t.Errorf("document is not marked:\n%s", body)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?orphans", nil))
+	body := rec.Body.String()
+	for _, s := range []string{`href="c.md"`, `href="sub/d.md"`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("orphans index does not have %s:\n%s", s, body)
+		}
+	}
+	for _, s := range []string{`href="a.md"`, `href="b.md"`} {
+		if strings.Contains(body, s) {
+			t.Errorf("orphans index has %s:\n%s", s, body)
+		}
+	}
+}
+
+func TestInclude(t *testing.T) {
+	fsys := fstest.MapFS{
+		"page.md":             {Data: []byte("# Page\n\n{{include: shared/note.md}}\n\n![[Footer Part]]\n\n{{include: page.md}}\n\n    {{include: shared/note.md}}")},
+		"shared/note.md":      {Data: []byte("---\ntitle: Note\n---\nSee [setup](setup.md).\n\n{{include: /Footer Part.md}}")},
+		"Footer Part.md":      {Data: []byte("Footer text.")},
+		"shared/loop.md":      {Data: []byte("{{include: loop.md}}")},
+		"shared/loop-host.md": {Data: []byte("{{include: loop.md}}")},
+		"drafts/secret.md":    {Data: []byte("Secret text.")},
+		".hidden/secret.md":   {Data: []byte("Secret text.")},
+		"leak.md":             {Data: []byte("{{include: drafts/secret.md}}\n\n{{include: .hidden/secret.md}}")},
+	}
+	h := &mdHandler{fsys: fsys, exclude: "drafts/*"}
+	body, _, _ := h.renderBody("page.md", fsys["page.md"].Data)
+	want := `<p>See <a href="/shared/setup.md" rel="nofollow">setup</a>.</p>
+
+<p>Footer text.</p>
+
+<p>Footer text.</p>
+
+<p>{{include: page.md}}</p>
+
+<pre><code>{{include: shared/note.md}}
+</code></pre>`
+	if got := string(body); !strings.HasSuffix(strings.TrimSpace(got), want) {
+		t.Errorf("got:\n%s\nwant suffix:\n%s", got, want)
+	}
+	body, _, _ = h.renderBody("shared/loop-host.md", fsys["shared/loop-host.md"].Data)
+	if got, want := strings.TrimSpace(string(body)), "<p>{{include: loop.md}}</p>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := h.includedFiles("page.md", fsys["page.md"].Data), []string{"shared/note.md", "Footer Part.md", "Footer Part.md"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("includedFiles: got %q, want %q", got, want)
+	}
+	body, _, _ = h.renderBody("leak.md", fsys["leak.md"].Data)
+	if strings.Contains(string(body), "Secret") {
+		t.Errorf("hidden files included:\n%s", body)
+	}
+}
+
+func TestVars(t *testing.T) {
+	os.Setenv("MDSERVER_TEST_HOST", "docs.example.com")
+	defer os.Unsetenv("MDSERVER_TEST_HOST")
+	h := &mdHandler{}
+	if err := h.setVars("version=1.2.0, empty=", "MDSERVER_TEST_HOST,MDSERVER_TEST_UNSET"); err != nil {
+		t.Fatal(err)
+	}
+	src := "Version {{version}}{{empty}} at {{ MDSERVER_TEST_HOST }}, {{unknown}}.\n\n    curl https://{{MDSERVER_TEST_HOST}}/v{{version}}"
+	body, _, _ := h.renderBody("a.md", []byte(src))
+	want := "<p>Version 1.2.0 at docs.example.com, {{unknown}}.</p>\n\n<pre><code>curl https://docs.example.com/v1.2.0\n</code></pre>"
+	if got := strings.TrimSpace(string(body)); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if err := h.setVars("no value", ""); err == nil {
+		t.Error("invalid variable accepted")
+	}
+}
+
+func TestViewPrefs(t *testing.T) {
+	fsys := fstest.MapFS{"a.md": {Data: []byte("# A\n\n## B\n\ntext\n\n## C\n")}}
+	h := &mdHandler{fsys: fsys, toc: tocTop}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a.md?notoc&width=wide", nil))
+	body := rec.Body.String()
+	if strings.Contains(body, `id="toc"`) || !strings.Contains(body, `<body class="wide">`) {
+		t.Errorf("preferences from query are not applied:\n%s", body)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != viewCookie {
+		t.Fatalf("got cookies %v, want one %s cookie", cookies, viewCookie)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/a.md?toc", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body = rec.Body.String()
+	if !strings.Contains(body, `id="toc"`) || !strings.Contains(body, `<body class="wide">`) {
+		t.Errorf("preferences from cookie are not applied:\n%s", body)
+	}
+	if c := rec.Result().Cookies(); len(c) != 1 || c[0].Value != "width=wide" {
+		t.Errorf("got updated cookies %v, want width=wide value", c)
+	}
+}
+
+func TestTarGz(t *testing.T) {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, hdr := range []*tar.Header{
+		{Name: "./docs/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "./docs/page.md", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime, Size: 6},
+		{Name: "./docs/link.md", Typeflag: tar.TypeSymlink, Linkname: "page.md", ModTime: mtime},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size != 0 {
+			io.WriteString(tw, "# Page")
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "docs.tar.gz")
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := openTarGz(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(fsys, "docs/page.md"); err != nil || string(b) != "# Page" {
+		t.Errorf("got %q, %v, want %q", b, err, "# Page")
+	}
+	if st, err := fs.Stat(fsys, "docs/page.md"); err != nil || !st.ModTime().Equal(mtime) {
+		t.Errorf("got %v, %v, want modification time %v", st, err, mtime)
+	}
+	if _, err := fs.Stat(fsys, "docs/link.md"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("symlink is not skipped: %v", err)
+	}
+	defer func(n int64) { maxUnpackedSize = n }(maxUnpackedSize)
+	maxUnpackedSize = 5
+	if _, err := openTarGz(name); err == nil {
+		t.Error("archive larger than maxUnpackedSize is opened")
+	}
+}
+
+func TestSearchHighlight(t *testing.T) {
+	h := &mdHandler{withSearch: true, fsys: fstest.MapFS{
+		"a.md": {Data: []byte("# Alpha\n\n## Setup\n\nRun the well-known installer.")},
+	}}
+	h.textIndex = newTextIndex(h.fsys, h.excluded)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?q=well-known+installer", nil))
+	want := `<a href="a.md?hl=well-known%20installer#setup:~:text=well%2Dknown%20installer">`
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("search results do not contain %s:\n%s", want, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a.md?hl=installer", nil))
+	if !strings.Contains(rec.Body.String(), highlightScript) {
+		t.Error("page does not include highlight script")
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); !strings.Contains(csp, highlightScriptHash) {
+		t.Errorf("CSP %q does not allow highlight script", csp)
+	}
+}
+
+func TestSearchModes(t *testing.T) {
+	h := &mdHandler{withSearch: true, fsys: fstest.MapFS{
+		"a.md": {Data: []byte("# Alpha\n\nError code E1234 happened")},
+		"b.md": {Data: []byte("# Beta\n\nerror codes are listed here")},
+	}}
+	for _, tc := range []struct {
+		q, mode string
+		want    []string
+	}{
+		{"error code", "", []string{"a.md", "b.md"}},
+		{"error code", searchExact, []string{"b.md"}},
+		{"exact:Error code", searchLoose, []string{"a.md"}},
+		{`E\d{4}`, searchRegexp, []string{"a.md"}},
+		{`regexp:(?i)^error codes`, "", []string{"b.md"}},
+		{`regexp:exact:|E\d{4}`, "", []string{"a.md"}},
+	} {
+		mode, term := h.searchMode(tc.q, tc.mode)
+		index, err := h.search(context.Background(), language.English, term, mode, searchScope{})
+		if err != nil {
+			t.Fatalf("%q: %v", tc.q, err)
+		}
+		var got []string
+		for _, rec := range index {
+			got = append(got, rec.File)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q in %q mode: got %q, want %q", tc.q, tc.mode, got, tc.want)
+		}
+	}
+	for _, q := range []string{"a(b", strings.Repeat("a", maxRegexpLen+1)} {
+		if _, err := h.search(context.Background(), language.English, q, searchRegexp, searchScope{}); !errors.As(err, new(queryError)) {
+			t.Errorf("%.10q: got error %v, want queryError", q, err)
+		}
+	}
+}
+
+func TestSearchScope(t *testing.T) {
+	fsys := fstest.MapFS{
+		"deploy.md":      {Data: []byte("# Deploy\n\nhow to deploy")},
+		"ops/deploy.md":  {Data: []byte("---\ntags: [Runbook, prod]\n---\n# Deploy\n\nhow to deploy")},
+		"ops/notes.md":   {Data: []byte("# Notes\n\ndeploy notes")},
+		"opsx/deploy.md": {Data: []byte("---\ntags: [runbook]\n---\n# Deploy\n\nhow to deploy")},
+	}
+	for _, withIndex := range []bool{false, true} {
+		h := &mdHandler{withSearch: true, fsys: fsys}
+		if withIndex {
+			h.textIndex = newTextIndex(h.fsys, h.excluded)
+		}
+		for query, want := range map[string][]string{
+			"path=ops/":              {"ops/deploy.md", "ops/notes.md"},
+			"path=/ops&tag=runbook":  {"ops/deploy.md"},
+			"tag=runbook":            {"ops/deploy.md", "opsx/deploy.md"},
+			"tag=runbook&tag=stage":  nil,
+			"path=ops/../deploy.md/": {"deploy.md", "ops/deploy.md", "ops/notes.md", "opsx/deploy.md"},
+		} {
+			q, _ := url.ParseQuery(query)
+			index, err := h.search(context.Background(), language.English, "deploy", searchLoose, readSearchScope(q))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, rec := range index {
+				got = append(got, rec.File)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s (text index: %t): got %q, want %q", query, withIndex, got, want)
+			}
+		}
+	}
+}
+
 func init() { testRun = true }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// mathPath is a path prefix KaTeX files are served under when run with -math
+// flag
+const mathPath = "/.katex/"
+
+// mathScript is embedded into pages with math formulas when run with -math
+// flag. It typesets formulas rendered by the parser as spans with the
+// formula wrapped into \( \) or \[ \] delimiters.
+const mathScript = `document.addEventListener("DOMContentLoaded", function() {
+	document.querySelectorAll("span.math").forEach(function(el) {
+		katex.render(el.textContent.slice(2, -2), el, {
+			displayMode: el.classList.contains("display"),
+			throwOnError: false
+		});
+	});
+});`
+
+var mathScriptHash = styleHash(mathScript)
+
+// mathMarker is how rendered math formulas start
+const mathMarker = `<span class="math `
+
+// newMathHandler returns handler serving KaTeX distribution files from dir
+// under mathPath. It checks that dir has files pages refer to.
+func newMathHandler(dir string) (http.Handler, error) {
+	for _, name := range []string{"katex.min.js", "katex.min.css"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	return http.StripPrefix(mathPath, http.FileServer(http.Dir(dir))), nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// mermaidScript is embedded into pages with mermaid code blocks when run with
+// -mermaid flag. It replaces such code blocks with elements mermaid.js
+// renders diagrams into; this runs before highlight.js handles code blocks.
+const mermaidScript = `document.addEventListener("DOMContentLoaded", function() {
+	document.querySelectorAll("pre > code.language-mermaid").forEach(function(code) {
+		var div = document.createElement("div");
+		div.className = "mermaid";
+		div.textContent = code.textContent;
+		code.parentNode.replaceWith(div);
+	});
+	mermaid.initialize({startOnLoad: false});
+	mermaid.init(undefined, "div.mermaid");
+});`
+
+var mermaidScriptHash = styleHash(mermaidScript)
+
+// mermaidMarker is how rendered mermaid code blocks start
+const mermaidMarker = `<pre><code class="language-mermaid">`
+
+// scriptSource returns Content-Security-Policy source expression matching
+// script url src: 'self' for relative urls, and url without query otherwise
+func scriptSource(src string) (string, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" && u.Host == "" {
+		return "'self'", nil
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+	// CSP sources can't have query or fragment, and must escape ";" and ","
+	p := strings.NewReplacer(";", "%3B", ",", "%2C").Replace(u.EscapedPath())
+	return u.Scheme + "://" + u.Host + p, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsPath is the path metrics are exposed at when run with -metrics flag
+const metricsPath = "/metrics"
+
+// metrics is a middleware collecting basic request statistics and exposing
+// them along with number of markdown files at metricsPath in Prometheus text
+// format.
+type metrics struct {
+	next http.Handler
+	h    *mdHandler // used to count markdown files on scrape
+
+	requests [6]uint64 // request counters by status class: 1xx at index 1, etc.
+
+	mu        sync.Mutex
+	durations [len(durationBuckets)]uint64 // cumulative histogram buckets
+	durSum    float64                      // sum of observed durations, in seconds
+	durCount  uint64
+}
+
+// durationBuckets are upper bounds of request duration histogram buckets, in
+// seconds
+var durationBuckets = [...]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func newMetrics(h *mdHandler, next http.Handler) *metrics {
+	return &metrics{h: h, next: next}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case metricsPath:
+		m.writeMetrics(w, r)
+		return
+	case healthPath, watchPath:
+		m.next.ServeHTTP(w, r)
+		return
+	}
+	begin := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	m.next.ServeHTTP(sw, r)
+	m.observe(sw.status, time.Since(begin))
+}
+
+func (m *metrics) observe(status int, d time.Duration) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if class := status / 100; class > 0 && class < len(m.requests) {
+		atomic.AddUint64(&m.requests[class], 1)
+	}
+	sec := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, le := range durationBuckets {
+		if sec <= le {
+			m.durations[i]++
+		}
+	}
+	m.durSum += sec
+	m.durCount++
+}
+
+func (m *metrics) writeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP mdserver_http_requests_total Number of served http requests by status class.")
+	fmt.Fprintln(w, "# TYPE mdserver_http_requests_total counter")
+	for class := 1; class < len(m.requests); class++ {
+		fmt.Fprintf(w, "mdserver_http_requests_total{code=\"%dxx\"} %d\n", class, atomic.LoadUint64(&m.requests[class]))
+	}
+	m.mu.Lock()
+	durations, durSum, durCount := m.durations, m.durSum, m.durCount
+	m.mu.Unlock()
+	fmt.Fprintln(w, "# HELP mdserver_http_request_duration_seconds Duration of served http requests.")
+	fmt.Fprintln(w, "# TYPE mdserver_http_request_duration_seconds histogram")
+	for i, le := range durationBuckets {
+		fmt.Fprintf(w, "mdserver_http_request_duration_seconds_bucket{le=\"%g\"} %d\n", le, durations[i])
+	}
+	fmt.Fprintf(w, "mdserver_http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", durCount)
+	fmt.Fprintf(w, "mdserver_http_request_duration_seconds_sum %g\n", durSum)
+	fmt.Fprintf(w, "mdserver_http_request_duration_seconds_count %d\n", durCount)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if files, err := markdownFiles(ctx, m.h.files(), ".", m.h.unlisted); err == nil {
+		fmt.Fprintln(w, "# HELP mdserver_markdown_files Number of markdown files listed in index.")
+		fmt.Fprintln(w, "# TYPE mdserver_markdown_files gauge")
+		fmt.Fprintf(w, "mdserver_markdown_files %d\n", len(files))
+	}
+}
+
+// statusWriter is a http.ResponseWriter recording response status code
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mount is a directory served under /name/ URL prefix
+type mount struct {
+	name, dir string
+}
+
+// mountFS is a file system with mounted directories at its root
+type mountFS []mount
+
+// parseMounts parses comma-separated list of name=path pairs
+func parseMounts(s string) (mountFS, error) {
+	var m mountFS
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not in name=path form", pair)
+		}
+		name, dir := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if name == "" || strings.HasPrefix(name, ".") || !fs.ValidPath(name) || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid mount name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate mount name %q", name)
+		}
+		seen[name] = true
+		if st, err := os.Stat(dir); err != nil {
+			return nil, err
+		} else if !st.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		m = append(m, mount{name: name, dir: dir})
+	}
+	sort.Slice(m, func(i, j int) bool { return m[i].name < m[j].name })
+	return m, nil
+}
+
+// resolve returns directory of mount name belongs to and name relative to
+// it. It returns false if name is not inside any mount.
+func (m mountFS) resolve(name string) (dir, rel string, ok bool) {
+	parts := strings.SplitN(name, "/", 2)
+	for _, mt := range m {
+		if mt.name != parts[0] {
+			continue
+		}
+		if len(parts) == 1 {
+			return mt.dir, ".", true
+		}
+		return mt.dir, parts[1], true
+	}
+	return "", "", false
+}
+
+func (m mountFS) dirs() []string {
+	out := make([]string, len(m))
+	for i, mt := range m {
+		out[i] = mt.dir
+	}
+	return out
+}
+
+func (m mountFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &mountRoot{m: m}, nil
+	}
+	dir, rel, ok := m.resolve(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	f, err := os.DirFS(dir).Open(rel)
+	if err != nil || rel != "." {
+		return f, err
+	}
+	if d, ok := f.(fs.ReadDirFile); ok {
+		return &mountDir{ReadDirFile: d, name: name}, nil
+	}
+	return f, nil
+}
+
+// Stat implements fs.StatFS, reporting mount point directories under their
+// mount names rather than names of mounted directories
+func (m mountFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return rootInfo{}, nil
+	}
+	dir, rel, ok := m.resolve(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	st, err := fs.Stat(os.DirFS(dir), rel)
+	if err != nil || rel != "." {
+		return st, err
+	}
+	return renamedInfo{FileInfo: st, name: name}, nil
+}
+
+// renamedInfo describes mount point directory, it implements both
+// fs.FileInfo and fs.DirEntry
+type renamedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i renamedInfo) Name() string               { return i.name }
+func (i renamedInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i renamedInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+// mountDir is a mounted directory reporting mount name as its name
+type mountDir struct {
+	fs.ReadDirFile
+	name string
+}
+
+func (d *mountDir) Stat() (fs.FileInfo, error) {
+	st, err := d.ReadDirFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return renamedInfo{FileInfo: st, name: d.name}, nil
+}
+
+// mountRoot is a root directory of mountFS listing its mounts
+type mountRoot struct {
+	m   mountFS
+	off int // number of entries already returned by ReadDir
+}
+
+func (d *mountRoot) Stat() (fs.FileInfo, error) { return rootInfo{}, nil }
+func (d *mountRoot) Close() error               { return nil }
+
+func (d *mountRoot) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: fs.ErrInvalid}
+}
+
+func (d *mountRoot) ReadDir(n int) ([]fs.DirEntry, error) {
+	var out []fs.DirEntry
+	for ; d.off < len(d.m) && (n <= 0 || len(out) < n); d.off++ {
+		if st, err := d.m.Stat(d.m[d.off].name); err == nil {
+			out = append(out, st.(renamedInfo))
+		}
+	}
+	if n > 0 && len(out) == 0 {
+		return nil, io.EOF
+	}
+	return out, nil
+}
+
+// rootInfo describes root directory of mountFS
+type rootInfo struct{}
+
+func (rootInfo) Name() string       { return "." }
+func (rootInfo) Size() int64        { return 0 }
+func (rootInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (rootInfo) ModTime() time.Time { return startTime }
+func (rootInfo) IsDir() bool        { return true }
+func (rootInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+)
+
+// openSearchPath is a path of OpenSearch description document, served when
+// search is enabled, so browsers can add mdserver search to their search
+// engines
+const openSearchPath = "/opensearch.xml"
+
+type openSearchDescription struct {
+	XMLName       xml.Name      `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string        `xml:"ShortName"`
+	Description   string        `xml:"Description"`
+	InputEncoding string        `xml:"InputEncoding"`
+	URL           openSearchURL `xml:"Url"`
+}
+
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Method   string `xml:"method,attr"`
+	Template string `xml:"template,attr"`
+}
+
+// serveOpenSearch serves OpenSearch description of search done by index
+// page
+func (h *mdHandler) serveOpenSearch(w http.ResponseWriter, r *http.Request) {
+	base := h.baseURL(r)
+	desc := openSearchDescription{
+		ShortName:     "mdserver",
+		Description:   "Search documents on " + base.Host,
+		InputEncoding: "UTF-8",
+		URL: openSearchURL{
+			Type:   "text/html",
+			Method: "get",
+			// appended to url string, as url.URL would escape template braces
+			Template: base.String() + "?q={searchTerms}",
+		},
+	}
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(desc); err != nil {
+		log.Printf("opensearch: %v", err)
+	}
+}
+
+// searchKeyScript is embedded into index pages with search form, it focuses
+// search input when "/" key is pressed outside of other inputs
+const searchKeyScript = `document.addEventListener("keydown", function(e) {
+	if (e.key !== "/" || e.ctrlKey || e.metaKey || e.altKey) return;
+	var t = e.target;
+	if (t.isContentEditable || /^(INPUT|TEXTAREA|SELECT)$/.test(t.tagName)) return;
+	var q = document.querySelector("input[name=q]");
+	if (!q) return;
+	e.preventDefault();
+	q.focus();
+	q.select();
+});`
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pdfConverter is a command line of external program which reads HTML page
+// from stdin and writes PDF document to stdout, like "wkhtmltopdf - -"
+type pdfConverter []string
+
+// pdfTimeout limits how long single conversion may take
+const pdfTimeout = time.Minute
+
+// pdfSlots limits number of converter processes running at once
+var pdfSlots = make(chan struct{}, 2)
+
+func (c pdfConverter) convert(ctx context.Context, page []byte) ([]byte, error) {
+	return runFilter(ctx, c, pdfTimeout, page)
+}
+
+// printPage renders printable page of markdown file name, with base URL set
+// to baseHref if it's not empty, so converter can resolve relative links and
+// images
+func (h *mdHandler) printPage(name, urlPath, baseHref string) ([]byte, error) {
+	rc, _, err := h.readerForFile(name)
+	if err != nil {
+		return nil, err
+	}
+	rc.print, rc.urlPath = true, urlPath
+	page, err := ioutil.ReadAll(rc)
+	if err != nil || baseHref == "" {
+		return page, err
+	}
+	base := `<head><base href="` + html.EscapeString(baseHref) + `">`
+	return bytes.Replace(page, []byte("<head>"), []byte(base), 1), nil
+}
+
+// servePDF responds with markdown file name converted to PDF. Converter
+// resolves relative links and images against address request came to, as
+// Host header is given by client.
+func (h *mdHandler) servePDF(w http.ResponseWriter, r *http.Request, name string) {
+	var baseHref string
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		base := &url.URL{Scheme: "http", Host: addr.String(), Path: r.URL.Path}
+		if r.TLS != nil {
+			base.Scheme = "https"
+		}
+		baseHref = base.String()
+	}
+	select {
+	case pdfSlots <- struct{}{}:
+		defer func() { <-pdfSlots }()
+	case <-r.Context().Done():
+		return
+	}
+	page, err := h.printPage(name, path.Clean(r.URL.Path), baseHref)
+	if err == errTooLarge {
+		h.tooLarge(w)
+		return
+	}
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err == nil {
+		page, err = h.pdf.convert(r.Context(), page)
+	}
+	if err != nil {
+		log.Printf("pdf %q: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("inline; filename=%q", strings.TrimSuffix(path.Base(name), mdSuffix)+".pdf"))
+	w.Write(page)
+}
+
+// exportPDF converts all markdown files into PDF files in outdir, keeping
+// directory structure
+func (h *mdHandler) exportPDF(outdir string) error {
+	// pages are converted offline, features requiring server are disabled
+	h.withSearch, h.watch = false, nil
+	files, err := markdownFiles(context.Background(), h.files(), ".", h.unlisted)
+	if err != nil {
+		return err
+	}
+	var baseDir string
+	if h.fsys == nil {
+		if baseDir, err = filepath.Abs(h.dir); err != nil {
+			return err
+		}
+	}
+	for _, name := range files {
+		var base string
+		if baseDir != "" {
+			base = (&url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(baseDir, filepath.FromSlash(name)))}).String()
+		}
+		page, err := h.printPage(name, "/"+name, base)
+		if err == errTooLarge {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if page, err = h.pdf.convert(context.Background(), page); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		dst := filepath.Join(outdir, filepath.FromSlash(strings.TrimSuffix(name, mdSuffix)+".pdf"))
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(dst, page, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// apiFile describes document in /api/files response
+type apiFile struct {
+	Path  string `json:"path"`
+	Title string `json:"title"`
+}
+
+// serveAPIFiles responds with names and titles of all documents, including
+// ones rendered with -convert, which quick-open dialog matches against
+func (h *mdHandler) serveAPIFiles(w http.ResponseWriter, r *http.Request) {
+	index, err := dirIndex(r.Context(), h.files(), ".", nil, h.unlisted)
+	if err != nil {
+		apiError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	index = append(index, h.convertedIndex(r.Context(), ".")...)
+	files := make([]apiFile, 0, len(index))
+	for _, rec := range index {
+		files = append(files, apiFile{Path: rec.File, Title: rec.Title})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	writeJSON(w, files)
+}
+
+// quickOpenScript is embedded into pages when run with -quickopen. On Ctrl+K
+// (⌘K on macOS) it shows dialog listing documents from /api/files which
+// names or titles fuzzy match typed text.
+const quickOpenScript = `(function() {
+	var files, box, input, list, sel = 0;
+	function score(q, s) {
+		s = s.toLowerCase();
+		var j = 0, total = 0, prev = -2;
+		for (var i = 0; i < s.length && j < q.length; i++) {
+			if (s[i] !== q[j]) continue;
+			total += i === prev + 1 ? 3 : 1;
+			if (i === 0 || " /-_.".indexOf(s[i - 1]) >= 0) total += 2;
+			prev = i; j++;
+		}
+		return j < q.length ? -1 : total - s.length / 1000;
+	}
+	function update() {
+		var q = input.value.toLowerCase().replace(/\s+/g, ""), found = [];
+		(files || []).forEach(function(f) {
+			var s = Math.max(score(q, f.title), score(q, f.path));
+			if (s >= 0) found.push({f: f, s: s});
+		});
+		found.sort(function(a, b) { return b.s - a.s || (a.f.path < b.f.path ? -1 : 1); });
+		list.textContent = "";
+		found.slice(0, 20).forEach(function(m, i) {
+			var li = document.createElement("li"), a = document.createElement("a");
+			a.href = "/" + m.f.path.split("/").map(encodeURIComponent).join("/");
+			a.textContent = m.f.title;
+			var small = document.createElement("small");
+			small.textContent = " " + m.f.path;
+			a.appendChild(small);
+			li.appendChild(a);
+			list.appendChild(li);
+		});
+		select(0);
+	}
+	function select(i) {
+		var items = list.children;
+		if (!items.length) return;
+		sel = (i + items.length) % items.length;
+		for (var k = 0; k < items.length; k++) items[k].classList.toggle("selected", k === sel);
+		items[sel].scrollIntoView({block: "nearest"});
+	}
+	function open() {
+		if (!box) {
+			box = document.createElement("div");
+			box.id = "quickopen";
+			input = document.createElement("input");
+			input.type = "search";
+			input.placeholder = "Go to document";
+			list = document.createElement("ul");
+			box.appendChild(input);
+			box.appendChild(list);
+			document.body.appendChild(box);
+			input.addEventListener("input", update);
+			input.addEventListener("keydown", function(e) {
+				if (e.key === "ArrowDown" || e.key === "ArrowUp") {
+					e.preventDefault();
+					select(sel + (e.key === "ArrowDown" ? 1 : -1));
+				} else if (e.key === "Enter") {
+					var a = list.children[sel] && list.children[sel].querySelector("a");
+					if (a) location.href = a.href;
+				} else if (e.key === "Escape") {
+					box.hidden = true;
+				}
+			});
+			box.addEventListener("focusout", function(e) {
+				if (!box.contains(e.relatedTarget)) box.hidden = true;
+			});
+		}
+		box.hidden = false;
+		input.select();
+		input.focus();
+		if (!files) fetch("/api/files").then(function(r) { return r.json(); }).then(function(f) {
+			files = f;
+			update();
+		});
+		else update();
+	}
+	document.addEventListener("keydown", function(e) {
+		if (e.key === "k" && (e.ctrlKey || e.metaKey) && !e.altKey) {
+			e.preventDefault();
+			open();
+		}
+	});
+})();`
+
+var quickOpenScriptHash = styleHash(quickOpenScript)
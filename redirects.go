@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redirectsFileName is a name of file in served directory mapping old paths
+// of moved or renamed documents to the new ones, one "old new" pair per line
+const redirectsFileName = ".mdredirects"
+
+// redirectMap keeps paths which requests are redirected from, collected from
+// redirects file and "aliases" front matter fields of markdown documents.
+// It's updated on access, at most once per redirectsInterval unless
+// invalidated earlier.
+type redirectMap struct {
+	h *mdHandler
+
+	mu      sync.Mutex
+	docs    map[string]*aliasedDoc // markdown file -> its aliases
+	file    aliasedDoc             // redirects file, aliases are "old new" pairs
+	updated time.Time              // when map was last refreshed, zero if invalidated
+	targets map[string]string      // old path, see redirectKey -> new url
+}
+
+type aliasedDoc struct {
+	mtime   time.Time
+	size    int64
+	aliases []string
+}
+
+// redirectsInterval is how long redirect map is considered fresh
+const redirectsInterval = 10 * time.Second
+
+func newRedirectMap(h *mdHandler) *redirectMap {
+	return &redirectMap{h: h, docs: make(map[string]*aliasedDoc)}
+}
+
+// lookup returns url request to urlPath should be redirected to
+func (m *redirectMap) lookup(ctx context.Context, urlPath string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.refresh(ctx); err != nil {
+		log.Printf("redirects: %v", err)
+	}
+	dst, ok := m.targets[redirectKey(urlPath)]
+	return dst, ok
+}
+
+// invalidate makes the next lookup refresh map
+func (m *redirectMap) invalidate() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updated = time.Time{}
+}
+
+// refresh rereads redirects file and front matter of new and modified
+// markdown files, unless map was refreshed recently. Must be called with
+// m.mu held.
+func (m *redirectMap) refresh(ctx context.Context) error {
+	if !m.updated.IsZero() && time.Since(m.updated) < redirectsInterval {
+		return nil
+	}
+	fsys := m.h.files()
+	files, err := markdownFiles(ctx, fsys, ".", m.h.unlisted)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]struct{}, len(files))
+	for _, name := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		known[name] = struct{}{}
+		st, err := fs.Stat(fsys, name)
+		if err != nil {
+			delete(m.docs, name)
+			continue
+		}
+		if d, ok := m.docs[name]; ok && d.mtime.Equal(st.ModTime()) && d.size == st.Size() {
+			continue
+		}
+		d := &aliasedDoc{mtime: st.ModTime(), size: st.Size()}
+		if b, err := fs.ReadFile(fsys, name); err == nil {
+			fm, _ := splitFrontMatter(b)
+			d.aliases = fm.Aliases
+		}
+		m.docs[name] = d
+	}
+	for name := range m.docs {
+		if _, ok := known[name]; !ok {
+			delete(m.docs, name)
+		}
+	}
+	if st, err := fs.Stat(fsys, redirectsFileName); err != nil {
+		m.file = aliasedDoc{}
+	} else if !st.ModTime().Equal(m.file.mtime) || st.Size() != m.file.size {
+		m.file = aliasedDoc{mtime: st.ModTime(), size: st.Size()}
+		if f, err := fsys.Open(redirectsFileName); err == nil {
+			m.file.aliases = parseRedirects(f)
+			f.Close()
+		}
+	}
+	targets := make(map[string]string)
+	for name, d := range m.docs {
+		for _, alias := range d.aliases {
+			if !path.IsAbs(alias) {
+				alias = path.Join("/", path.Dir(name), alias)
+			}
+			targets[redirectKey(alias)] = (&url.URL{Path: "/" + name}).String()
+		}
+	}
+	// explicitly listed redirects take precedence over aliases
+	for i := 0; i+1 < len(m.file.aliases); i += 2 {
+		targets[redirectKey(m.file.aliases[i])] = m.file.aliases[i+1]
+	}
+	m.targets, m.updated = targets, time.Now()
+	return nil
+}
+
+// parseRedirects reads redirects file, returning flat list of old path and
+// new url pairs. Empty lines and lines starting with "#" are skipped. Old
+// paths are relative to served directory, new urls may be absolute paths
+// within it, or urls of other sites.
+func parseRedirects(r io.Reader) []string {
+	var out []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			log.Printf("redirects file: skipping invalid line %q", sc.Text())
+			continue
+		}
+		from, to := fields[0], fields[1]
+		if u, err := url.Parse(to); err == nil && u.Scheme == "" && u.Host == "" && !path.IsAbs(u.Path) {
+			to = "/" + to
+		}
+		out = append(out, path.Join("/", from), to)
+	}
+	return out
+}
+
+// redirectKey normalizes slash separated path for lookup: it's cleaned, made
+// absolute, and has .md suffix removed, so "/old" and "old.md" are the same
+func redirectKey(p string) string {
+	return strings.TrimSuffix(path.Clean("/"+p), mdSuffix)
+}
+
+// serveRedirect redirects request for missing file to its new location, if
+// file was renamed or moved as recorded by redirects file or aliases of
+// documents. It reports whether request was handled.
+func (h *mdHandler) serveRedirect(w http.ResponseWriter, r *http.Request) bool {
+	if h.redirects == nil {
+		return false
+	}
+	dst, ok := h.redirects.lookup(r.Context(), r.URL.Path)
+	if !ok || redirectKey(dst) == redirectKey(r.URL.Path) {
+		return false
+	}
+	if u, err := url.Parse(dst); err == nil && u.RawQuery == "" && u.Host == "" {
+		u.RawQuery = r.URL.RawQuery
+		dst = u.String()
+	}
+	http.Redirect(w, r, dst, http.StatusMovedPermanently)
+	return true
+}
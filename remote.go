@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// remoteDir returns directory in user cache directory where git repository
+// with given url is cloned to
+func remoteDir(url string) (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return -1
+	}, strings.TrimSuffix(path.Base(strings.TrimRight(url, "/")), ".git"))
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(cache, "mdserver", strings.TrimLeft(name, ".")+"-"+hex.EncodeToString(sum[:6])), nil
+}
+
+// cloneRemote clones git repository url into cache directory, or updates it
+// if it was cloned before, and returns its path
+func cloneRemote(url string) (string, error) {
+	dir, err := remoteDir(url)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		g := &gitRepo{dir: dir}
+		if _, err := g.run(context.Background(), "pull", "--ff-only", "--quiet"); err != nil {
+			log.Printf("updating %s: %v, serving copy cloned earlier", url, err)
+		}
+		return dir, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0777); err != nil {
+		return "", err
+	}
+	// clone into temporary directory, so that interrupted clone is never
+	// mistaken for complete one
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), ".clone-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	log.Printf("cloning %s into %s", url, dir)
+	cmd := exec.Command("git", "clone", "--quiet", "--", url, tmp)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git clone: %v", err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
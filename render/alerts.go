@@ -0,0 +1,78 @@
+package render
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// alertPattern matches marker starting GitHub alert blockquote, like
+// "[!NOTE]", optionally followed by alert title on the same line
+var alertPattern = regexp.MustCompile(`(?i)^\[!(note|tip|important|warning|caution)\][ \t]*([^\n]*)(\n|$)`)
+
+// alertClass is a class of asides alert blockquotes are rendered as, they
+// also have "alert-note" style class of alert type
+const alertClass = "alert"
+
+// alertTitleClass is a class of paragraph with alert title
+const alertTitleClass = "alert-title"
+
+// alerts replaces blockquotes of doc starting with "[!NOTE]", "[!TIP]",
+// "[!IMPORTANT]", "[!WARNING]" or "[!CAUTION]" markers with <aside> elements
+// having alert classes and title paragraph, as GitHub does. Text following
+// marker on the same line is used as title instead of alert type.
+func alerts(doc ast.Node) {
+	var quotes []*ast.BlockQuote
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if q, ok := node.(*ast.BlockQuote); ok && entering {
+			quotes = append(quotes, q)
+		}
+		return ast.GoToNext
+	})
+	for _, q := range quotes {
+		if len(q.Children) == 0 {
+			continue
+		}
+		para, ok := q.Children[0].(*ast.Paragraph)
+		if !ok || len(para.Children) == 0 {
+			continue
+		}
+		text, ok := para.Children[0].(*ast.Text)
+		if !ok {
+			continue
+		}
+		m := alertPattern.FindSubmatch(text.Literal)
+		if m == nil {
+			continue
+		}
+		kind := strings.ToLower(string(m[1]))
+		title := string(bytes.TrimSpace(m[2]))
+		if title == "" {
+			title = strings.ToUpper(kind[:1]) + kind[1:]
+		}
+		text.Literal = text.Literal[len(m[0]):]
+		children := q.Children
+		if len(text.Literal) == 0 && len(para.Children) == 1 {
+			children = children[1:]
+		}
+		titlePara := &ast.Paragraph{}
+		titlePara.Attribute = &ast.Attribute{Classes: [][]byte{[]byte(alertTitleClass)}}
+		ast.AppendChild(titlePara, &ast.Text{Leaf: ast.Leaf{Literal: []byte(title)}})
+		aside := &ast.Aside{}
+		aside.Attribute = &ast.Attribute{Classes: [][]byte{[]byte(alertClass + " " + alertClass + "-" + kind)}}
+		aside.SetParent(q.Parent)
+		titlePara.SetParent(aside)
+		aside.Children = append([]ast.Node{titlePara}, children...)
+		for _, child := range children {
+			child.SetParent(aside)
+		}
+		siblings := q.Parent.GetChildren()
+		for i := range siblings {
+			if siblings[i] == q {
+				siblings[i] = aside
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package render
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+)
+
+// githubHeadingIDs sets ids of doc headings which have none to slugs of their
+// text, see githubSlug
+func githubHeadingIDs(doc ast.Node) {
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if h, ok := node.(*ast.Heading); ok && entering {
+			if h.HeadingID == "" {
+				h.HeadingID = githubSlug(headingText(h))
+			}
+			return ast.SkipChildren
+		}
+		return ast.GoToNext
+	})
+}
+
+// githubSlug returns anchor GitHub gives to heading with given text: it's
+// lowercased, has everything except letters, numbers, spaces, hyphens and
+// underscores removed, and spaces replaced with hyphens.
+func githubSlug(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == ' ':
+			return '-'
+		case r == '-', r == '_', unicode.IsLetter(r), unicode.IsNumber(r), unicode.IsMark(r):
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, strings.TrimSpace(text))
+}
+
+// headingText returns text of heading without markup
+func headingText(h *ast.Heading) string {
+	var text []byte
+	ast.WalkFunc(h, func(node ast.Node, entering bool) ast.WalkStatus {
+		if _, ok := node.(*ast.HTMLSpan); !ok && entering && node.AsLeaf() != nil {
+			text = append(text, node.AsLeaf().Literal...)
+		}
+		return ast.GoToNext
+	})
+	return string(text)
+}
+
+// anchorClass is a class of links added to headings with
+// Options.HeadingAnchors
+const anchorClass = "anchor"
+
+// headingAnchors returns html.RenderNodeFunc adding "¶" links to headings
+// of doc, pointing to headings themselves
+func headingAnchors(doc ast.Node) html.RenderNodeFunc {
+	ids := make(map[*ast.Heading]string)
+	walkHeadings(doc, func(h *ast.Heading, id string) { ids[h] = id })
+	return func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+		h, ok := node.(*ast.Heading)
+		if !ok || entering {
+			return ast.GoToNext, false
+		}
+		if id := ids[h]; id != "" {
+			fmt.Fprintf(w, ` <a class="%s" href="#`, anchorClass)
+			html.EscapeHTML(w, []byte(id))
+			io.WriteString(w, `">¶</a>`)
+		}
+		return ast.GoToNext, false
+	}
+}
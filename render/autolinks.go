@@ -0,0 +1,95 @@
+package render
+
+import (
+	"bytes"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// autolinkPattern matches bare www addresses, email addresses and @mentions
+// in text, see splitAutolinks
+var autolinkPattern = regexp.MustCompile(`(?i)\bwww\.[a-z0-9_-]+(?:\.[a-z0-9_-]+)+[^\s<]*` +
+	`|[a-z0-9._+-]+@[a-z0-9_-]+(?:\.[a-z0-9_-]+)*\.[a-z]+` +
+	`|@[a-z0-9](?:[a-z0-9]|-[a-z0-9]){0,38}\b`)
+
+// autolinks replaces "@username" mentions in text nodes of doc with links to
+// destinations mention returns for user names, if it's not nil. If urls is
+// true, it also replaces bare "www.example.com" addresses and email
+// addresses with links to them, as GitHub does.
+func autolinks(doc ast.Node, urls bool, mention func(user string) string) {
+	replaceText(doc, func(text []byte) []ast.Node {
+		return splitAutolinks(text, urls, mention)
+	})
+}
+
+// splitAutolinks splits text into text and link nodes, it returns nil if text
+// has no links
+func splitAutolinks(text []byte, urls bool, mention func(user string) string) []ast.Node {
+	if !bytes.Contains(text, []byte("www.")) && bytes.IndexByte(text, '@') < 0 {
+		return nil
+	}
+	var nodes []ast.Node
+	last := 0 // end of text already added to nodes
+	for _, m := range autolinkPattern.FindAllIndex(text, -1) {
+		start, end := m[0], m[1]
+		if start > 0 {
+			if r, _ := utf8.DecodeLastRune(text[:start]); unicode.IsLetter(r) || unicode.IsNumber(r) ||
+				r == '@' || r == '.' || r == '/' {
+				continue
+			}
+		}
+		var dst string
+		switch s := text[start:end]; {
+		case s[0] == '@':
+			if mention != nil {
+				dst = mention(string(s[1:]))
+			}
+		case !urls:
+		case bytes.IndexByte(s, '@') > 0:
+			dst = "mailto:" + string(s)
+		default:
+			end = start + trimURL(s)
+			dst = "http://" + string(text[start:end])
+		}
+		if dst == "" {
+			continue
+		}
+		if start > last {
+			nodes = append(nodes, &ast.Text{Leaf: ast.Leaf{Literal: text[last:start]}})
+		}
+		link := &ast.Link{Destination: []byte(dst)}
+		ast.AppendChild(link, &ast.Text{Leaf: ast.Leaf{Literal: text[start:end]}})
+		nodes = append(nodes, link)
+		last = end
+	}
+	if nodes == nil {
+		return nil
+	}
+	if last < len(text) {
+		nodes = append(nodes, &ast.Text{Leaf: ast.Leaf{Literal: text[last:]}})
+	}
+	return nodes
+}
+
+// trimURL returns length of url without trailing punctuation and unbalanced
+// closing parentheses, which are not considered part of it
+func trimURL(url []byte) int {
+	n := len(url)
+	for n > 0 {
+		switch url[n-1] {
+		case '?', '!', '.', ',', ':', '*', '_', '~', '\'', '"':
+			n--
+			continue
+		case ')':
+			if bytes.Count(url[:n], []byte("(")) < bytes.Count(url[:n], []byte(")")) {
+				n--
+				continue
+			}
+		}
+		break
+	}
+	return n
+}
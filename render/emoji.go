@@ -0,0 +1,269 @@
+package render
+
+import (
+	"bytes"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// emojiShortcodes replaces :shortcode: emoji codes in text nodes of doc with
+// emoji characters
+func emojiShortcodes(doc ast.Node) {
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch n := node.(type) {
+		case *ast.CodeBlock, *ast.Code, *ast.HTMLBlock:
+			return ast.SkipChildren
+		case *ast.Text:
+			if entering && bytes.Count(n.Literal, []byte(":")) > 1 {
+				n.Literal = replaceEmoji(n.Literal)
+			}
+		}
+		return ast.GoToNext
+	})
+}
+
+// replaceEmoji returns text with known :shortcode: codes replaced
+func replaceEmoji(text []byte) []byte {
+	var out []byte
+	last := 0 // end of text already copied to out
+	for i := 0; i < len(text); i++ {
+		if text[i] != ':' {
+			continue
+		}
+		j := i + 1
+		for j < len(text) && isShortcodeByte(text[j]) {
+			j++
+		}
+		if j == i+1 || j == len(text) || text[j] != ':' {
+			continue
+		}
+		e, ok := emoji[string(text[i+1:j])]
+		if !ok {
+			// closing colon may start another shortcode
+			i = j - 1
+			continue
+		}
+		out = append(append(out, text[last:i]...), e...)
+		last = j + 1
+		i = j
+	}
+	if out == nil {
+		return text
+	}
+	return append(out, text[last:]...)
+}
+
+func isShortcodeByte(b byte) bool {
+	return 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '_' || b == '+' || b == '-'
+}
+
+// emoji maps commonly used GitHub emoji shortcodes to emoji
+var emoji = map[string]string{
+	"+1":                           "👍",
+	"-1":                           "👎",
+	"100":                          "💯",
+	"alarm_clock":                  "⏰",
+	"angry":                        "😠",
+	"apple":                        "🍎",
+	"arrow_down":                   "⬇️",
+	"arrow_left":                   "⬅️",
+	"arrow_right":                  "➡️",
+	"arrow_up":                     "⬆️",
+	"art":                          "🎨",
+	"astonished":                   "😲",
+	"baby":                         "👶",
+	"balloon":                      "🎈",
+	"bangbang":                     "‼️",
+	"beer":                         "🍺",
+	"beers":                        "🍻",
+	"beetle":                       "🐞",
+	"bell":                         "🔔",
+	"bike":                         "🚲",
+	"blue_heart":                   "💙",
+	"blush":                        "😊",
+	"bomb":                         "💣",
+	"book":                         "📖",
+	"bookmark":                     "🔖",
+	"books":                        "📚",
+	"boom":                         "💥",
+	"bowtie":                       "👔",
+	"broken_heart":                 "💔",
+	"bug":                          "🐛",
+	"bulb":                         "💡",
+	"bust_in_silhouette":           "👤",
+	"busts_in_silhouette":          "👥",
+	"cake":                         "🍰",
+	"calendar":                     "📆",
+	"camera":                       "📷",
+	"cat":                          "🐱",
+	"chart_with_downwards_trend":   "📉",
+	"chart_with_upwards_trend":     "📈",
+	"checkered_flag":               "🏁",
+	"clap":                         "👏",
+	"clipboard":                    "📋",
+	"clock":                        "🕐",
+	"closed_lock_with_key":         "🔐",
+	"cloud":                        "☁️",
+	"coffee":                       "☕",
+	"cold_sweat":                   "😰",
+	"computer":                     "💻",
+	"confused":                     "😕",
+	"construction":                 "🚧",
+	"cool":                         "🆒",
+	"copyright":                    "©️",
+	"crossed_fingers":              "🤞",
+	"cry":                          "😢",
+	"crying_cat_face":              "😿",
+	"dart":                         "🎯",
+	"dash":                         "💨",
+	"disappointed":                 "😞",
+	"dizzy":                        "💫",
+	"dog":                          "🐶",
+	"dollar":                       "💵",
+	"door":                         "🚪",
+	"eyes":                         "👀",
+	"email":                        "📧",
+	"exclamation":                  "❗",
+	"expressionless":               "😑",
+	"facepunch":                    "👊",
+	"file_folder":                  "📁",
+	"fire":                         "🔥",
+	"fireworks":                    "🎆",
+	"fist":                         "✊",
+	"flushed":                      "😳",
+	"gear":                         "⚙️",
+	"gem":                          "💎",
+	"ghost":                        "👻",
+	"gift":                         "🎁",
+	"globe_with_meridians":         "🌐",
+	"green_heart":                  "💚",
+	"grey_exclamation":             "❕",
+	"grey_question":                "❔",
+	"grimacing":                    "😬",
+	"grin":                         "😁",
+	"grinning":                     "😀",
+	"hammer":                       "🔨",
+	"hammer_and_wrench":            "🛠️",
+	"hand":                         "✋",
+	"heart":                        "❤️",
+	"heart_eyes":                   "😍",
+	"heavy_check_mark":             "✔️",
+	"heavy_minus_sign":             "➖",
+	"heavy_plus_sign":              "➕",
+	"hear_no_evil":                 "🙉",
+	"high_brightness":              "🔆",
+	"hocho":                        "🔪",
+	"hole":                         "🕳️",
+	"hourglass":                    "⌛",
+	"house":                        "🏠",
+	"hugs":                         "🤗",
+	"hushed":                       "😯",
+	"information_source":           "ℹ️",
+	"innocent":                     "😇",
+	"joy":                          "😂",
+	"key":                          "🔑",
+	"kissing_heart":                "😘",
+	"label":                        "🏷️",
+	"laughing":                     "😆",
+	"link":                         "🔗",
+	"lipstick":                     "💄",
+	"lock":                         "🔒",
+	"loudspeaker":                  "📢",
+	"mag":                          "🔍",
+	"mag_right":                    "🔎",
+	"mailbox":                      "📫",
+	"memo":                         "📝",
+	"microscope":                   "🔬",
+	"moneybag":                     "💰",
+	"muscle":                       "💪",
+	"mute":                         "🔇",
+	"necktie":                      "👔",
+	"neutral_face":                 "😐",
+	"new":                          "🆕",
+	"no_entry":                     "⛔",
+	"no_entry_sign":                "🚫",
+	"no_mouth":                     "😶",
+	"notebook":                     "📓",
+	"ok":                           "🆗",
+	"ok_hand":                      "👌",
+	"open_mouth":                   "😮",
+	"package":                      "📦",
+	"page_facing_up":               "📄",
+	"paperclip":                    "📎",
+	"partying_face":                "🥳",
+	"pencil":                       "📝",
+	"pencil2":                      "✏️",
+	"pensive":                      "😔",
+	"point_down":                   "👇",
+	"point_left":                   "👈",
+	"point_right":                  "👉",
+	"point_up":                     "☝️",
+	"poop":                         "💩",
+	"pray":                         "🙏",
+	"pushpin":                      "📌",
+	"purple_heart":                 "💜",
+	"question":                     "❓",
+	"rage":                         "😡",
+	"raised_hands":                 "🙌",
+	"recycle":                      "♻️",
+	"red_circle":                   "🔴",
+	"relaxed":                      "☺️",
+	"relieved":                     "😌",
+	"robot":                        "🤖",
+	"rocket":                       "🚀",
+	"rofl":                         "🤣",
+	"rotating_light":               "🚨",
+	"scream":                       "😱",
+	"see_no_evil":                  "🙈",
+	"shipit":                       "🐿️",
+	"skull":                        "💀",
+	"sleeping":                     "😴",
+	"sleepy":                       "😪",
+	"slightly_frowning_face":       "🙁",
+	"slightly_smiling_face":        "🙂",
+	"smile":                        "😄",
+	"smiley":                       "😃",
+	"smirk":                        "😏",
+	"sob":                          "😭",
+	"sparkles":                     "✨",
+	"sparkling_heart":              "💖",
+	"speak_no_evil":                "🙊",
+	"speech_balloon":               "💬",
+	"star":                         "⭐",
+	"star2":                        "🌟",
+	"stop_sign":                    "🛑",
+	"stuck_out_tongue":             "😛",
+	"stuck_out_tongue_winking_eye": "😜",
+	"sun_with_face":                "🌞",
+	"sunglasses":                   "😎",
+	"sunny":                        "☀️",
+	"sweat":                        "😓",
+	"sweat_smile":                  "😅",
+	"tada":                         "🎉",
+	"thinking":                     "🤔",
+	"thought_balloon":              "💭",
+	"thumbsdown":                   "👎",
+	"thumbsup":                     "👍",
+	"tired_face":                   "😫",
+	"trophy":                       "🏆",
+	"triumph":                      "😤",
+	"truck":                        "🚚",
+	"umbrella":                     "☔",
+	"unamused":                     "😒",
+	"unlock":                       "🔓",
+	"upside_down_face":             "🙃",
+	"v":                            "✌️",
+	"warning":                      "⚠️",
+	"wave":                         "👋",
+	"weary":                        "😩",
+	"white_check_mark":             "✅",
+	"wink":                         "😉",
+	"world_map":                    "🗺️",
+	"worried":                      "😟",
+	"wrench":                       "🔧",
+	"x":                            "❌",
+	"yellow_heart":                 "💛",
+	"yum":                          "😋",
+	"zap":                          "⚡",
+	"zzz":                          "💤",
+}
@@ -0,0 +1,102 @@
+package render
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Handler is a http.Handler serving markdown (.md) files from file system
+// rendered into html pages, and other files as is. Handler can be used by
+// programs embedding markdown serving without the rest of mdserver:
+//
+//	http.Handle("/", render.NewHandler(os.DirFS("docs")))
+//
+// Any fs.FS can be served, like embed.FS, zip archive or fstest.MapFS.
+type Handler struct {
+	FS fs.FS
+
+	// Options configure rendering of markdown files
+	Options Options
+
+	// Template, if set, replaces DefaultTemplate pages are rendered with.
+	// It's executed with PageData.
+	Template *template.Template
+}
+
+// Option configures Handler created with NewHandler
+type Option func(*Handler)
+
+// WithOptions sets options markdown files are rendered with
+func WithOptions(opts Options) Option { return func(h *Handler) { h.Options = opts } }
+
+// WithTemplate sets template pages are rendered with, see Handler.Template
+func WithTemplate(t *template.Template) Option { return func(h *Handler) { h.Template = t } }
+
+// NewHandler returns Handler serving files from fsys
+func NewHandler(fsys fs.FS, opts ...Option) *Handler {
+	h := &Handler{FS: fsys}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// PageData is passed to Handler.Template when rendering markdown file
+type PageData struct {
+	Name  string        // file name relative to Handler.FS root
+	Title string        // text of the first header, or file name
+	Body  template.HTML // rendered document
+}
+
+// DefaultTemplate is used by Handler if its Template is not set
+var DefaultTemplate = template.Must(template.New("page").Parse(`<!doctype html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+</head><body><article>
+{{.Body}}
+</article></body>
+`))
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if !strings.HasSuffix(name, ".md") {
+		http.FileServer(http.FS(h.FS)).ServeHTTP(w, r)
+		return
+	}
+	src, err := fs.ReadFile(h.FS, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("read %q: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	doc := Parse(src, h.Options)
+	page := PageData{Name: name, Title: Title(doc), Body: template.HTML(Document(doc, h.Options))}
+	if page.Title == "" {
+		page.Title = strings.TrimSuffix(path.Base(name), ".md")
+	}
+	tpl := h.Template
+	if tpl == nil {
+		tpl = DefaultTemplate
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, page); err != nil {
+		log.Printf("render %q: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	var mtime time.Time
+	if st, err := fs.Stat(h.FS, name); err == nil {
+		mtime = st.ModTime()
+	}
+	http.ServeContent(w, r, "page.html", mtime, bytes.NewReader(buf.Bytes()))
+}
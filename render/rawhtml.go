@@ -0,0 +1,30 @@
+package render
+
+import (
+	"io"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+)
+
+// escapedHTML is a html.RenderNodeFunc rendering raw html of documents as
+// text, keeping table of contents placeholders and task list checkboxes
+func escapedHTML(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	switch n := node.(type) {
+	case *ast.HTMLBlock:
+		if tocPlaceholder.Match(n.Literal) {
+			return ast.GoToNext, false
+		}
+		io.WriteString(w, "<p>")
+		html.EscapeHTML(w, n.Literal)
+		io.WriteString(w, "</p>\n")
+		return ast.GoToNext, true
+	case *ast.HTMLSpan:
+		if isTaskCheckbox(n) {
+			return ast.GoToNext, false
+		}
+		html.EscapeHTML(w, n.Literal)
+		return ast.GoToNext, true
+	}
+	return ast.GoToNext, false
+}
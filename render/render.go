@@ -0,0 +1,485 @@
+// Package render converts markdown documents to sanitized html the same way
+// mdserver does: with common extensions and GitHub-compatible heading ids,
+// GitHub-like handling of <details> blocks and "> [!NOTE]" alerts, and
+// bluemonday's UGC policy applied to the result. Parser extensions,
+// sanitization policy and render hooks can be changed with Options, and
+// Handler serves rendered documents over HTTP.
+package render
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// Options configure rendering
+type Options struct {
+	// GithubWiki enables rewriting of absolute links to github wiki pages
+	// like "https://github.com/user/project/wiki/Page" to relative ones
+	// like "Page.md"
+	GithubWiki bool
+
+	// HTMLLinks enables rewriting of relative links to markdown files like
+	// "Page.md" to links to html files like "Page.html", useful when
+	// rendering documents into static html files
+	HTMLLinks bool
+
+	// Math enables parsing of LaTeX formulas between $ (inline) and $$
+	// (display) delimiters. They're rendered as-is within <span> elements
+	// with "math inline" or "math display" classes, to be typeset in browser
+	// with KaTeX or MathJax.
+	Math bool
+
+	// Emoji enables replacing of GitHub emoji shortcodes like :smile: with
+	// emoji characters
+	Emoji bool
+
+	// Mentions, if set, enables linking of @username mentions. It's called
+	// with user name and returns link destination; if it returns an empty
+	// string, text is left as is.
+	Mentions func(user string) string
+
+	// WikiLinks, if set, enables [[Page Name]] and [[Link text|Page Name]]
+	// links. It's called with page name and returns link destination; if
+	// it returns an empty string, text is left as is.
+	WikiLinks func(page string) string
+
+	// Hooks are called in order for each rendered node until one of them
+	// reports node as handled, after built-in ones
+	Hooks []html.RenderNodeFunc
+
+	// Extensions, if not zero, replace DefaultExtensions documents are
+	// parsed with. MathJax extension is added if Math is set.
+	Extensions parser.Extensions
+
+	// Policy, if set, replaces DefaultPolicy used to sanitize rendered
+	// html. It must not be modified after use.
+	Policy *bluemonday.Policy
+
+	// NoSanitize disables sanitization of rendered html, it must only be
+	// used for trusted documents
+	NoSanitize bool
+
+	// EscapeHTML makes raw html of documents rendered as text
+	EscapeHTML bool
+
+	// TOC, if set, enables "<!-- toc -->" placeholder in documents. It's
+	// called with document headings, and returned html replaces the first
+	// placeholder as is, without sanitization. Other placeholders are
+	// removed.
+	TOC func([]Heading) []byte
+
+	// NoSmartypants disables replacing of straight quotes, dashes and
+	// fractions with typographic ones
+	NoSmartypants bool
+
+	// HeadingAnchors enables "¶" links to headings placed after their
+	// text, having "anchor" class
+	HeadingAnchors bool
+
+	// TaskIndexes adds data-task attribute to task list checkboxes, with
+	// their number in document order, counting from zero, so that they can
+	// be told from each other and from checkboxes of raw html
+	TaskIndexes bool
+}
+
+// Markdown renders markdown document src to sanitized html
+func Markdown(src []byte, opts Options) []byte {
+	return Document(Parse(src, opts), opts)
+}
+
+// Parse parses markdown document src with the same extensions Markdown uses
+// with given options, so that the resulting tree can be inspected before
+// rendering it with Document. Wiki links are resolved by Parse.
+func Parse(src []byte, opts Options) ast.Node {
+	ext := extensions(opts)
+	doc := newParser(ext).Parse(src)
+	if ext&parser.AutoHeadingIDs != 0 {
+		githubHeadingIDs(doc)
+	}
+	taskLists(doc, opts.TaskIndexes)
+	alerts(doc)
+	if opts.WikiLinks != nil {
+		wikiLinks(doc, opts.WikiLinks)
+	}
+	if urls := ext&parser.Autolink != 0; urls || opts.Mentions != nil {
+		autolinks(doc, urls, opts.Mentions)
+	}
+	if opts.Emoji {
+		emojiShortcodes(doc)
+	}
+	return doc
+}
+
+// Document renders document parsed with Parse to sanitized html
+func Document(doc ast.Node, opts Options) []byte {
+	ropts := rendererOpts
+	if opts.NoSmartypants {
+		ropts.Flags &^= html.Smartypants | html.SmartypantsFractions | html.SmartypantsDashes | html.SmartypantsLatexDashes
+	}
+	hooks := []html.RenderNodeFunc{taskListItems}
+	ext := ".md"
+	if opts.HTMLLinks {
+		ext = ".html"
+		hooks = append(hooks, markdownLinksToHTML)
+	}
+	if opts.GithubWiki {
+		hooks = append(hooks, githubWikiLinks(ext))
+	}
+	var marker []byte // replaced with table of contents after sanitization
+	if opts.TOC != nil {
+		marker = tocMarker()
+		hooks = append(hooks, tocPlaceholders(marker))
+	}
+	if opts.HeadingAnchors {
+		hooks = append(hooks, headingAnchors(doc))
+	}
+	if opts.EscapeHTML {
+		hooks = append(hooks, escapedHTML)
+	}
+	ropts.RenderNodeHook = chainHooks(append(hooks, opts.Hooks...)...)
+	p := policy
+	if opts.Policy != nil {
+		p = opts.Policy
+	}
+	out := markdown.Render(doc, html.NewRenderer(ropts))
+	if !opts.NoSanitize {
+		out = p.SanitizeBytes(out)
+	}
+	if marker != nil && bytes.Contains(out, marker) {
+		out = bytes.Replace(out, marker, opts.TOC(Headings(doc)), 1)
+		out = bytes.ReplaceAll(out, marker, nil)
+	}
+	return out
+}
+
+// tocMarker returns text rendered in place of table of contents placeholder.
+// It's made of private use characters, so that it survives sanitization, and
+// random digits, so that documents cannot have it.
+func tocMarker() []byte {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return []byte("\uf8fftoc" + hex.EncodeToString(b[:]) + "\uf8ff")
+}
+
+var tocPlaceholder = regexp.MustCompile(`(?i)^<!--\s*toc\s*-->\s*$`)
+
+// tocPlaceholders returns html.RenderNodeFunc rendering "<!-- toc -->" html
+// blocks as marker
+func tocPlaceholders(marker []byte) html.RenderNodeFunc {
+	return func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+		if b, ok := node.(*ast.HTMLBlock); ok && tocPlaceholder.Match(b.Literal) {
+			w.Write(marker)
+			return ast.GoToNext, true
+		}
+		return ast.GoToNext, false
+	}
+}
+
+// DefaultExtensions are parser extensions documents are parsed with unless
+// Options.Extensions is set. With parser.Autolink extension, bare
+// "www.example.com" addresses and email addresses are linked too.
+const DefaultExtensions = parser.CommonExtensions | parser.AutoHeadingIDs ^ parser.MathJax
+
+// extensions returns parser extensions documents are parsed with
+func extensions(opts Options) parser.Extensions {
+	ext := DefaultExtensions
+	if opts.Extensions != 0 {
+		ext = opts.Extensions
+	}
+	if opts.Math {
+		ext |= parser.MathJax
+	}
+	return ext
+}
+
+// newParser returns markdown parser used to render documents. Automatic
+// heading ids are given by Parse instead, see githubHeadingIDs.
+func newParser(ext parser.Extensions) *parser.Parser {
+	p := parser.NewWithExtensions(ext &^ parser.AutoHeadingIDs)
+	p.Opts.ParserHook = detailsHook
+	return p
+}
+
+// detailsHook is a parser.BlockFunc recognizing lines with opening and
+// closing <details> tags and a <summary> element as separate html blocks,
+// so that markdown between them is rendered as usual and not wrapped into
+// paragraphs along with these tags, matching how GitHub renders such
+// collapsible sections. Lines indented by four or more spaces are left for
+// parser to treat as code.
+func detailsHook(data []byte) (ast.Node, []byte, int) {
+	line := data
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		line = data[:i+1]
+	}
+	if indent(line) >= 4 {
+		return nil, nil, 0
+	}
+	tag := bytes.TrimSpace(line)
+	if !detailsLine(tag) {
+		return nil, nil, 0
+	}
+	return &ast.HTMLBlock{Leaf: ast.Leaf{Literal: tag}}, nil, len(line)
+}
+
+// indent returns width of leading whitespace of line, with tabs advancing to
+// the next multiple of four columns
+func indent(line []byte) int {
+	var n int
+	for _, c := range line {
+		switch c {
+		case ' ':
+			n++
+		case '\t':
+			n += 4 - n%4
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// detailsLine reports whether line consists only of opening or closing
+// <details> tag, optionally followed by a <summary> element.
+func detailsLine(line []byte) bool {
+	lower := bytes.ToLower(line)
+	if bytes.Equal(lower, []byte("</details>")) {
+		return true
+	}
+	if isOpeningTag(lower, "details") {
+		lower = lower[bytes.IndexByte(lower, '>')+1:]
+		if len(lower) == 0 {
+			return true
+		}
+	}
+	return isOpeningTag(lower, "summary") &&
+		bytes.HasSuffix(lower, []byte("</summary>")) &&
+		bytes.Count(lower, []byte("<summary")) == 1
+}
+
+// isOpeningTag reports whether b starts with opening html tag with given name
+func isOpeningTag(b []byte, name string) bool {
+	if len(b) < len(name)+2 || b[0] != '<' || string(b[1:len(name)+1]) != name {
+		return false
+	}
+	switch b[len(name)+1] {
+	case '>':
+		return true
+	case ' ', '\t':
+		return bytes.IndexByte(b, '>') > 0
+	}
+	return false
+}
+
+var rendererOpts = html.RendererOptions{Flags: html.CommonFlags}
+
+var policy = DefaultPolicy()
+
+// DefaultPolicy returns new policy used to sanitize rendered html unless
+// Options.Policy is set. It can be extended to allow more elements or
+// attributes. Note that UGCPolicy it's based on already allows <details>
+// element with its "open" attribute, and <summary> element.
+func DefaultPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").OnElements("code")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^math (inline|display)$`)).OnElements("span")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^task-list-item$`)).OnElements("li")
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^task-list-item-checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	p.AllowAttrs("data-task").Matching(regexp.MustCompile(`^[0-9]+$`)).OnElements("input")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^anchor$`)).OnElements("a")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^alert alert-(note|tip|important|warning|caution)$`)).OnElements("aside")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^alert-title$`)).OnElements("p")
+	return p
+}
+
+// RelaxedPolicy returns policy which, in addition to what DefaultPolicy
+// allows, keeps html trusted documents commonly embed: iframes with https
+// sources, like embedded videos, style attributes, and named anchors.
+func RelaxedPolicy() *bluemonday.Policy {
+	p := DefaultPolicy()
+	p.AllowElements("iframe")
+	p.AllowAttrs("src").Matching(regexp.MustCompile(`^https://`)).OnElements("iframe")
+	p.AllowAttrs("width", "height", "frameborder", "allow", "allowfullscreen", "loading", "title").OnElements("iframe")
+	p.AllowAttrs("style").Globally()
+	p.AllowAttrs("name").OnElements("a")
+	return p
+}
+
+// githubWikiLinks returns html.RenderNodeFunc which renders links with github
+// wiki destinations as local ones.
+//
+// Link with "https://github.com/user/project/wiki/Page" destination would be
+// rendered as a link to "Page"+ext
+func githubWikiLinks(ext string) html.RenderNodeFunc {
+	return func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+		link, ok := node.(*ast.Link)
+		if !ok || !entering {
+			return ast.GoToNext, false
+		}
+		if u, err := url.Parse(string(link.Destination)); err == nil &&
+			u.Host == "github.com" && strings.HasSuffix(path.Dir(u.Path), "/wiki") {
+			dst := path.Base(u.Path) + ext
+			switch u.Fragment {
+			case "":
+				fmt.Fprintf(w, "<a href=\"%s\">", url.QueryEscape(dst))
+			default:
+				fmt.Fprintf(w, "<a href=\"%s#%s\">", url.QueryEscape(dst), url.QueryEscape(u.Fragment))
+			}
+			return ast.GoToNext, true
+		}
+		return ast.GoToNext, false
+	}
+}
+
+// markdownLinksToHTML is a html.RenderNodeFunc which changes destinations of
+// relative links to markdown files to html files with the same base name,
+// leaving rendering to other hooks or renderer itself.
+func markdownLinksToHTML(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	link, ok := node.(*ast.Link)
+	if !ok || !entering {
+		return ast.GoToNext, false
+	}
+	u, err := url.Parse(string(link.Destination))
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasSuffix(u.Path, ".md") {
+		return ast.GoToNext, false
+	}
+	u.Path = strings.TrimSuffix(u.Path, ".md") + ".html"
+	link.Destination = []byte(u.String())
+	return ast.GoToNext, false
+}
+
+// chainHooks returns html.RenderNodeFunc calling non-nil hooks in order until
+// one of them reports node as handled.
+func chainHooks(hooks ...html.RenderNodeFunc) html.RenderNodeFunc {
+	var nonNil []html.RenderNodeFunc
+	for _, fn := range hooks {
+		if fn != nil {
+			nonNil = append(nonNil, fn)
+		}
+	}
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		return nonNil[0]
+	}
+	return func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+		for _, fn := range nonNil {
+			if status, ok := fn(w, node, entering); ok {
+				return status, ok
+			}
+		}
+		return ast.GoToNext, false
+	}
+}
+
+// Title returns text of the first h1 header of document. If document has no
+// h1 headers, text of its first header of any level is returned.
+func Title(doc ast.Node) string {
+	var title, fallback string
+	walkFn := func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch n := node.(type) {
+		case *ast.Heading:
+			if n.Level != 1 {
+				if fallback == "" {
+					fallback = string(childLiterals(n))
+				}
+				return ast.SkipChildren
+			}
+			title = string(childLiterals(n))
+			return ast.Terminate
+		case *ast.Code, *ast.CodeBlock, *ast.BlockQuote:
+			return ast.SkipChildren
+		}
+		return ast.GoToNext
+	}
+	_ = ast.Walk(doc, ast.NodeVisitorFunc(walkFn))
+	if title == "" {
+		return fallback
+	}
+	return title
+}
+
+func childLiterals(node ast.Node) []byte {
+	if l := node.AsLeaf(); l != nil {
+		return l.Literal
+	}
+	var out [][]byte
+	for _, n := range node.GetChildren() {
+		if lit := childLiterals(n); lit != nil {
+			out = append(out, lit)
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return bytes.Join(out, nil)
+}
+
+// Heading describes document heading
+type Heading struct {
+	Level int
+	ID    string // id of rendered heading, if any
+	Text  string // heading text without markup
+}
+
+// Headings returns headings of document in their order. Their ids are made
+// unique the same way Document does, so they can be used as anchors.
+func Headings(doc ast.Node) []Heading {
+	var out []Heading
+	walkHeadings(doc, func(h *ast.Heading, id string) {
+		out = append(out, Heading{Level: h.Level, ID: id, Text: headingText(h)})
+	})
+	return out
+}
+
+// walkHeadings calls fn for headings of doc in order, with ids they're
+// rendered with
+func walkHeadings(doc ast.Node, fn func(h *ast.Heading, id string)) {
+	seen := make(map[string]int) // id -> number of its duplicates
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		h, ok := node.(*ast.Heading)
+		if !ok || !entering {
+			return ast.GoToNext
+		}
+		id := h.HeadingID
+		// matches html.Renderer ensureUniqueHeadingID method
+		for count, found := seen[id]; id != "" && found; count, found = seen[id] {
+			if tmp := fmt.Sprintf("%s-%d", id, count+1); !hasKey(seen, tmp) {
+				seen[id] = count + 1
+				id = tmp
+			} else {
+				id += "-1"
+			}
+		}
+		if id != "" && !hasKey(seen, id) {
+			seen[id] = 0
+		}
+		fn(h, id)
+		return ast.SkipChildren
+	})
+}
+
+func hasKey(m map[string]int, key string) bool {
+	_, ok := m[key]
+	return ok
+}
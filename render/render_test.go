@@ -0,0 +1,296 @@
+package render
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gomarkdown/markdown/parser"
+)
+
+func TestMarkdown(t *testing.T) {
+	src := []byte("# Title\n\nSee [page](https://github.com/user/project/wiki/Some-Page)" +
+		" and [local page](dir/Other.md#top) <script>alert(1)</script>\n")
+	for _, tc := range []struct {
+		opts Options
+		want string
+	}{
+		{Options{}, `<a href="https://github.com/user/project/wiki/Some-Page" rel="nofollow">page</a>`},
+		{Options{GithubWiki: true}, `<a href="Some-Page.md" rel="nofollow">page</a>`},
+		{Options{GithubWiki: true, HTMLLinks: true}, `<a href="Some-Page.html" rel="nofollow">page</a>`},
+		{Options{HTMLLinks: true}, `<a href="dir/Other.html#top" rel="nofollow">local page</a>`},
+	} {
+		b := Markdown(src, tc.opts)
+		if !bytes.Contains(b, []byte(`<h1 id="title">Title</h1>`)) {
+			t.Errorf("%+v: no header in output:\n%s", tc.opts, b)
+		}
+		if !bytes.Contains(b, []byte(tc.want)) {
+			t.Errorf("%+v: output does not contain %q:\n%s", tc.opts, tc.want, b)
+		}
+		if bytes.Contains(b, []byte("<script")) {
+			t.Errorf("%+v: output is not sanitized:\n%s", tc.opts, b)
+		}
+	}
+}
+
+func TestMath(t *testing.T) {
+	src := []byte("Formula $a<b$ inline.\n\n$$\nx^2\n$$\n")
+	if b := Markdown(src, Options{}); bytes.Contains(b, []byte("math")) {
+		t.Errorf("math is parsed when disabled:\n%s", b)
+	}
+	b := Markdown(src, Options{Math: true})
+	for _, want := range []string{
+		`<span class="math inline">\(a&lt;b\)</span>`,
+		`<span class="math display">\[`,
+	} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Errorf("output does not contain %q:\n%s", want, b)
+		}
+	}
+}
+
+func TestWikiLinks(t *testing.T) {
+	src := []byte("See [[Page]], [[Text|Other Page]], [[missing]] and `[[code]]`\n")
+	resolve := func(page string) string {
+		if page == "missing" {
+			return ""
+		}
+		return "/" + strings.ReplaceAll(page, " ", "-") + ".md"
+	}
+	b := Markdown(src, Options{WikiLinks: resolve})
+	for _, want := range []string{
+		`See <a href="/Page.md" rel="nofollow">Page</a>, `,
+		`<a href="/Other-Page.md" rel="nofollow">Text</a>`,
+		`[[missing]] and <code>[[code]]</code>`,
+	} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Errorf("output does not contain %q:\n%s", want, b)
+		}
+	}
+	if b := Markdown(src, Options{}); bytes.Contains(b, []byte("<a ")) {
+		t.Errorf("wiki links are rendered when disabled:\n%s", b)
+	}
+}
+
+func TestEmoji(t *testing.T) {
+	src := []byte("Done :tada: :+1:, time 10:30:45, :unknown:smile: and `:smile:`\n")
+	want := "<p>Done 🎉 👍, time 10:30:45, :unknown😄 and <code>:smile:</code></p>\n"
+	if got := string(Markdown(src, Options{Emoji: true})); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if b := Markdown(src, Options{}); bytes.Contains(b, []byte("🎉")) {
+		t.Errorf("emoji replaced when disabled:\n%s", b)
+	}
+}
+
+func TestTaskLists(t *testing.T) {
+	src := []byte("- [ ] todo\n- [x] done\n- [y] not a task\n\n```\n- [ ] code\n```\n")
+	want := "<ul>\n" +
+		`<li class="task-list-item"><input type="checkbox" class="task-list-item-checkbox" disabled=""> todo</li>` + "\n" +
+		`<li class="task-list-item"><input type="checkbox" class="task-list-item-checkbox" checked="" disabled=""> done</li>` + "\n" +
+		"<li>[y] not a task</li>\n</ul>\n\n<pre><code>- [ ] code\n</code></pre>\n"
+	if got := string(Markdown(src, Options{})); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	got := string(Markdown([]byte("- [ ] a\n- [x] b\n\n<input type=\"checkbox\" data-task=\"x\">"), Options{TaskIndexes: true}))
+	for _, want := range []string{`data-task="0" disabled=""> a`, `data-task="1" checked="" disabled=""> b`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q not found in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `data-task="x"`) {
+		t.Errorf("invalid data-task attribute is kept:\n%s", got)
+	}
+}
+
+func TestTitle(t *testing.T) {
+	for _, tc := range []struct{ doc, want string }{
+		{"# Title\n\ntext", "Title"},
+		{"## Section\n\n# Title\n", "Title"},
+		{"text\n\n## Section\n\n### Subsection\n", "Section"},
+		{"> ## Quoted\n\n### Subsection\n", "Subsection"},
+		{"just text", ""},
+	} {
+		if got := Title(Parse([]byte(tc.doc), Options{})); got != tc.want {
+			t.Errorf("document %q: got title %q, want %q", tc.doc, got, tc.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	policy := DefaultPolicy()
+	policy.AllowAttrs("class").OnElements("p")
+	fsys := fstest.MapFS{
+		"doc.md":  {Data: []byte("# Doc\n\n<p class=\"note\">~~note~~</p>\n")},
+		"doc.txt": {Data: []byte("plain")},
+	}
+	h := NewHandler(fsys,
+		WithOptions(Options{Policy: policy, Extensions: parser.CommonExtensions &^ parser.Strikethrough}),
+		WithTemplate(template.Must(template.New("").Parse(`{{.Name}}: {{.Title}}: {{.Body}}`))),
+	)
+	for p, want := range map[string]string{
+		"/doc.md":  "doc.md: Doc: <h1>Doc</h1>\n\n<p class=\"note\">~~note~~</p>\n",
+		"/doc.txt": "plain",
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		if got := rec.Body.String(); rec.Code != http.StatusOK || got != want {
+			t.Errorf("%s: got status %d and body %q, want %q", p, rec.Code, got, want)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/missing.md", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing file: got status %d", rec.Code)
+	}
+}
+
+func TestHeadings(t *testing.T) {
+	doc := Parse([]byte("# Doc <b>x</b>\n\n## A `code` x\n\n## A code x\n\n## A code x\n\n> ### Quoted\n"), Options{})
+	want := []Heading{
+		{1, "doc-x", "Doc x"},
+		{2, "a-code-x", "A code x"},
+		{2, "a-code-x-1", "A code x"},
+		{2, "a-code-x-2", "A code x"},
+		{3, "quoted", "Quoted"},
+	}
+	if got := Headings(doc); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	html := string(Document(doc, Options{}))
+	for _, h := range want {
+		if !strings.Contains(html, `id="`+h.ID+`"`) {
+			t.Errorf("rendered document has no id %q:\n%s", h.ID, html)
+		}
+	}
+}
+
+func TestTOCPlaceholder(t *testing.T) {
+	src := []byte("# Doc\n\n<!-- toc -->\n\n## Section\n\n<!--TOC-->\n")
+	toc := func(headings []Heading) []byte {
+		var ids []string
+		for _, h := range headings {
+			ids = append(ids, h.ID)
+		}
+		return []byte("<nav>" + strings.Join(ids, ",") + "</nav>")
+	}
+	want := "<h1 id=\"doc\">Doc</h1>\n<nav>doc,section</nav>\n<h2 id=\"section\">Section</h2>\n"
+	if got := string(Markdown(src, Options{TOC: toc})); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+	if got := Markdown(src, Options{}); bytes.Contains(got, []byte("nav")) || bytes.Contains(got, []byte("\uf8ff")) {
+		t.Errorf("placeholder is replaced without Options.TOC:\n%s", got)
+	}
+	src = []byte("# Doc\n\n<a title=\"\uf8fftoc\uf8ff\">x</a> \uf8fftoc\uf8ff\n")
+	if got := string(Markdown(src, Options{TOC: toc})); strings.Contains(got, "<nav>") {
+		t.Errorf("table of contents is put in place of text of document:\n%s", got)
+	}
+}
+
+func TestHeadingAnchors(t *testing.T) {
+	src := []byte("# Foo & Bar: v1.2\n\n## Foo & Bar: v1.2\n\n## Über_alles -- `x`\n\n## Custom {#own-id}\n")
+	want := "<h1 id=\"foo--bar-v12\">Foo &amp; Bar: v1.2 <a class=\"anchor\" href=\"#foo--bar-v12\" rel=\"nofollow\">¶</a></h1>\n\n" +
+		"<h2 id=\"foo--bar-v12-1\">Foo &amp; Bar: v1.2 <a class=\"anchor\" href=\"#foo--bar-v12-1\" rel=\"nofollow\">¶</a></h2>\n\n" +
+		"<h2 id=\"über_alles----x\">Über_alles – <code>x</code> <a class=\"anchor\" href=\"#%C3%BCber_alles----x\" rel=\"nofollow\">¶</a></h2>\n\n" +
+		"<h2 id=\"own-id\">Custom <a class=\"anchor\" href=\"#own-id\" rel=\"nofollow\">¶</a></h2>\n"
+	if got := string(Markdown(src, Options{HeadingAnchors: true})); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDetails(t *testing.T) {
+	src := []byte("<details>\n<summary>More</summary>\n\nHidden *text*.\n\n</details>\n\nExample:\n\n    <details>\n\t</details>\n")
+	want := "<details>\n\n<summary>More</summary>\n\n<p>Hidden <em>text</em>.</p>\n\n</details>\n\n<p>Example:</p>\n\n" +
+		"<pre><code>&lt;details&gt;\n&lt;/details&gt;\n</code></pre>\n"
+	if got := string(Markdown(src, Options{})); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAutolinks(t *testing.T) {
+	src := []byte("See www.example.com/a_(b)., mail me@example.org, ask @octo-cat or @x; not a@b, `www.code.com` or [www.link.com](/x).\n")
+	mention := func(user string) string {
+		if user == "x" {
+			return ""
+		}
+		return "https://github.com/" + user
+	}
+	want := `<p>See <a href="http://www.example.com/a_(b)" rel="nofollow">www.example.com/a_(b)</a>., ` +
+		`mail <a href="mailto:me@example.org" rel="nofollow">me@example.org</a>, ` +
+		`ask <a href="https://github.com/octo-cat" rel="nofollow">@octo-cat</a> or @x; not a@b, ` +
+		`<code>www.code.com</code> or <a href="/x" rel="nofollow">www.link.com</a>.</p>` + "\n"
+	if got := string(Markdown(src, Options{Mentions: mention})); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	got := string(Markdown(src, Options{Extensions: DefaultExtensions &^ parser.Autolink}))
+	if strings.Contains(got, "<a href=\"http://www") || strings.Contains(got, "mailto:") || strings.Contains(got, "github.com") {
+		t.Errorf("links added without autolink extension and mentions:\n%s", got)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	src := "> [!NOTE]\n> Useful *info*.\n\n---\n\n> [!warning] Mind the gap\n>\n> Text.\n\n---\n\n> [!TODO]\n> Not an alert.\n"
+	want := `<aside class="alert alert-note">
+<p class="alert-title">Note</p>
+
+<p>Useful <em>info</em>.</p>
+</aside>
+
+<hr>
+
+<aside class="alert alert-warning">
+<p class="alert-title">Mind the gap</p>
+
+<p>Text.</p>
+</aside>
+
+<hr>
+
+<blockquote>
+<p>[!TODO]
+Not an alert.</p>
+</blockquote>`
+	if got := strings.TrimSpace(string(Markdown([]byte(src), Options{}))); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSanitizeLevels(t *testing.T) {
+	src := []byte("<iframe src=\"https://example.com/embed\" width=\"560\"></iframe>\n\n" +
+		"Text <span style=\"color:red\">red</span><script>alert(1)</script>\n\n" +
+		"- [x] done\n- <input type=\"checkbox\"> raw\n")
+	for i, tc := range []struct {
+		opts    Options
+		want    []string
+		notWant []string
+	}{
+		{Options{}, []string{"<span>red</span>", `<input type="checkbox" class="task-list-item-checkbox" checked="" disabled=""> done`},
+			[]string{"iframe", "style=", "<script>"}},
+		{Options{Policy: RelaxedPolicy()},
+			[]string{`<iframe src="https://example.com/embed" width="560">`, `<span style="color:red">`},
+			[]string{"<script>"}},
+		{Options{NoSanitize: true}, []string{"<script>alert(1)</script>"}, nil},
+		{Options{EscapeHTML: true},
+			[]string{"<p>&lt;iframe src=&#34;https://example.com/embed&#34;", "&lt;script&gt;",
+				`<input type="checkbox" class="task-list-item-checkbox" checked="" disabled=""> done`,
+				"&lt;input type=&#34;checkbox&#34;&gt; raw"},
+			[]string{"<span", "<iframe", "&lt;input type=&#34;checkbox&#34; class"}},
+	} {
+		got := string(Markdown(src, tc.opts))
+		for _, s := range tc.want {
+			if !strings.Contains(got, s) {
+				t.Errorf("case %d: %q not found in:\n%s", i, s, got)
+			}
+		}
+		for _, s := range tc.notWant {
+			if strings.Contains(got, s) {
+				t.Errorf("case %d: unexpected %q in:\n%s", i, s, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package render
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// taskListItemClass is a class of list items starting with a checkbox
+const taskListItemClass = "task-list-item"
+
+// taskCheckboxClass is a class of checkboxes added by taskLists, it also
+// marks their nodes to tell them from raw html of documents
+const taskCheckboxClass = "task-list-item-checkbox"
+
+// taskLists replaces "[ ]" and "[x]" markers starting list items of doc with
+// disabled checkboxes, as GitHub does. If indexes is set, checkboxes have
+// data-task attribute with their number in document order, counting from
+// zero.
+func taskLists(doc ast.Node, indexes bool) {
+	var n int
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		item, ok := node.(*ast.ListItem)
+		if !ok || !entering || len(item.Children) == 0 {
+			return ast.GoToNext
+		}
+		para, ok := item.Children[0].(*ast.Paragraph)
+		if !ok || len(para.Children) == 0 {
+			return ast.GoToNext
+		}
+		text, ok := para.Children[0].(*ast.Text)
+		if !ok {
+			return ast.GoToNext
+		}
+		checked, rest, ok := cutTaskMarker(text.Literal)
+		if !ok {
+			return ast.GoToNext
+		}
+		text.Literal = rest
+		box := `<input type="checkbox" class="` + taskCheckboxClass + `"`
+		if indexes {
+			box += ` data-task="` + strconv.Itoa(n) + `"`
+		}
+		if n++; checked {
+			box += ` checked`
+		}
+		box += ` disabled>`
+		span := &ast.HTMLSpan{Leaf: ast.Leaf{
+			Literal:   []byte(box),
+			Attribute: &ast.Attribute{Classes: [][]byte{[]byte(taskCheckboxClass)}},
+		}}
+		span.SetParent(para)
+		para.Children = append([]ast.Node{span}, para.Children...)
+		item.Attribute = &ast.Attribute{Classes: [][]byte{[]byte(taskListItemClass)}}
+		return ast.GoToNext
+	})
+}
+
+// cutTaskMarker reports whether text starts with task marker, and returns
+// marker state and text following it
+func cutTaskMarker(text []byte) (checked bool, rest []byte, ok bool) {
+	if len(text) < 3 || text[0] != '[' || text[2] != ']' {
+		return false, nil, false
+	}
+	switch text[1] {
+	case ' ':
+	case 'x', 'X':
+		checked = true
+	default:
+		return false, nil, false
+	}
+	rest = text[3:]
+	if len(rest) != 0 && rest[0] != ' ' && rest[0] != '\t' && rest[0] != '\n' {
+		return false, nil, false
+	}
+	return checked, rest, true
+}
+
+// isTaskCheckbox reports whether node is a checkbox added by taskLists
+func isTaskCheckbox(node ast.Node) bool {
+	span, ok := node.(*ast.HTMLSpan)
+	return ok && span.Attribute != nil && len(span.Attribute.Classes) != 0 &&
+		bytes.Equal(span.Attribute.Classes[0], []byte(taskCheckboxClass))
+}
+
+// taskListItems renders list items marked by taskLists with a class
+func taskListItems(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	item, ok := node.(*ast.ListItem)
+	if !ok || !entering || item.Attribute == nil || len(item.Attribute.Classes) == 0 ||
+		!bytes.Equal(item.Attribute.Classes[0], []byte(taskListItemClass)) {
+		return ast.GoToNext, false
+	}
+	io.WriteString(w, `<li class="`+taskListItemClass+`">`)
+	return ast.GoToNext, true
+}
@@ -0,0 +1,102 @@
+package render
+
+import (
+	"bytes"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// wikiLinks replaces [[Page Name]] and [[Link text|Page Name]] in text nodes
+// of doc with links to destinations returned by resolve
+func wikiLinks(doc ast.Node, resolve func(page string) string) {
+	replaceText(doc, func(text []byte) []ast.Node {
+		if !bytes.Contains(text, []byte("[[")) {
+			return nil
+		}
+		return splitWikiLinks(text, resolve)
+	})
+}
+
+// replaceText calls split for text nodes of doc outside of links and code,
+// and replaces them with nodes it returns, unless it returns nil
+func replaceText(doc ast.Node, split func(text []byte) []ast.Node) {
+	var texts []*ast.Text
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch n := node.(type) {
+		case *ast.Link, *ast.Image, *ast.CodeBlock, *ast.Code, *ast.HTMLBlock:
+			return ast.SkipChildren
+		case *ast.Text:
+			if entering {
+				texts = append(texts, n)
+			}
+		}
+		return ast.GoToNext
+	})
+	for _, text := range texts {
+		nodes := split(text.Literal)
+		if nodes == nil {
+			continue
+		}
+		parent := text.GetParent()
+		var children []ast.Node
+		for _, child := range parent.GetChildren() {
+			if child != text {
+				children = append(children, child)
+				continue
+			}
+			for _, n := range nodes {
+				n.SetParent(parent)
+				children = append(children, n)
+			}
+		}
+		parent.SetChildren(children)
+	}
+}
+
+// splitWikiLinks splits text into text and link nodes, it returns nil if text
+// has no wiki links
+func splitWikiLinks(text []byte, resolve func(page string) string) []ast.Node {
+	var nodes []ast.Node
+	var found bool
+	for {
+		start := bytes.Index(text, []byte("[["))
+		if start < 0 {
+			break
+		}
+		end := bytes.Index(text[start:], []byte("]]"))
+		if end < 0 {
+			break
+		}
+		end += start
+		inner := text[start+2 : end]
+		label, page := inner, inner
+		if i := bytes.IndexByte(inner, '|'); i >= 0 {
+			label, page = inner[:i], inner[i+1:]
+		}
+		label, page = bytes.TrimSpace(label), bytes.TrimSpace(page)
+		var dst string
+		if len(page) != 0 && bytes.IndexByte(inner, '\n') < 0 {
+			dst = resolve(string(page))
+		}
+		if dst == "" {
+			nodes = append(nodes, &ast.Text{Leaf: ast.Leaf{Literal: text[:end+2]}})
+			text = text[end+2:]
+			continue
+		}
+		found = true
+		if start > 0 {
+			nodes = append(nodes, &ast.Text{Leaf: ast.Leaf{Literal: text[:start]}})
+		}
+		link := &ast.Link{Destination: []byte(dst)}
+		ast.AppendChild(link, &ast.Text{Leaf: ast.Leaf{Literal: label}})
+		nodes = append(nodes, link)
+		text = text[end+2:]
+	}
+	if !found {
+		return nil
+	}
+	if len(text) != 0 {
+		nodes = append(nodes, &ast.Text{Leaf: ast.Leaf{Literal: text}})
+	}
+	return nodes
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+)
+
+// resolveName looks up markdown file name case-insensitively when there's no
+// file with exactly this name, the way GitHub wiki resolves page URLs:
+// directories are matched ignoring case, and file base names are compared
+// with wikiKey, so "page-name.md" finds "Page Name.md". It returns the name
+// of found file, and false if there's no such file or there are several
+// equally good matches.
+func (h *mdHandler) resolveName(name string) (string, bool) {
+	if !strings.HasSuffix(name, mdSuffix) {
+		return "", false
+	}
+	fsys := h.files()
+	if _, err := fs.Stat(fsys, name); !errors.Is(err, fs.ErrNotExist) {
+		return "", false
+	}
+	parts := strings.Split(name, "/")
+	dir := "."
+	for i, part := range parts {
+		last := i == len(parts)-1
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			return "", false
+		}
+		var found string
+		var n int
+		for _, e := range entries {
+			switch {
+			case e.Name() == part:
+				found, n = e.Name(), 1
+			case n > 0 && found == part:
+			case last && strings.HasSuffix(e.Name(), mdSuffix) &&
+				wikiKey(e.Name()) == wikiKey(part):
+				found, n = e.Name(), n+1
+			case !last && e.IsDir() && strings.EqualFold(e.Name(), part):
+				found, n = e.Name(), n+1
+			}
+		}
+		if n != 1 {
+			return "", false
+		}
+		if dir == "." {
+			dir = found
+		} else {
+			dir += "/" + found
+		}
+	}
+	if h.excluded(dir) {
+		return "", false
+	}
+	return dir, true
+}
@@ -0,0 +1,18 @@
+package main
+
+// values of -sanitize flag
+const (
+	sanitizeStrict  = "strict"  // html of documents is shown as text
+	sanitizeUGC     = "ugc"     // html is sanitized with render.DefaultPolicy
+	sanitizeRelaxed = "relaxed" // html is sanitized with render.RelaxedPolicy
+	sanitizeOff     = "off"     // html is kept as is
+)
+
+// validSanitize reports whether s is a valid -sanitize flag value
+func validSanitize(s string) bool {
+	switch s {
+	case sanitizeStrict, sanitizeUGC, sanitizeRelaxed, sanitizeOff:
+		return true
+	}
+	return false
+}
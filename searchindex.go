@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/artyom/mdserver/render"
+	"github.com/gomarkdown/markdown/ast"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// textIndex is an in-memory inverted index of words found in markdown files,
+// used for loose search. On search, it is updated for files which were
+// modified since they were indexed, at most once per indexRefreshInterval
+// unless invalidated earlier.
+type textIndex struct {
+	fsys    fs.FS
+	exclude func(string) bool
+
+	mu        sync.Mutex
+	docs      map[string]*indexedDoc
+	postings  map[string]map[string]int // word -> file -> number of occurrences
+	words     []string                  // sorted keys of postings, nil if outdated
+	refreshed time.Time                 // when files were last checked, zero if invalidated
+}
+
+type indexedDoc struct {
+	mtime time.Time
+	size  int64
+	title string
+	text  []byte
+	words map[string]struct{} // normalized words of document text
+}
+
+// maxIndexedSize limits how much of each file is indexed, matching limit
+// used by search over files
+const maxIndexedSize = 1 << 20
+
+// indexRefreshInterval is how often textIndex checks files for changes
+const indexRefreshInterval = 10 * time.Second
+
+func newTextIndex(fsys fs.FS, exclude func(string) bool) *textIndex {
+	return &textIndex{
+		fsys:     fsys,
+		exclude:  exclude,
+		docs:     make(map[string]*indexedDoc),
+		postings: make(map[string]map[string]int),
+	}
+}
+
+// invalidate makes the next search check files for changes
+func (ix *textIndex) invalidate() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.refreshed = time.Time{}
+}
+
+// refresh walks file system, indexing new and modified files and dropping
+// removed ones, unless it was done recently. Must be called with ix.mu held.
+func (ix *textIndex) refresh(ctx context.Context) error {
+	if !ix.refreshed.IsZero() && time.Since(ix.refreshed) < indexRefreshInterval {
+		return nil
+	}
+	files, err := markdownFiles(ctx, ix.fsys, ".", ix.exclude)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]struct{}, len(files))
+	for _, name := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		seen[name] = struct{}{}
+		st, err := fs.Stat(ix.fsys, name)
+		if err != nil {
+			ix.remove(name)
+			continue
+		}
+		if d, ok := ix.docs[name]; ok && d.mtime.Equal(st.ModTime()) && d.size == st.Size() {
+			continue
+		}
+		ix.remove(name)
+		f, err := ix.fsys.Open(name)
+		if err != nil {
+			continue
+		}
+		text, err := ioutil.ReadAll(io.LimitReader(f, maxIndexedSize))
+		f.Close()
+		if err != nil {
+			continue
+		}
+		ix.add(name, &indexedDoc{mtime: st.ModTime(), size: st.Size(), text: text})
+	}
+	for name := range ix.docs {
+		if _, ok := seen[name]; !ok {
+			ix.remove(name)
+		}
+	}
+	ix.refreshed = time.Now()
+	return nil
+}
+
+func (ix *textIndex) add(name string, d *indexedDoc) {
+	d.title = documentMeta(ix.fsys, name).Title
+	if d.title == "" {
+		d.title = nameToTitle(path.Base(name))
+	}
+	d.words = make(map[string]struct{})
+	for _, w := range splitWords(string(d.text)) {
+		d.words[w] = struct{}{}
+		p := ix.postings[w]
+		if p == nil {
+			p = make(map[string]int)
+			ix.postings[w] = p
+			ix.words = nil
+		}
+		p[name]++
+	}
+	ix.docs[name] = d
+}
+
+func (ix *textIndex) remove(name string) {
+	d, ok := ix.docs[name]
+	if !ok {
+		return
+	}
+	for w := range d.words {
+		delete(ix.postings[w], name)
+		if len(ix.postings[w]) == 0 {
+			delete(ix.postings, w)
+			ix.words = nil
+		}
+	}
+	delete(ix.docs, name)
+}
+
+// matchingWords returns indexed words starting with prefix. Must be called
+// with ix.mu held.
+func (ix *textIndex) matchingWords(prefix string) []string {
+	if ix.words == nil {
+		ix.words = make([]string, 0, len(ix.postings))
+		for w := range ix.postings {
+			ix.words = append(ix.words, w)
+		}
+		sort.Strings(ix.words)
+	}
+	i := sort.SearchStrings(ix.words, prefix)
+	j := i
+	for j < len(ix.words) && strings.HasPrefix(ix.words[j], prefix) {
+		j++
+	}
+	return ix.words[i:j]
+}
+
+// search returns files having all words of query q, or words starting with
+// them, ranked by relevance. Index finds candidates with words folded the
+// same for all languages, which are then checked to match every word of q
+// under collation rules of lang, so that, for example, German ß matches ss,
+// but Turkish ı does not match i. Each result has a snippet with highlighted
+// matches. Only files in slash separated directory dir are searched, unless
+// it's empty. If ctx is canceled before index is fully updated, search works
+// on partially updated index and returns ctx.Err() along with results.
+func (ix *textIndex) search(ctx context.Context, lang language.Tag, q, dir string) ([]indexRecord, error) {
+	terms := splitWords(q)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	err := ix.refresh(ctx)
+	scores := make(map[string]float64)
+	for i, term := range terms {
+		termScores := make(map[string]float64)
+		for _, w := range ix.matchingWords(term) {
+			p := ix.postings[w]
+			idf := math.Log(1 + float64(len(ix.docs))/float64(len(p)))
+			for name, n := range p {
+				if dir != "" && !strings.HasPrefix(name, dir+"/") {
+					continue
+				}
+				termScores[name] += float64(n) * idf
+			}
+		}
+		for name, s := range termScores {
+			if i > 0 {
+				if _, ok := scores[name]; !ok {
+					continue
+				}
+			}
+			if titleHasPrefix(ix.docs[name].title, term) {
+				s *= 2
+			}
+			scores[name] += s
+		}
+		for name := range scores {
+			if _, ok := termScores[name]; !ok {
+				delete(scores, name)
+			}
+		}
+	}
+	var matchers []lineMatcher
+	for _, w := range textWords(q) {
+		if normalizeWord(w) != "" {
+			matchers = append(matchers, looseMatcher(lang, w))
+		}
+	}
+	index := make([]indexRecord, 0, len(scores))
+scores:
+	for name, score := range scores {
+		d := ix.docs[name]
+		for _, m := range matchers {
+			if start, _ := m(d.text); start < 0 {
+				continue scores
+			}
+		}
+		match := matchText(d.text, matchers)
+		index = append(index, indexRecord{
+			Title:   d.title,
+			File:    name,
+			Subdir:  path.Dir(name),
+			Count:   match.count,
+			Snippet: match.snippet,
+			Anchor:  match.anchor,
+			score:   score,
+		})
+	}
+	sort.Slice(index, func(i, j int) bool {
+		if index[i].score != index[j].score {
+			return index[i].score > index[j].score
+		}
+		return index[i].File < index[j].File
+	})
+	return index, err
+}
+
+// splitWords splits text into lowercase words with diacritical marks removed
+// and letters folded, see normalizeWord
+func splitWords(text string) []string {
+	words := textWords(text)
+	out := words[:0]
+	for _, w := range words {
+		if w = normalizeWord(w); w != "" {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// textWords splits text into words as is
+func textWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.Is(unicode.Mn, r)
+	})
+}
+
+// normalizeWord lowercases w, removes diacritical marks and folds letters
+// which some languages treat as equal to others, like ß and ss. Words equal
+// under collation rules of any language must be normalized the same, so
+// that search can find them before checking these rules.
+func normalizeWord(w string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(w)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case foldedLetters[r] != "":
+			b.WriteString(foldedLetters[r])
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// foldedLetters maps letters without decompositions to ones they may be
+// equal to under collation rules
+var foldedLetters = map[rune]string{
+	'ß': "ss", 'ı': "i", 'ø': "o", 'đ': "d", 'ł': "l", 'æ': "ae", 'œ': "oe",
+}
+
+func titleHasPrefix(title, prefix string) bool {
+	for _, w := range splitWords(title) {
+		if strings.HasPrefix(w, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// snippetLen is approximate max length of search result snippet, in bytes
+const snippetLen = 160
+
+// textMatch describes lines of markdown document matching search query
+type textMatch struct {
+	count   int           // number of matching lines, up to maxMatchesPerFile
+	snippet template.HTML // the first matching line with matches highlighted
+	anchor  string        // id of the heading preceding the first match
+}
+
+// matchText finds lines of markdown text matching any of ms. Snippet of the
+// first match has matches wrapped into <mark> elements.
+func matchText(text []byte, ms []lineMatcher) textMatch {
+	var match textMatch
+	_, body := splitFrontMatter(text)
+	bodyStart := len(text) - len(body)
+	var heading, prev []byte // last heading and previous line
+	var fence bool           // inside fenced code block
+	for pos := 0; pos < len(text); {
+		line := text[pos:]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		lineStart := pos
+		pos += len(line) + 1
+		if match.snippet == "" && lineStart >= bodyStart {
+			trimmed := bytes.TrimSpace(line)
+			switch {
+			case bytes.HasPrefix(trimmed, []byte("```")), bytes.HasPrefix(trimmed, []byte("~~~")):
+				fence = !fence
+			case fence:
+			case bytes.HasPrefix(line, []byte("#")):
+				if rest := bytes.TrimLeft(line, "#"); len(rest) == 0 || rest[0] == ' ' || rest[0] == '\t' {
+					heading = line
+				}
+			case len(bytes.TrimSpace(prev)) != 0 && len(trimmed) != 0 &&
+				(len(bytes.Trim(trimmed, "=")) == 0 || len(bytes.Trim(trimmed, "-")) == 0):
+				// setext heading underline
+				heading = append([]byte("# "), bytes.TrimSpace(prev)...)
+			}
+			prev = line
+		}
+		spans := matchSpans(line, ms)
+		if len(spans) == 0 {
+			continue
+		}
+		if match.snippet == "" {
+			match.snippet = renderSnippet(line, spans)
+			match.anchor = headingID(heading)
+		}
+		if match.count++; match.count == maxMatchesPerFile {
+			break
+		}
+	}
+	return match
+}
+
+// headingID returns id given to heading when rendering markdown line
+func headingID(line []byte) string {
+	if len(line) == 0 {
+		return ""
+	}
+	var id string
+	ast.WalkFunc(render.Parse(line, render.Options{}), func(node ast.Node, entering bool) ast.WalkStatus {
+		if h, ok := node.(*ast.Heading); ok && entering {
+			id = h.HeadingID
+			return ast.Terminate
+		}
+		return ast.GoToNext
+	})
+	return id
+}
+
+// matchSpans returns sorted non-overlapping [start, end) spans of line
+// matched by ms
+func matchSpans(line []byte, ms []lineMatcher) [][2]int {
+	var spans [][2]int
+	for _, m := range ms {
+		for off := 0; off < len(line); {
+			start, end := m(line[off:])
+			if start < 0 || end <= start {
+				break
+			}
+			spans = append(spans, [2]int{off + start, off + end})
+			off += end
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	out := spans[:0]
+	for _, s := range spans {
+		if n := len(out); n > 0 && s[0] < out[n-1][1] {
+			if s[1] > out[n-1][1] {
+				out[n-1][1] = s[1]
+			}
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// renderSnippet renders up to snippetLen bytes of line around its first span,
+// wrapping spans into <mark> elements
+func renderSnippet(line []byte, spans [][2]int) template.HTML {
+	from, to := 0, len(line)
+	if to-from > snippetLen {
+		if from = spans[0][0] - snippetLen/4; from < 0 {
+			from = 0
+		}
+		if to = from + snippetLen; to > len(line) {
+			to = len(line)
+		}
+		// don't cut multi-byte characters
+		for from > 0 && !utf8.RuneStart(line[from]) {
+			from--
+		}
+		for to < len(line) && !utf8.RuneStart(line[to]) {
+			to++
+		}
+	}
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := from
+	for _, s := range spans {
+		if s[1] <= from || s[0] >= to {
+			continue
+		}
+		start, end := s[0], s[1]
+		if start < pos {
+			start = pos
+		}
+		if end > to {
+			end = to
+		}
+		template.HTMLEscape(&b, line[pos:start])
+		b.WriteString("<mark>")
+		template.HTMLEscape(&b, line[start:end])
+		b.WriteString("</mark>")
+		pos = end
+	}
+	template.HTMLEscape(&b, line[pos:to])
+	if to < len(line) {
+		b.WriteString("…")
+	}
+	return template.HTML(strings.TrimSpace(b.String()))
+}
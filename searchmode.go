@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// search modes, selected with "mode" query parameter or query prefix
+const (
+	searchLoose  = "loose"  // case and accent insensitive, see looseMatcher
+	searchExact  = "exact"  // case-sensitive substring, see exactMatcher
+	searchRegexp = "regexp" // regular expression, see regexpMatcher
+)
+
+// regexpPrefix is a search query prefix forcing regular expression search
+const regexpPrefix = "regexp:"
+
+// maxRegexpLen limits length of regular expression search query. Go regular
+// expressions run in time linear to input size, which is limited by
+// maxIndexedSize per file and by -searchtimeout in total, so only
+// expression size needs a guard.
+const maxRegexpLen = 256
+
+// queryError is returned by search for queries it can't search for
+type queryError string
+
+func (e queryError) Error() string { return string(e) }
+
+// searchMode returns search mode and term of query q. Query prefix takes
+// precedence over mode given explicitly, and without either, mode is set by
+// -searchexact flag.
+func (h *mdHandler) searchMode(q, mode string) (string, string) {
+	switch {
+	case strings.HasPrefix(q, exactPrefix):
+		return searchExact, strings.TrimPrefix(q, exactPrefix)
+	case strings.HasPrefix(q, regexpPrefix):
+		return searchRegexp, strings.TrimPrefix(q, regexpPrefix)
+	}
+	switch mode {
+	case searchLoose, searchExact, searchRegexp:
+		return mode, q
+	}
+	if h.exactMatch {
+		return searchExact, q
+	}
+	return searchLoose, q
+}
+
+// regexpMatcher returns lineMatcher matching regular expression q
+func regexpMatcher(q string) (lineMatcher, error) {
+	if len(q) > maxRegexpLen {
+		return nil, queryError(fmt.Sprintf("regular expression is longer than %d bytes", maxRegexpLen))
+	}
+	re, err := regexp.Compile(q)
+	if err != nil {
+		return nil, queryError(strings.TrimPrefix(err.Error(), "error parsing regexp: "))
+	}
+	return func(line []byte) (int, int) {
+		loc := re.FindIndex(line)
+		if loc == nil {
+			return -1, -1
+		}
+		return loc[0], loc[1]
+	}, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// searchScope limits search to files in directory and having tags
+type searchScope struct {
+	dir  string   // slash separated directory relative to root, empty for all files
+	tags []string // tags files must all have, compared case-insensitively
+}
+
+// readSearchScope returns scope set by "path" query parameter, like "ops/",
+// and "tag" ones, which can be repeated
+func readSearchScope(q url.Values) searchScope {
+	var s searchScope
+	if p := q.Get("path"); p != "" && !containsDotDot(p) {
+		s.dir = strings.Trim(path.Clean("/"+p), "/")
+	}
+	for _, tag := range q["tag"] {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			s.tags = append(s.tags, tag)
+		}
+	}
+	return s
+}
+
+// filter returns records of index within scope. Records without tags, like
+// those found with full-text index, get them from document front matter.
+func (s searchScope) filter(fsys fs.FS, index []indexRecord) []indexRecord {
+	if s.dir == "" && len(s.tags) == 0 {
+		return index
+	}
+	out := index[:0]
+	for _, rec := range index {
+		if s.dir != "" && !strings.HasPrefix(rec.File, s.dir+"/") {
+			continue
+		}
+		if len(s.tags) != 0 && rec.Tags == nil {
+			rec.Tags = documentMeta(fsys, rec.File).Tags
+		}
+		if s.hasTags(rec.Tags) {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// hasTags reports whether tags include all tags of scope
+func (s searchScope) hasTags(tags []string) bool {
+outer:
+	for _, want := range s.tags {
+		for _, t := range tags {
+			if strings.EqualFold(t, want) {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// describe returns scope description appended to search results title
+func (s searchScope) describe() string {
+	var b strings.Builder
+	if s.dir != "" {
+		fmt.Fprintf(&b, " in %s/", s.dir)
+	}
+	for i, tag := range s.tags {
+		if i == 0 {
+			b.WriteString(" tagged")
+		} else {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, " %q", tag)
+	}
+	return b.String()
+}
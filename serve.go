@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long server waits for active requests to complete
+// on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// unixPrefix marks -addr value as a path of unix socket
+const unixPrefix = "unix:"
+
+// listen returns listener passed by systemd socket activation if there's
+// one, or a new listener on addr otherwise. Address in "unix:/path/to.sock"
+// form is a path of unix socket, stale socket file left there is removed;
+// socket file is removed when listener is closed.
+func listen(addr string) (net.Listener, error) {
+	ln, err := activationListener()
+	if ln != nil || err != nil {
+		return ln, err
+	}
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	name := strings.TrimPrefix(addr, unixPrefix)
+	if st, err := os.Lstat(name); err == nil {
+		if st.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", name)
+		}
+		// connecting to a live socket succeeds, so it's not stale
+		if c, err := net.Dial("unix", name); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", name)
+		}
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", name)
+}
+
+// activationListener returns listener from the first file descriptor passed
+// by systemd, see sd_listen_fds(3). It returns nil if process was not
+// started with socket activation.
+func activationListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	// passed descriptors start from 3
+	const fd = 3
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(fd, "systemd socket")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %w", err)
+	}
+	return ln, nil
+}
+
+// serve serves HTTP on ln, or HTTPS if srv.TLSConfig is set or certFile is
+// not empty, until process receives SIGINT or SIGTERM, and then gracefully
+// shuts server down
+func serve(srv *http.Server, ln net.Listener, certFile, keyFile string) error {
+	errCh := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil || certFile != "" {
+			errCh <- srv.ServeTLS(ln, certFile, keyFile)
+			return
+		}
+		errCh <- srv.Serve(ln)
+	}()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	select {
+	case err := <-errCh:
+		return err
+	case sig := <-sigCh:
+		log.Printf("%v received, shutting down", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// index sort orders, see sortIndex
+const (
+	sortByName  = "name"
+	sortByTitle = "title"
+	sortByMtime = "mtime"
+)
+
+// validSort reports whether s is a known index sort order
+func validSort(s string) bool {
+	return s == sortByName || s == sortByTitle || s == sortByMtime
+}
+
+// sortIndex sorts index records by file name, title or modification time
+// within each subdirectory, keeping records of the same subdirectory
+// together.
+func sortIndex(index []indexRecord, by string, desc bool) {
+	less := func(a, b *indexRecord) bool { return a.sortKey < b.sortKey }
+	switch by {
+	case sortByTitle:
+		less = func(a, b *indexRecord) bool {
+			if ta, tb := strings.ToLower(a.Title), strings.ToLower(b.Title); ta != tb {
+				return ta < tb
+			}
+			return a.sortKey < b.sortKey
+		}
+	case sortByMtime:
+		less = func(a, b *indexRecord) bool {
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+			return a.sortKey < b.sortKey
+		}
+	}
+	sort.SliceStable(index, func(i, j int) bool {
+		a, b := &index[i], &index[j]
+		if a.Subdir != b.Subdir {
+			return a.Subdir < b.Subdir
+		}
+		if desc {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+}
+
+// sortLink is a link to index sorted in a different way
+type sortLink struct {
+	Name    string
+	Href    string
+	Current bool
+}
+
+// sortLinks returns links to index with given query, like "index", sorted
+// in every supported way; link to the current sort order reverses it.
+func sortLinks(query, by string, desc bool) []sortLink {
+	var links []sortLink
+	for _, s := range []struct{ by, name string }{
+		{sortByName, "name"},
+		{sortByTitle, "title"},
+		{sortByMtime, "last updated"},
+	} {
+		v := url.Values{"sort": {s.by}}
+		// most recently updated files are usually more interesting
+		linkDesc := s.by == sortByMtime
+		if s.by == by {
+			linkDesc = !desc
+		}
+		if linkDesc {
+			v.Set("order", "desc")
+		}
+		links = append(links, sortLink{Name: s.name, Href: "?" + query + "&" + v.Encode(), Current: s.by == by})
+	}
+	return links
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// servePrecompressed serves gzip-compressed variant of static file name, if
+// there's a name+".gz" file next to it and client accepts gzip encoding. It
+// returns false if request should be handled as usual.
+func (h *mdHandler) servePrecompressed(w http.ResponseWriter, r *http.Request, name string) bool {
+	if !acceptsGzip(r) {
+		return false
+	}
+	st, err := fs.Stat(h.files(), name)
+	if err != nil || !st.Mode().IsRegular() {
+		return false
+	}
+	f, err := h.files().Open(name + ".gz")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	gzSt, err := f.Stat()
+	if err != nil || !gzSt.Mode().IsRegular() || gzSt.ModTime().Before(st.ModTime()) {
+		return false
+	}
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		if ctype, err = sniffContentType(h.files(), name); err != nil {
+			return false
+		}
+	}
+	hdr := w.Header()
+	hdr.Set("Content-Type", ctype)
+	hdr.Set("Content-Encoding", "gzip")
+	addVary(hdr, "Accept-Encoding")
+	http.ServeContent(w, r, "", gzSt.ModTime(), rs)
+	return true
+}
+
+// sniffContentType detects content type of file using http.DetectContentType
+func sniffContentType(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b := make([]byte, 512)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(b[:n]), nil
+}
+
+// addVary adds value to the Vary header unless it's already there
+func addVary(hdr http.Header, value string) {
+	for _, v := range hdr["Vary"] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return
+			}
+		}
+	}
+	hdr.Add("Vary", value)
+}
+
+// acceptsGzip reports whether request's Accept-Encoding header allows gzip
+// encoding.
+func acceptsGzip(r *http.Request) bool {
+	for _, s := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.SplitN(s, ";", 2)
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		if len(parts) == 1 {
+			return true
+		}
+		qv := strings.TrimSpace(parts[1])
+		if !strings.HasPrefix(qv, "q=") {
+			return false
+		}
+		q, err := strconv.ParseFloat(strings.TrimPrefix(qv, "q="), 64)
+		return err == nil && q > 0
+	}
+	return false
+}
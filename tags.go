@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// tagCount is a tag with number of documents having it
+type tagCount struct {
+	Name  string
+	Count int
+}
+
+// countTags returns tags of index records, sorted by name, along with the
+// number of records having each. Tags differing only in case are counted
+// as the same tag.
+func countTags(index []indexRecord) []tagCount {
+	seen := make(map[string]int) // lowercase tag -> index in out
+	var out []tagCount
+	for _, rec := range index {
+		for _, tag := range rec.Tags {
+			key := strings.ToLower(tag)
+			i, ok := seen[key]
+			if !ok {
+				i = len(out)
+				seen[key] = i
+				out = append(out, tagCount{Name: tag})
+			}
+			out[i].Count++
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.ToLower(out[i].Name) < strings.ToLower(out[j].Name)
+	})
+	return out
+}
+
+// filterByTag returns records of index having tag, compared case-insensitively
+func filterByTag(index []indexRecord, tag string) []indexRecord {
+	var out []indexRecord
+	for _, rec := range index {
+		for _, t := range rec.Tags {
+			if strings.EqualFold(t, tag) {
+				out = append(out, rec)
+				break
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// isTarGz reports whether file name looks like gzip-compressed tar archive
+func isTarGz(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// maxUnpackedSize limits total size of files in archive opened by openTarGz
+var maxUnpackedSize int64 = 1 << 30
+
+// openTarGz opens gzip-compressed tar archive and returns its files as
+// fs.FS. Tar archives can't be accessed randomly, so archive is repacked
+// into uncompressed zip archive in a temporary file, which is removed right
+// away and then served as the one given with -zip flag. Entries other than
+// regular files and directories are skipped.
+func openTarGz(name string) (fs.FS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "mdserver-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name())
+	fsys, err := repackTar(tmp, tar.NewReader(gr))
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// repackTar writes files of tr into zip archive in tmp file, returning them
+// as fs.FS, see openTarGz
+func repackTar(tmp *os.File, tr *tar.Reader) (fs.FS, error) {
+	bw := bufio.NewWriter(tmp)
+	zw := zip.NewWriter(bw)
+	left := maxUnpackedSize
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		p := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if p == "." || containsDotDot(p) {
+			continue
+		}
+		fh := &zip.FileHeader{Name: p, Method: zip.Store, Modified: hdr.ModTime}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			fh.SetMode(hdr.FileInfo().Mode())
+		case tar.TypeDir:
+			fh.Name += "/"
+			fh.SetMode(hdr.FileInfo().Mode())
+		default:
+			continue
+		}
+		if left -= hdr.Size; left < 0 {
+			return nil, fmt.Errorf("archive has more than %d bytes of files", maxUnpackedSize)
+		}
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	st, err := tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(tmp, st.Size())
+	if err != nil {
+		return nil, err
+	}
+	return seekableFS{zr}, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// loadTemplates parses *.tmpl files in dir, overriding built-in templates
+// with page.tmpl and index.tmpl found among them. Other files may define
+// templates shared by these two.
+func (h *mdHandler) loadTemplates(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	set := template.New("")
+	hash := sha256.New()
+	for _, name := range files {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if _, err := set.New(filepath.Base(name)).Parse(string(b)); err != nil {
+			return err
+		}
+		hash.Write(b)
+	}
+	h.pageTpl, h.indexTpl = set.Lookup("page.tmpl"), set.Lookup("index.tmpl")
+	if h.pageTpl == nil && h.indexTpl == nil {
+		return fmt.Errorf("neither page.tmpl nor index.tmpl found in %s", dir)
+	}
+	h.templateHash = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"html/template"
+	"strconv"
+	"strings"
+
+	"github.com/artyom/mdserver/render"
+)
+
+// tableOfContents renders list of links to document headings up to
+// -tocdepth level, or returns an empty string if there are less than two
+// such headings. Headings of deeper levels are listed in nested lists; list
+// items have "h1" to "h6" classes matching heading levels.
+func (h *mdHandler) tableOfContents(headings []render.Heading) template.HTML {
+	var b strings.Builder
+	var n int
+	var levels []int // levels of open lists, innermost last
+	for _, hd := range headings {
+		if h.tocDepth > 0 && hd.Level > h.tocDepth {
+			continue
+		}
+		n++
+		switch {
+		case len(levels) == 0:
+			levels = append(levels, hd.Level)
+		case hd.Level > levels[len(levels)-1]:
+			b.WriteString("<ul>")
+			levels = append(levels, hd.Level)
+		default:
+			b.WriteString("</li>")
+			for len(levels) > 1 && levels[len(levels)-2] >= hd.Level {
+				b.WriteString("</ul></li>")
+				levels = levels[:len(levels)-1]
+			}
+			levels[len(levels)-1] = hd.Level
+		}
+		b.WriteString(`<li class="h` + strconv.Itoa(hd.Level) + `"><a href="#`)
+		template.HTMLEscape(&b, []byte(hd.ID))
+		b.WriteString(`">`)
+		template.HTMLEscape(&b, []byte(hd.Text))
+		b.WriteString("</a>")
+	}
+	if n < 2 {
+		return ""
+	}
+	b.WriteString("</li>" + strings.Repeat("</ul></li>", len(levels)-1))
+	return template.HTML(`<nav id="toc"><details open><summary>Contents</summary><ul>` + b.String() + "</ul></details></nav>")
+}
+
+// validTOC reports whether s is a valid -toc flag value
+func validTOC(s string) bool {
+	switch s {
+	case tocTop, tocSidebar, tocOff:
+		return true
+	}
+	return false
+}
+
+// values of -toc flag
+const (
+	tocTop     = "top"
+	tocSidebar = "sidebar"
+	tocOff     = "off"
+)
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// varPattern matches variable reference in markdown source, like {{version}}
+var varPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][\w.-]*)\s*\}\}`)
+
+// setVars sets variables substituted into documents from comma-separated
+// name=value list, and values of environment variables from comma-separated
+// list of their names. Unset environment variables are skipped.
+func (h *mdHandler) setVars(list, env string) error {
+	vars := make(map[string]string)
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		i := strings.IndexByte(s, '=')
+		if i <= 0 || !varPattern.MatchString("{{"+s[:i]+"}}") {
+			return fmt.Errorf("invalid variable %q, must be in name=value form", s)
+		}
+		vars[s[:i]] = s[i+1:]
+	}
+	for _, name := range strings.Split(env, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			vars[name] = v
+		}
+	}
+	if len(vars) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + "=" + vars[name] + "\x00")
+	}
+	h.vars, h.varsKey = vars, b.String()
+	return nil
+}
+
+// substituteVars replaces references to known variables in markdown source b
+// with their values, leaving other references as is. It's only applied to
+// documents being rendered, titles read by documentMeta and text index are
+// not substituted.
+func (h *mdHandler) substituteVars(b []byte) []byte {
+	if len(h.vars) == 0 || !bytes.Contains(b, []byte("{{")) {
+		return b
+	}
+	return varPattern.ReplaceAllFunc(b, func(m []byte) []byte {
+		if v, ok := h.vars[string(varPattern.FindSubmatch(m)[1])]; ok {
+			return []byte(v)
+		}
+		return m
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// viewCookie stores reader's presentation preferences, see readView
+const viewCookie = "mdserver-view"
+
+// viewCookieAge is how long viewCookie is kept by browsers
+const viewCookieAge = 365 * 24 * time.Hour
+
+// viewPrefs are presentation preferences of a reader, overriding ones set by
+// flags
+type viewPrefs struct {
+	noTOC bool   // hide table of contents
+	theme string // color theme, see -theme flag; empty to use flag value
+	wide  bool   // don't limit width of text
+}
+
+// readView returns reader's presentation preferences saved in cookie,
+// updated with request query parameters: "notoc" or "toc", "theme" set to
+// "light", "dark" or "auto", and "width" set to "wide" or "normal". If query
+// changes preferences, they're saved in cookie for subsequent requests.
+func readView(w http.ResponseWriter, r *http.Request) viewPrefs {
+	var v viewPrefs
+	if c, err := r.Cookie(viewCookie); err == nil {
+		if vals, err := url.ParseQuery(c.Value); err == nil {
+			v.update(vals)
+		}
+	}
+	vals, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return v
+	}
+	saved := v
+	if v.update(vals); v == saved {
+		return v
+	}
+	c := &http.Cookie{
+		Name:     viewCookie,
+		Value:    v.encode(),
+		Path:     "/",
+		MaxAge:   int(viewCookieAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if c.Value == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+	return v
+}
+
+// update changes preferences set in vals, see readView
+func (v *viewPrefs) update(vals url.Values) {
+	if _, ok := vals["notoc"]; ok {
+		v.noTOC = true
+	}
+	if _, ok := vals["toc"]; ok {
+		v.noTOC = false
+	}
+	if t := vals.Get("theme"); validTheme(t) {
+		v.theme = t
+	}
+	switch vals.Get("width") {
+	case "wide":
+		v.wide = true
+	case "normal":
+		v.wide = false
+	}
+}
+
+// encode returns preferences in query form understood by update
+func (v viewPrefs) encode() string {
+	vals := make(url.Values)
+	if v.noTOC {
+		vals.Set("notoc", "")
+	}
+	if v.theme != "" {
+		vals.Set("theme", v.theme)
+	}
+	if v.wide {
+		vals.Set("width", "wide")
+	}
+	return vals.Encode()
+}
+
+// themes are valid -theme flag values, in order their stylesheets are listed
+// in Content-Security-Policy
+var themes = []string{"light", "dark", "auto"}
+
+// validTheme reports whether s is a valid -theme flag value
+func validTheme(s string) bool {
+	for _, t := range themes {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+// themeStyle returns addition to built-in stylesheet implementing theme
+func themeStyle(theme string) string {
+	switch theme {
+	case "dark":
+		return "\n@media screen {" + darkStyle + "}\n"
+	case "auto":
+		return "\n@media screen and (prefers-color-scheme: dark) {" + darkStyle + "}\n"
+	}
+	return ""
+}
+
+// themedStyle is a built-in stylesheet for one of themes
+type themedStyle struct {
+	style, hash string
+}
+
+// viewStyle returns stylesheet (or its href if run with -csslink) matching
+// preferences v. Theme preference only affects built-in stylesheet.
+func (h *mdHandler) viewStyle(v viewPrefs) string {
+	if s, ok := h.themes[v.theme]; ok {
+		return s.style
+	}
+	style, _ := h.styles()
+	return style
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchPath is a path of server-sent events stream notifying pages about file
+// changes when run with -watch flag
+const watchPath = "/.watch"
+
+// watchScript is embedded into rendered pages when run with -watch flag, it
+// reloads page once server reports file changes
+const watchScript = `new EventSource("` + watchPath + `").onmessage = function() { location.reload() };`
+
+var watchScriptHash = styleHash(watchScript)
+
+// watchDelay is how long watcher waits for more changes before notifying
+// clients, so that a burst of changes, as when editor saves a file, results
+// in a single reload
+const watchDelay = 100 * time.Millisecond
+
+// watcher tracks changes in directory tree and notifies clients subscribed
+// to its server-sent events stream
+type watcher struct {
+	w *fsnotify.Watcher
+
+	mu        sync.Mutex
+	clients   map[chan struct{}]struct{}
+	callbacks []func() // called on every change, see onChange
+
+	done      chan struct{} // closed to end all event streams
+	closeOnce sync.Once
+}
+
+func newWatcher(dirs ...string) (*watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	wt := &watcher{w: fw, clients: make(map[chan struct{}]struct{}), done: make(chan struct{})}
+	for _, dir := range dirs {
+		if err := wt.addTree(dir); err != nil {
+			fw.Close()
+			return nil, err
+		}
+	}
+	go wt.loop()
+	return wt, nil
+}
+
+// addTree adds dir and its subdirectories, except hidden ones, to watched
+// directories
+func (wt *watcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if p != dir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return wt.w.Add(p)
+	})
+}
+
+func (wt *watcher) loop() {
+	var timer <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-wt.w.Events:
+			if !ok {
+				return
+			}
+			if strings.HasPrefix(filepath.Base(ev.Name), ".") {
+				continue
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if st, err := os.Stat(ev.Name); err == nil && st.IsDir() {
+					if err := wt.addTree(ev.Name); err != nil {
+						log.Printf("watch: %v", err)
+					}
+				}
+			}
+			if timer == nil {
+				timer = time.After(watchDelay)
+			}
+		case err, ok := <-wt.w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("watch: %v", err)
+		case <-timer:
+			timer = nil
+			wt.notify()
+		}
+	}
+}
+
+// onChange makes fn called after files change
+func (wt *watcher) onChange(fn func()) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	wt.callbacks = append(wt.callbacks, fn)
+}
+
+// notify signals all subscribed clients that files have changed
+func (wt *watcher) notify() {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	for _, fn := range wt.callbacks {
+		fn()
+	}
+	for ch := range wt.clients {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// close ends all event streams served by watcher
+func (wt *watcher) close() { wt.closeOnce.Do(func() { close(wt.done) }) }
+
+// ServeHTTP serves server-sent events stream with a message sent on every
+// file change.
+func (wt *watcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan struct{}, 1)
+	wt.mu.Lock()
+	wt.clients[ch] = struct{}{}
+	wt.mu.Unlock()
+	defer func() {
+		wt.mu.Lock()
+		delete(wt.clients, ch)
+		wt.mu.Unlock()
+	}()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, ": watching for changes\n\n")
+	fl.Flush()
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wt.done:
+			return
+		case <-ch:
+			io.WriteString(w, "data: reload\n\n")
+		case <-ping.C:
+			io.WriteString(w, ": ping\n\n")
+		}
+		fl.Flush()
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artyom/mdserver/render"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+)
+
+// GitHub wiki special files rendered on every page, see wikiPart
+const (
+	sidebarFile = "_Sidebar.md"
+	footerFile  = "_Footer.md"
+)
+
+// isWikiPart reports whether markdown file name is one of GitHub wiki special
+// files, which are not standalone documents
+func isWikiPart(name string) bool {
+	base := path.Base(name)
+	return base == sidebarFile || base == footerFile
+}
+
+// wikiPart looks up file part, like _Sidebar.md, in directory of file name and
+// its parent directories, returning the closest one found. It returns an
+// empty string if there's no such file.
+func (h *mdHandler) wikiPart(name, part string) (string, fs.FileInfo) {
+	fsys := h.files()
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		p := path.Join(dir, part)
+		if st, err := fs.Stat(fsys, p); err == nil && st.Mode().IsRegular() && h.insideRoot(p) {
+			return p, st
+		}
+		if dir == "." {
+			return "", nil
+		}
+	}
+}
+
+// renderWikiPart renders wiki part file name with given options, returning
+// an empty string if name is empty or file cannot be read
+func (h *mdHandler) renderWikiPart(name string, opts render.Options) template.HTML {
+	if name == "" {
+		return ""
+	}
+	b, err := fs.ReadFile(h.files(), name)
+	if err != nil {
+		return ""
+	}
+	// part is shown on pages of subdirectories too, so its relative links
+	// must not depend on page location
+	opts.Hooks = append(opts.Hooks, absoluteLinks(path.Dir(name)))
+	opts.WikiLinks = h.wikiLinkResolver(name)
+	if h.inlineImg {
+		opts.Hooks = append(opts.Hooks, h.inlineImagesHook(name))
+	}
+	_, b = splitFrontMatter(b)
+	return template.HTML(render.Markdown(b, opts))
+}
+
+// absoluteLinks returns html.RenderNodeFunc which changes relative link and
+// image destinations of document from dir to absolute ones, leaving rendering
+// to other hooks or renderer itself.
+func absoluteLinks(dir string) html.RenderNodeFunc {
+	return func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+		if !entering {
+			return ast.GoToNext, false
+		}
+		var dst *[]byte
+		switch n := node.(type) {
+		case *ast.Link:
+			dst = &n.Destination
+		case *ast.Image:
+			dst = &n.Destination
+		default:
+			return ast.GoToNext, false
+		}
+		u, err := url.Parse(string(*dst))
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || path.IsAbs(u.Path) {
+			return ast.GoToNext, false
+		}
+		p := path.Join("/", dir, u.Path)
+		if strings.HasSuffix(u.Path, "/") && p != "/" {
+			p += "/"
+		}
+		u.Path = p
+		*dst = []byte(u.String())
+		return ast.GoToNext, false
+	}
+}
+
+// wikiLinkResolver returns function resolving [[Page Name]] links of markdown
+// file name to link destinations, see wikiPages.resolver.
+func (h *mdHandler) wikiLinkResolver(name string) func(string) string {
+	var resolve func(string) string
+	return func(page string) string {
+		if resolve == nil {
+			list, _ := h.wikiFiles.get(context.Background(), h)
+			resolve = newWikiPages(list).resolver(name)
+		}
+		return resolve(page)
+	}
+}
+
+// wikiFileList caches list of markdown files wiki links are resolved
+// against. It's refreshed on access, at most once per wikiFilesInterval
+// unless invalidated earlier.
+type wikiFileList struct {
+	mu      sync.Mutex
+	files   []string
+	gen     int       // incremented every time list changes
+	updated time.Time // when list was last refreshed, zero if invalidated
+}
+
+// wikiFilesInterval is how long list of markdown files is considered fresh
+const wikiFilesInterval = 10 * time.Second
+
+// get returns markdown files of h and generation of the list, which changes
+// along with it, so it can be used in keys of pages with wiki links
+func (c *wikiFileList) get(ctx context.Context, h *mdHandler) ([]string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.updated.IsZero() && time.Since(c.updated) < wikiFilesInterval {
+		return c.files, c.gen
+	}
+	files, err := markdownFiles(ctx, h.files(), ".", h.unlisted)
+	if err != nil {
+		return c.files, c.gen
+	}
+	if c.gen == 0 || !slices.Equal(files, c.files) {
+		c.files = files
+		c.gen++
+	}
+	c.updated = time.Now()
+	return c.files, c.gen
+}
+
+// invalidate makes the next get call refresh list
+func (c *wikiFileList) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updated = time.Time{}
+}
+
+// wikiPages maps wikiKey of markdown file names to their paths
+type wikiPages map[string][]string
+
+func newWikiPages(files []string) wikiPages {
+	pages := make(wikiPages)
+	for _, p := range files {
+		key := wikiKey(strings.TrimSuffix(path.Base(p), mdSuffix))
+		pages[key] = append(pages[key], p)
+	}
+	return pages
+}
+
+// resolver returns function resolving [[Page Name]] links of markdown file
+// name to link destinations. Page name is matched against names of markdown
+// files case-insensitively, with spaces matching hyphens; files in the same
+// directory are preferred. Page name can be followed by "#section". Links to
+// missing pages point to Page-Name.md in the same directory.
+func (pages wikiPages) resolver(name string) func(string) string {
+	return func(page string) string {
+		var frag string
+		if i := strings.IndexByte(page, '#'); i >= 0 {
+			page, frag = strings.TrimSpace(page[:i]), wikiKey(strings.TrimSpace(page[i+1:]))
+		}
+		if page == "" {
+			return (&url.URL{Fragment: frag}).String()
+		}
+		dst := strings.ReplaceAll(page, " ", "-") + mdSuffix
+		if paths := pages[wikiKey(page)]; len(paths) != 0 {
+			dst = "/" + paths[0]
+			for _, p := range paths {
+				if path.Dir(p) == path.Dir(name) {
+					dst = "/" + p
+					break
+				}
+			}
+		}
+		return (&url.URL{Path: dst, Fragment: frag}).String()
+	}
+}
+
+// wikiKey normalizes page name for matching, see wikiLinkResolver
+func wikiKey(s string) string {
+	return strings.ToLower(strings.ReplaceAll(s, " ", "-"))
+}
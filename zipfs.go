@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+)
+
+// seekableFS wraps fs.FS which files don't implement io.Seeker, like files of
+// zip archive, so that they can be served with http.ServeContent. Such files
+// are read into memory when opened.
+type seekableFS struct {
+	fs.FS
+}
+
+func (s seekableFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.(io.Seeker); ok {
+		return f, nil
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return f, nil
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{Reader: bytes.NewReader(b), info: st}, nil
+}
+
+// Stat implements fs.StatFS so that checking file metadata does not read the
+// whole file.
+func (s seekableFS) Stat(name string) (fs.FileInfo, error) { return fs.Stat(s.FS, name) }
+
+// ReadFile implements fs.ReadFileFS
+func (s seekableFS) ReadFile(name string) ([]byte, error) { return fs.ReadFile(s.FS, name) }
+
+// ReadDir implements fs.ReadDirFS
+func (s seekableFS) ReadDir(name string) ([]fs.DirEntry, error) { return fs.ReadDir(s.FS, name) }
+
+// memFile is a fs.File with content held in memory
+type memFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }